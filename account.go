@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+	utils "github.com/gitnoober/chat-go/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	maxNameLength       = 255
+	maxProfileURLLength = 255
+	maxStatusTextLength = 140
+	minPasswordLength   = 8
+	emailVerifyPrefix   = "email:verify:"
+)
+
+// pendingEmailChange is stored until the new address is verified
+type pendingEmailChange struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// validateProfileUpdate checks and normalizes the fields of a profile update
+func validateProfileUpdate(update *service.ProfileUpdate) error {
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+			return fmt.Errorf("name must be between 1 and %d characters", maxNameLength)
+		}
+		update.Name = &name
+	}
+	if update.ProfileURL != nil {
+		u, err := url.Parse(*update.ProfileURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(*update.ProfileURL) > maxProfileURLLength {
+			return fmt.Errorf("profile_url must be an http(s) URL of at most %d characters", maxProfileURLLength)
+		}
+	}
+	if update.StatusText != nil {
+		status := strings.TrimSpace(*update.StatusText)
+		if utf8.RuneCountInString(status) > maxStatusTextLength {
+			return fmt.Errorf("status_text must be at most %d characters", maxStatusTextLength)
+		}
+		update.StatusText = &status
+	}
+	if update.Discoverable != nil {
+		switch *update.Discoverable {
+		case service.DiscoverableEveryone, service.DiscoverableEmailOnly, service.DiscoverableNobody:
+		default:
+			return fmt.Errorf("discoverable must be one of %s, %s or %s", service.DiscoverableEveryone, service.DiscoverableEmailOnly, service.DiscoverableNobody)
+		}
+	}
+	if update.DMPolicy != nil {
+		switch *update.DMPolicy {
+		case service.DMPolicyEveryone, service.DMPolicyContacts:
+		default:
+			return fmt.Errorf("dm_policy must be %s or %s", service.DMPolicyEveryone, service.DMPolicyContacts)
+		}
+	}
+	return nil
+}
+
+// reauthenticate confirms the caller's identity before a sensitive change and
+// answers the request when it fails. Accounts with a password must send it.
+// Accounts created through an identity provider have none, they confirm by
+// having signed in through the provider within cfg.ReauthWindow.
+func reauthenticate(w http.ResponseWriter, svc *service.Service, claims *Claims, password string, cfg *config.AccountConfig) bool {
+	user, err := svc.GetUserByID(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if user.Password != "" {
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	session, err := svc.GetSession(claims.SessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if session == nil || time.Since(session.CreatedAt) > cfg.ReauthWindow {
+		http.Error(w, "Sign in again with your identity provider to confirm this change", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// HandleUpdateProfile changes the caller's name, avatar or status text
+func HandleUpdateProfile(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+
+	var update service.ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateProfileUpdate(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := svc.UpdateUserProfile(claims.UserID(), update); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := svc.GetUserProfile(claims.UserID())
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// HandleChangePassword changes the caller's password after checking the
+// current one, and signs out every other session. Accounts created through an
+// identity provider set their first password this way.
+func HandleChangePassword(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, cfg *config.AccountConfig) {
+	claims := claimsFromContext(r.Context())
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	if !reauthenticate(w, svc, claims, req.CurrentPassword, cfg) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := svc.UpdateUserPassword(claims.UserID(), string(hashedPassword)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := svc.ListSessions(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := svc.DeleteUserSessionsExcept(claims.UserID(), claims.SessionID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, s := range sessions {
+		if s.ID != claims.SessionID {
+			pool.DisconnectSession(claims.UserID(), s.ID)
+		}
+	}
+	log.Printf("[security] password changed: user=%d ip=%s", claims.UserID(), clientIP(r))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleChangeEmail starts an email change. The new address only takes effect
+// once the link sent to it is confirmed, on the page served by
+// HandleVerifyEmailPage or by a web client calling HandleVerifyEmail.
+func HandleChangeEmail(w http.ResponseWriter, r *http.Request, svc *service.Service, mailer thirdparty.Mailer, cfg *config.AccountConfig) {
+	claims := claimsFromContext(r.Context())
+
+	var req struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil || addr.Address != strings.TrimSpace(req.Email) {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+
+	if !reauthenticate(w, svc, claims, req.CurrentPassword, cfg) {
+		return
+	}
+	if _, err := svc.GetUserByEmail(addr.Address); err == nil {
+		http.Error(w, service.ErrEmailTaken.Error(), http.StatusConflict)
+		return
+	}
+
+	token, err := newTokenID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(pendingEmailChange{UserID: claims.UserID(), Email: addr.Address})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := svc.SetRedisData(emailVerifyPrefix+utils.GenerateSHA256Hash(token), string(data), cfg.EmailVerifyTTL); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	link := strings.TrimSuffix(cfg.BaseURL, "/") + "/verify-email?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Confirm your new email address by opening this link within %v:\n\n%s\n", cfg.EmailVerifyTTL, link)
+	if err := mailer.Send(addr.Address, "Confirm your new email address", body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyEmailPage is served at the link mailed by HandleChangeEmail. Opening
+// the link only shows a button that posts the token back, so mail scanners
+// that prefetch links cannot use it up.
+var verifyEmailPage = template.Must(template.New("verify-email").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Confirm your email address</title></head>
+<body>
+{{if .Token}}<form method="post" action="/verify-email">
+<p>Confirm the new email address of your account.</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm</button>
+</form>{{else}}<p>{{.Message}}</p>{{end}}
+</body>
+</html>
+`))
+
+// renderVerifyEmailPage writes the confirmation form for token, or message
+// when token is empty
+func renderVerifyEmailPage(w http.ResponseWriter, status int, token, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The token is in the page URL, keep it out of Referer headers
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	if err := verifyEmailPage.Execute(w, struct{ Token, Message string }{token, message}); err != nil {
+		log.Printf("Error rendering verify email page: %v", err)
+	}
+}
+
+// applyEmailChange consumes a verification token and applies its pending email
+// change. On failure it returns the status to answer with.
+func applyEmailChange(svc *service.Service, token string) (int, error) {
+	if token == "" {
+		return http.StatusBadRequest, errors.New("token is required")
+	}
+	raw, err := svc.GetRedisDataAndDelete(emailVerifyPrefix + utils.GenerateSHA256Hash(token))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	var change pendingEmailChange
+	if raw == "" || json.Unmarshal([]byte(raw), &change) != nil {
+		return http.StatusBadRequest, errors.New("invalid or expired token")
+	}
+
+	if err := svc.UpdateUserEmail(change.UserID, change.Email); err != nil {
+		if errors.Is(err, service.ErrEmailTaken) {
+			return http.StatusConflict, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("[security] email changed: user=%d", change.UserID)
+	return http.StatusOK, nil
+}
+
+// HandleVerifyEmail applies a pending email change using the token from the
+// verification email. Web clients serving the mailed link call it.
+func HandleVerifyEmail(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	if status, err := applyEmailChange(svc, r.FormValue("token")); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleVerifyEmailPage answers the mailed link with a confirmation form
+func HandleVerifyEmailPage(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		renderVerifyEmailPage(w, http.StatusBadRequest, "", "This link is incomplete. Open the link from the email again.")
+		return
+	}
+	renderVerifyEmailPage(w, http.StatusOK, token, "")
+}
+
+// HandleVerifyEmailForm applies the email change confirmed on the page served
+// by HandleVerifyEmailPage
+func HandleVerifyEmailForm(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	status, err := applyEmailChange(svc, r.PostFormValue("token"))
+	switch {
+	case err == nil:
+		renderVerifyEmailPage(w, http.StatusOK, "", "Your email address was changed.")
+	case status == http.StatusInternalServerError:
+		log.Printf("Error verifying email: %v", err)
+		renderVerifyEmailPage(w, status, "", "Something went wrong, please try again later.")
+	case status == http.StatusConflict:
+		renderVerifyEmailPage(w, status, "", "This email address is already used by another account.")
+	default:
+		renderVerifyEmailPage(w, status, "", "This link is invalid or has expired.")
+	}
+}
+
+// HandleDeleteUser deletes the caller's account after re-authenticating them.
+// All sessions are revoked, the socket is dropped and the account's messages
+// are anonymized or deleted according to the configured policy. The blobs of
+// the attachments deleted with the account are removed afterwards.
+func HandleDeleteUser(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, blobs thirdparty.BlobStore, cfg *config.AccountConfig) {
+	claims := claimsFromContext(r.Context())
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !reauthenticate(w, svc, claims, req.CurrentPassword, cfg) {
+		return
+	}
+
+	attachments, err := svc.DeleteUser(claims.UserID(), cfg.MessagePolicy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deleteAttachmentBlobs(blobs, attachments)
+	if err := svc.DeleteUserSessions(claims.UserID()); err != nil {
+		log.Printf("Error revoking sessions of deleted user %d: %v", claims.UserID(), err)
+	}
+	pool.DisconnectUser(claims.UserID(), "account deleted")
+	log.Printf("[security] account deleted: user=%d policy=%s", claims.UserID(), cfg.MessagePolicy)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+func TestDeleteUserAttachments(t *testing.T) {
+	created := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	attachmentRow := func(id string, messageID interface{}) []driver.Value {
+		return []driver.Value{id, int64(7), messageID, id + ".png", "image/png", int64(3), int64(1), int64(1), "blobs/" + id, "thumbs/" + id, created}
+	}
+
+	for _, tt := range []struct {
+		policy string
+		want   []string
+	}{
+		// Anonymized messages keep their files, only unsent uploads go
+		{service.MessagePolicyAnonymize, []string{"unsent"}},
+		{service.MessagePolicyDelete, []string{"unsent", "sent"}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			db := newFakeDB()
+			svc, _ := newTestService(t, db)
+			db.onQuery("uploader_id = ? AND message_id IS NULL", func(args []driver.Value) [][]driver.Value {
+				return [][]driver.Value{attachmentRow("unsent", nil)}
+			})
+			db.onQuery("FROM attachments WHERE uploader_id = ?", func(args []driver.Value) [][]driver.Value {
+				return [][]driver.Value{attachmentRow("unsent", nil), attachmentRow("sent", int64(40))}
+			})
+
+			attachments, err := svc.DeleteUser(7, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, a := range attachments {
+				ids = append(ids, a.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("deleted attachments %v, want %v", ids, tt.want)
+			}
+			deletes := db.executed("DELETE FROM attachments")
+			if len(deletes) != 1 || (tt.policy == service.MessagePolicyAnonymize) != strings.Contains(deletes[0].query, "message_id IS NULL") {
+				t.Errorf("attachment deletes = %+v", deletes)
+			}
+		})
+	}
+
+	// Their blobs and thumbnails are removed after the account is gone
+	blobs, err := thirdparty.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"blobs/unsent", "thumbs/unsent", "blobs/other"} {
+		if err := blobs.Put(ctx, key, strings.NewReader("png"), 3, "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteAttachmentBlobs(blobs, []service.Attachment{{ID: "unsent", BlobKey: "blobs/unsent", ThumbnailKey: "thumbs/unsent"}})
+	for key, gone := range map[string]bool{"blobs/unsent": true, "thumbs/unsent": true, "blobs/other": false} {
+		rc, err := blobs.Get(ctx, key)
+		if err == nil {
+			rc.Close()
+		}
+		if gone != errors.Is(err, thirdparty.ErrBlobNotFound) {
+			t.Errorf("blob %s: Get error = %v", key, err)
+		}
+	}
+}
+
+func TestDeleteUserIgnoresCacheErrors(t *testing.T) {
+	db := newFakeDB()
+	svc, rdb := newTestService(t, db)
+	// The account is deleted once the transaction commits, so a failing
+	// cache does not turn it into an error
+	rdb.fail("DEL")
+	if _, err := svc.DeleteUser(7, service.MessagePolicyDelete); err != nil {
+		t.Fatalf("DeleteUser = %v", err)
+	}
+	if len(db.executed("DELETE FROM users")) != 1 {
+		t.Error("user was not deleted")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+// pathUserID parses the {id} path parameter
+func pathUserID(r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	return userID, err == nil && userID > 0
+}
+
+// HandleAdminListUsers lists all users, paginated with limit and offset
+func HandleAdminListUsers(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	limit := defaultUserPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxUserPageSize)
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	users, err := svc.ListUsers(limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// HandleAdminSetDisabled disables or re-enables an account. Disabling also
+// revokes every session of the user and drops their socket.
+func HandleAdminSetDisabled(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, disabled bool) {
+	claims := claimsFromContext(r.Context())
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if disabled && userID == claims.UserID() {
+		http.Error(w, "Cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := svc.SetUserDisabled(userID, disabled); err != nil {
+		if errors.Is(err, service.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if disabled {
+		if err := svc.DeleteUserSessions(userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pool.DisconnectUser(userID, "account disabled")
+	}
+	log.Printf("[security] account disabled=%t: user=%d by admin=%d", disabled, userID, claims.UserID())
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAdminDisconnect force-disconnects a user's socket
+func HandleAdminDisconnect(pool *Pool, w http.ResponseWriter, r *http.Request) {
+	claims := claimsFromContext(r.Context())
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !pool.DisconnectUser(userID, "disconnected by admin") {
+		http.Error(w, "User not connected", http.StatusNotFound)
+		return
+	}
+	log.Printf("User force-disconnected: user=%d by admin=%d", userID, claims.UserID())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAdminUnlock lifts a login lockout for a user
+func HandleAdminUnlock(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	user, err := svc.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := unlockAccount(svc, user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[security] account unlocked: account=%s by admin=%d", accountKey(user.Email), claims.UserID())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+)
+
+// Roles a user can hold, stored in users.role
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// Permissions that handlers declare with requirePermission
+const (
+	permUsersList       = "users:list"
+	permUsersDisable    = "users:disable"
+	permUsersDisconnect = "users:disconnect"
+	permUsersUnlock     = "users:unlock"
+)
+
+// rolePermissions maps each role to what it may do. Unknown roles get nothing.
+var rolePermissions = map[string][]string{
+	roleUser: {},
+	roleAdmin: {
+		permUsersList,
+		permUsersDisable,
+		permUsersDisconnect,
+		permUsersUnlock,
+	},
+}
+
+// permissionsFor returns the permissions granted to a role
+func permissionsFor(role string) []string {
+	return rolePermissions[role]
+}
+
+// HasPermission reports whether the token grants a permission
+func (c *Claims) HasPermission(perm string) bool {
+	return slices.Contains(c.Permissions, perm)
+}
+
+// requirePermission only lets the request through if the caller's token grants
+// perm. It must run after requireAuth.
+func requirePermission(perm string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := claimsFromContext(r.Context())
+			if claims == nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !claims.HasPermission(perm) {
+				log.Printf("[security] permission denied: user=%d permission=%s path=%s", claims.UserID(), perm, r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+// relationTarget reads and checks the {id} of a block or mute request
+func relationTarget(w http.ResponseWriter, r *http.Request, svc *service.Service) (int, bool) {
+	claims := claimsFromContext(r.Context())
+	targetID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if targetID == claims.UserID() {
+		http.Error(w, "Cannot block or mute yourself", http.StatusBadRequest)
+		return 0, false
+	}
+	if _, err := svc.GetUserProfile(targetID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+	return targetID, true
+}
+
+// writeProfiles answers with the public profiles of the given users
+func writeProfiles(w http.ResponseWriter, svc *service.Service, key string, ids []int) {
+	sort.Ints(ids)
+	profiles, err := svc.GetUserProfiles(ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	users := make([]service.User, 0, len(ids))
+	for _, id := range ids {
+		if user, ok := profiles[id]; ok {
+			users = append(users, publicProfile(user))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]service.User{key: users})
+}
+
+// HandleBlocks lists the users the caller blocked
+func HandleBlocks(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+
+	ids, err := svc.ListBlockedIDs(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeProfiles(w, svc, "blocked", ids)
+}
+
+// HandleBlock blocks or unblocks the user in the path. Blocking also removes
+// the contact and any pending request between the two.
+func HandleBlock(w http.ResponseWriter, r *http.Request, svc *service.Service, block bool) {
+	claims := claimsFromContext(r.Context())
+	targetID, ok := relationTarget(w, r, svc)
+	if !ok {
+		return
+	}
+
+	var err error
+	if block {
+		err = svc.BlockUser(claims.UserID(), targetID)
+	} else {
+		err = svc.UnblockUser(claims.UserID(), targetID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMutes lists the users the caller muted
+func HandleMutes(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+
+	ids, err := svc.ListMutedIDs(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeProfiles(w, svc, "muted", ids)
+}
+
+// HandleMute mutes or unmutes the user in the path
+func HandleMute(w http.ResponseWriter, r *http.Request, svc *service.Service, mute bool) {
+	claims := claimsFromContext(r.Context())
+	targetID, ok := relationTarget(w, r, svc)
+	if !ok {
+		return
+	}
+
+	var err error
+	if mute {
+		err = svc.MuteUser(claims.UserID(), targetID)
+	} else {
+		err = svc.UnmuteUser(claims.UserID(), targetID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql/driver"
+	"sync"
+	"testing"
+)
+
+func TestBlockCacheRace(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	var mu sync.Mutex
+	blocked := map[int64]bool{}
+	db.onExec("INSERT IGNORE INTO user_blocks", func(args []driver.Value) error {
+		mu.Lock()
+		defer mu.Unlock()
+		blocked[args[1].(int64)] = true
+		return nil
+	})
+	db.onExec("DELETE FROM user_blocks", func(args []driver.Value) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(blocked, args[1].(int64))
+		return nil
+	})
+	// race commits a block of user 8 right after the next load read the table,
+	// before the loaded set is cached
+	race := false
+	db.onQuery("UNION SELECT user_id FROM user_blocks", func([]driver.Value) [][]driver.Value {
+		mu.Lock()
+		var rows [][]driver.Value
+		for id := range blocked {
+			rows = append(rows, []driver.Value{id})
+		}
+		commit := race
+		race = false
+		mu.Unlock()
+		if commit {
+			if err := svc.BlockUser(7, 8); err != nil {
+				t.Error(err)
+			}
+		}
+		return rows
+	})
+
+	isBlocked := func(want bool) {
+		t.Helper()
+		got, err := svc.IsBlocked(7, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("IsBlocked(7, 8) = %v, want %v", got, want)
+		}
+	}
+
+	race = true
+	isBlocked(false)
+	// The set loaded before the block must not be read after it
+	isBlocked(true)
+	isBlocked(true)
+
+	if err := svc.UnblockUser(7, 8); err != nil {
+		t.Fatal(err)
+	}
+	isBlocked(false)
+}
+
+func TestMuteCache(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	muted := false
+	db.onExec("INSERT IGNORE INTO user_mutes", func([]driver.Value) error { muted = true; return nil })
+	db.onExec("DELETE FROM user_mutes", func([]driver.Value) error { muted = false; return nil })
+	db.onQuery("SELECT muted_id FROM user_mutes", func([]driver.Value) [][]driver.Value {
+		if muted {
+			return [][]driver.Value{{int64(8)}}
+		}
+		return nil
+	})
+
+	for _, step := range []struct {
+		change func(userID, otherID int) error
+		want   bool
+	}{
+		{nil, false},
+		{svc.MuteUser, true},
+		{nil, true},
+		{svc.UnmuteUser, false},
+	} {
+		if step.change != nil {
+			if err := step.change(7, 8); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := svc.IsMuted(7, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != step.want {
+			t.Fatalf("IsMuted(7, 8) = %v, want %v", got, step.want)
+		}
+	}
+}
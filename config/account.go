@@ -0,0 +1,27 @@
+package config
+
+import (
+	"time"
+)
+
+type AccountConfig struct {
+	// MessagePolicy is "anonymize" or "delete", applied to a user's messages
+	// when they delete their account
+	MessagePolicy  string        `json:"message_policy"`
+	EmailVerifyTTL time.Duration `json:"email_verify_ttl"`
+	// BaseURL is the public URL that links sent by email point at. This server
+	// answers them itself, a web client hosted elsewhere serves the same paths.
+	BaseURL string `json:"base_url"`
+	// ReauthWindow is how recently a user without a password must have signed
+	// in through their identity provider to change or delete their account
+	ReauthWindow time.Duration `json:"reauth_window"`
+}
+
+func loadAccountConfig() *AccountConfig {
+	return &AccountConfig{
+		MessagePolicy:  getEnvString("ACCOUNT_DELETION_MESSAGE_POLICY", "anonymize"),
+		EmailVerifyTTL: getEnvDuration("EMAIL_VERIFY_TTL", 24*time.Hour),
+		BaseURL:        getEnvString("APP_BASE_URL", "http://localhost:8080"),
+		ReauthWindow:   getEnvDuration("ACCOUNT_REAUTH_WINDOW", 10*time.Minute),
+	}
+}
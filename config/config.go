@@ -1,14 +1,34 @@
 package config
 
 type Config struct {
-	DBConfig *DBConfig
-	RedisConfig *RedisConfig
+	DBConfig      *DBConfig
+	RedisConfig   *RedisConfig
+	LockoutConfig *LockoutConfig
+	MFAConfig     *MFAConfig
+	JWTConfig     *JWTConfig
+	OIDCConfig    []*OIDCProviderConfig
+	HTTPConfig    *HTTPConfig
+	TLSConfig     *TLSConfig
+	MailConfig    *MailConfig
+	AccountConfig *AccountConfig
+	MessageConfig *MessageConfig
+	UploadConfig  *UploadConfig
 }
 
 func LoadConfig() *Config {
 	cfg := &Config{
-		DBConfig: loadDBConfig(),
-		RedisConfig: loadRedisConfig(),
+		DBConfig:      loadDBConfig(),
+		RedisConfig:   loadRedisConfig(),
+		LockoutConfig: loadLockoutConfig(),
+		MFAConfig:     loadMFAConfig(),
+		JWTConfig:     loadJWTConfig(),
+		OIDCConfig:    loadOIDCConfig(),
+		HTTPConfig:    loadHTTPConfig(),
+		TLSConfig:     loadTLSConfig(),
+		MailConfig:    loadMailConfig(),
+		AccountConfig: loadAccountConfig(),
+		MessageConfig: loadMessageConfig(),
+		UploadConfig:  loadUploadConfig(),
 	}
 	return cfg
 }
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+type HTTPConfig struct {
+	// AllowedOrigins lists the origins allowed by CORS. "*" allows any origin.
+	AllowedOrigins []string `json:"allowed_origins"`
+	// WSOriginPatterns lists the host patterns allowed to open websockets from
+	// another origin, e.g. "chat.example.com" or "*.example.com". Same-host
+	// origins are always allowed.
+	WSOriginPatterns []string      `json:"ws_origin_patterns"`
+	WSTicketTTL      time.Duration `json:"ws_ticket_ttl"`
+	// ShutdownDrainDelay is how long /readyz reports not-ready before the
+	// server stops accepting connections
+	ShutdownDrainDelay time.Duration `json:"shutdown_drain_delay"`
+}
+
+func loadHTTPConfig() *HTTPConfig {
+	return &HTTPConfig{
+		AllowedOrigins:     splitList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		WSOriginPatterns:   splitList(os.Getenv("WS_ALLOWED_ORIGINS")),
+		WSTicketTTL:        getEnvDuration("WS_TICKET_TTL", 30*time.Second),
+		ShutdownDrainDelay: getEnvDuration("SHUTDOWN_DRAIN_DELAY", 5*time.Second),
+	}
+}
+
+// splitList splits a comma separated environment variable, dropping empty entries
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
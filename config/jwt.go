@@ -0,0 +1,28 @@
+package config
+
+import (
+	"time"
+)
+
+type JWTConfig struct {
+	// Algorithm is one of HS256, RS256 or EdDSA
+	Algorithm        string        `json:"algorithm"`
+	Issuer           string        `json:"issuer"`
+	Audience         string        `json:"audience"`
+	RotationInterval time.Duration `json:"rotation_interval"`
+	// OverlapWindow keeps retired keys published so tokens signed with them
+	// stay verifiable until they expire
+	OverlapWindow time.Duration `json:"overlap_window"`
+	RefreshEvery  time.Duration `json:"refresh_every"`
+}
+
+func loadJWTConfig() *JWTConfig {
+	return &JWTConfig{
+		Algorithm:        getEnvString("JWT_ALGORITHM", "HS256"),
+		Issuer:           getEnvString("JWT_ISSUER", "chat-go"),
+		Audience:         getEnvString("JWT_AUDIENCE", "chat-go"),
+		RotationInterval: getEnvDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+		OverlapWindow:    getEnvDuration("JWT_KEY_OVERLAP", 8*24*time.Hour),
+		RefreshEvery:     getEnvDuration("JWT_KEY_REFRESH", 10*time.Minute),
+	}
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+type LockoutConfig struct {
+	MaxAccountAttempts int           `json:"max_account_attempts"`
+	MaxIPAttempts      int           `json:"max_ip_attempts"`
+	Window             time.Duration `json:"window"`
+	BaseLockout        time.Duration `json:"base_lockout"`
+	MaxLockout         time.Duration `json:"max_lockout"`
+	UnlockKey          string        `json:"-"`
+}
+
+func loadLockoutConfig() *LockoutConfig {
+	return &LockoutConfig{
+		MaxAccountAttempts: getEnvInt("LOGIN_MAX_ACCOUNT_ATTEMPTS", 5),
+		MaxIPAttempts:      getEnvInt("LOGIN_MAX_IP_ATTEMPTS", 20),
+		Window:             getEnvDuration("LOGIN_ATTEMPT_WINDOW", 15*time.Minute),
+		BaseLockout:        getEnvDuration("LOGIN_BASE_LOCKOUT", time.Minute),
+		MaxLockout:         getEnvDuration("LOGIN_MAX_LOCKOUT", time.Hour),
+		UnlockKey:          os.Getenv("LOGIN_UNLOCK_KEY"),
+	}
+}
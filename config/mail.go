@@ -0,0 +1,18 @@
+package config
+
+type MailConfig struct {
+	// SMTPAddr is host:port of the SMTP server. Without it emails are only logged.
+	SMTPAddr string `json:"smtp_addr"`
+	From     string `json:"from"`
+	Username string `json:"username"`
+	Password string `json:"-"`
+}
+
+func loadMailConfig() *MailConfig {
+	return &MailConfig{
+		SMTPAddr: getEnvString("SMTP_ADDR", ""),
+		From:     getEnvString("SMTP_FROM", "no-reply@chat-go.local"),
+		Username: getEnvString("SMTP_USERNAME", ""),
+		Password: getEnvString("SMTP_PASSWORD", ""),
+	}
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"time"
+)
+
+type MessageConfig struct {
+	// MaxLength is the longest message body accepted, in characters
+	MaxLength int `json:"max_length"`
+	// EditWindow is how long after sending the author can edit or delete a message
+	EditWindow time.Duration `json:"edit_window"`
+	// MaxReactions is the number of different emoji a message can carry
+	MaxReactions int `json:"max_reactions"`
+}
+
+func loadMessageConfig() *MessageConfig {
+	return &MessageConfig{
+		MaxLength:    getEnvInt("MESSAGE_MAX_LENGTH", 4000),
+		EditWindow:   getEnvDuration("MESSAGE_EDIT_WINDOW", 15*time.Minute),
+		MaxReactions: getEnvInt("MESSAGE_MAX_REACTIONS", 20),
+	}
+}
@@ -0,0 +1,17 @@
+package config
+
+import (
+	"time"
+)
+
+type MFAConfig struct {
+	Issuer     string        `json:"issuer"`
+	PendingTTL time.Duration `json:"pending_ttl"`
+}
+
+func loadMFAConfig() *MFAConfig {
+	return &MFAConfig{
+		Issuer:     getEnvString("MFA_ISSUER", "chat-go"),
+		PendingTTL: getEnvDuration("MFA_PENDING_TTL", 5*time.Minute),
+	}
+}
@@ -38,6 +38,8 @@ func ConnectMysql(
 		Net:    cfg.DBConfig.Net,
 		Addr:   cfg.DBConfig.Addr,
 		DBName: cfg.DBConfig.DBName,
+		// Scan DATETIME and TIMESTAMP columns straight into time.Time
+		ParseTime: true,
 	}
 
 	// Get a database handle
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"-"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	// LinkByEmail lets the provider sign in to an existing account with the
+	// same verified email. Only enable it for providers that own the domain.
+	LinkByEmail bool `json:"link_by_email"`
+}
+
+// loadOIDCConfig reads the providers listed in OIDC_PROVIDERS, e.g. "corp,google".
+// Each provider is configured with OIDC_<NAME>_ISSUER, _CLIENT_ID,
+// _CLIENT_SECRET, _REDIRECT_URL and optionally _SCOPES and _LINK_BY_EMAIL.
+func loadOIDCConfig() []*OIDCProviderConfig {
+	var providers []*OIDCProviderConfig
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, &OIDCProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(getEnvString(prefix+"SCOPES", "openid email profile")),
+			LinkByEmail:  getEnvString(prefix+"LINK_BY_EMAIL", "false") == "true",
+		})
+	}
+	return providers
+}
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"time"
+)
+
+type TLSConfig struct {
+	// CertFile and KeyFile enable in-process TLS when both are set
+	CertFile       string        `json:"cert_file"`
+	KeyFile        string        `json:"key_file"`
+	HTTPAddr       string        `json:"http_addr"`
+	HTTPSAddr      string        `json:"https_addr"`
+	ReloadInterval time.Duration `json:"reload_interval"`
+	// RedirectHTTP serves a redirect to HTTPS on HTTPAddr when TLS is enabled
+	RedirectHTTP bool `json:"redirect_http"`
+}
+
+func loadTLSConfig() *TLSConfig {
+	return &TLSConfig{
+		CertFile:       getEnvString("TLS_CERT_FILE", ""),
+		KeyFile:        getEnvString("TLS_KEY_FILE", ""),
+		HTTPAddr:       getEnvString("HTTP_ADDR", ":8080"),
+		HTTPSAddr:      getEnvString("HTTPS_ADDR", ":8443"),
+		ReloadInterval: getEnvDuration("TLS_RELOAD_INTERVAL", time.Minute),
+		RedirectHTTP:   getEnvString("TLS_REDIRECT_HTTP", "true") == "true",
+	}
+}
+
+// Enabled reports whether a certificate and key are configured
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
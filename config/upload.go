@@ -0,0 +1,58 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+type UploadConfig struct {
+	// MaxSize is the largest accepted upload in bytes
+	MaxSize int `json:"max_size"`
+	// AllowedTypes lists the accepted content types, as sniffed from the data
+	AllowedTypes []string `json:"allowed_types"`
+	// ThumbnailSize bounds the width and height of image thumbnails
+	ThumbnailSize int `json:"thumbnail_size"`
+	// URLTTL is how long a signed download URL stays valid
+	URLTTL time.Duration `json:"url_ttl"`
+	// SigningKey signs download URLs. A random key is used when it is empty,
+	// which invalidates issued URLs on restart.
+	SigningKey string `json:"-"`
+	// UnsentTTL is how long an upload that was never sent with a message is
+	// kept. Older ones are deleted every SweepInterval.
+	UnsentTTL     time.Duration `json:"unsent_ttl"`
+	SweepInterval time.Duration `json:"sweep_interval"`
+
+	// Store is "local" or "s3"
+	Store    string `json:"store"`
+	LocalDir string `json:"local_dir"`
+	// S3Endpoint is the base URL of an S3-compatible service, e.g.
+	// "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	S3Endpoint  string `json:"s3_endpoint"`
+	S3Region    string `json:"s3_region"`
+	S3Bucket    string `json:"s3_bucket"`
+	S3AccessKey string `json:"-"`
+	S3SecretKey string `json:"-"`
+}
+
+func loadUploadConfig() *UploadConfig {
+	allowed := splitList(os.Getenv("UPLOAD_ALLOWED_TYPES"))
+	if len(allowed) == 0 {
+		allowed = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+	}
+	return &UploadConfig{
+		MaxSize:       getEnvInt("UPLOAD_MAX_SIZE", 10<<20),
+		AllowedTypes:  allowed,
+		ThumbnailSize: getEnvInt("UPLOAD_THUMBNAIL_SIZE", 256),
+		URLTTL:        getEnvDuration("UPLOAD_URL_TTL", 15*time.Minute),
+		SigningKey:    os.Getenv("UPLOAD_SIGNING_KEY"),
+		UnsentTTL:     getEnvDuration("UPLOAD_UNSENT_TTL", 24*time.Hour),
+		SweepInterval: getEnvDuration("UPLOAD_SWEEP_INTERVAL", time.Hour),
+		Store:         getEnvString("BLOB_STORE", "local"),
+		LocalDir:      getEnvString("BLOB_LOCAL_DIR", "uploads"),
+		S3Endpoint:    os.Getenv("S3_ENDPOINT"),
+		S3Region:      getEnvString("S3_REGION", "us-east-1"),
+		S3Bucket:      os.Getenv("S3_BUCKET"),
+		S3AccessKey:   os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:   os.Getenv("S3_SECRET_KEY"),
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+type contactRequestResponse struct {
+	User      service.User `json:"user"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type contactRequestsResponse struct {
+	Incoming []contactRequestResponse `json:"incoming"`
+	Outgoing []contactRequestResponse `json:"outgoing"`
+}
+
+// contactEvent is the payload of the contact events pushed over /ws
+type contactEvent struct {
+	User service.User `json:"user"`
+}
+
+// contactProfile loads the public profile of the user a contact event is
+// about, leaving out private fields
+func contactProfile(svc *service.Service, userID int) service.User {
+	profile, err := svc.GetUserProfile(userID)
+	if err != nil {
+		return service.User{ID: strconv.Itoa(userID)}
+	}
+	return publicProfile(*profile)
+}
+
+// publicProfile strips the fields only the user themselves should see
+func publicProfile(user service.User) service.User {
+	return service.User{
+		ID:         user.ID,
+		Name:       user.Name,
+		ProfileURL: user.ProfileURL,
+		StatusText: user.StatusText,
+	}
+}
+
+// HandleContacts lists the caller's contacts
+func HandleContacts(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+
+	ids, err := svc.ListContactIDs(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	profiles, err := svc.GetUserProfiles(ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contacts := make([]service.User, 0, len(ids))
+	for _, id := range ids {
+		if user, ok := profiles[id]; ok {
+			contacts = append(contacts, publicProfile(user))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]service.User{"contacts": contacts})
+}
+
+// HandleRemoveContact removes a contact for both sides
+func HandleRemoveContact(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	contactID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := svc.RemoveContact(claims.UserID(), contactID); err != nil {
+		if errors.Is(err, service.ErrContactNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pool.notify(contactID, eventContactRemoved, contactEvent{User: contactProfile(svc, claims.UserID())})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleContactRequests lists the caller's pending incoming and outgoing requests
+func HandleContactRequests(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+
+	incoming, outgoing, err := svc.ListContactRequests(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ids := make([]int, 0, len(incoming)+len(outgoing))
+	for _, req := range incoming {
+		ids = append(ids, req.SenderID)
+	}
+	for _, req := range outgoing {
+		ids = append(ids, req.ReceiverID)
+	}
+	profiles, err := svc.GetUserProfiles(ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := contactRequestsResponse{
+		Incoming: []contactRequestResponse{},
+		Outgoing: []contactRequestResponse{},
+	}
+	for _, req := range incoming {
+		if user, ok := profiles[req.SenderID]; ok {
+			response.Incoming = append(response.Incoming, contactRequestResponse{User: publicProfile(user), CreatedAt: req.CreatedAt})
+		}
+	}
+	for _, req := range outgoing {
+		if user, ok := profiles[req.ReceiverID]; ok {
+			response.Outgoing = append(response.Outgoing, contactRequestResponse{User: publicProfile(user), CreatedAt: req.CreatedAt})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleSendContactRequest sends a friend request to the user in the path. A
+// request crossing one from that user accepts it right away.
+func HandleSendContactRequest(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	receiverID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if receiverID == claims.UserID() {
+		http.Error(w, "Cannot send a contact request to yourself", http.StatusBadRequest)
+		return
+	}
+	receiver, err := svc.GetUserProfile(receiverID)
+	if err != nil || receiver.Disabled {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	// Blocked users cannot tell a block apart from a missing account
+	blocked, err := svc.IsBlocked(claims.UserID(), receiverID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	accepted, err := svc.SendContactRequest(claims.UserID(), receiverID)
+	if err != nil {
+		if errors.Is(err, service.ErrAlreadyContacts) || errors.Is(err, service.ErrContactRequestExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sender := contactEvent{User: contactProfile(svc, claims.UserID())}
+	if accepted {
+		pool.notify(receiverID, eventContactAccepted, sender)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"accepted": true})
+		return
+	}
+	pool.notify(receiverID, eventContactRequest, sender)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]bool{"accepted": false})
+}
+
+// HandleCancelContactRequest withdraws a request the caller sent
+func HandleCancelContactRequest(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	receiverID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := svc.DeleteContactRequest(claims.UserID(), receiverID); err != nil {
+		if errors.Is(err, service.ErrContactRequestNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pool.notify(receiverID, eventContactRequestCanceled, contactEvent{User: contactProfile(svc, claims.UserID())})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAnswerContactRequest accepts or declines a request sent to the caller.
+// Declines are not pushed to the sender.
+func HandleAnswerContactRequest(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, accept bool) {
+	claims := claimsFromContext(r.Context())
+	senderID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if accept {
+		err = svc.AcceptContactRequest(claims.UserID(), senderID)
+	} else {
+		err = svc.DeleteContactRequest(senderID, claims.UserID())
+	}
+	if err != nil {
+		if errors.Is(err, service.ErrContactRequestNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if accept {
+		pool.notify(senderID, eventContactAccepted, contactEvent{User: contactProfile(svc, claims.UserID())})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
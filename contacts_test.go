@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+)
+
+// contactsTest keeps contacts and contact requests of users 7 to 10 in
+// memory. User 8 only accepts direct messages from contacts and user 10 is
+// disabled.
+type contactsTest struct {
+	svc      *service.Service
+	db       *fakeDB
+	requests map[[2]int64]bool
+	contacts map[[2]int64]bool
+}
+
+func newContactsTest(t *testing.T) *contactsTest {
+	t.Helper()
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	ct := &contactsTest{svc: svc, db: db, requests: map[[2]int64]bool{}, contacts: map[[2]int64]bool{}}
+	pair := func(args []driver.Value) [2]int64 { return [2]int64{args[0].(int64), args[1].(int64)} }
+
+	db.onQuery("FROM users WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, id := range args {
+			if id.(int64) < 7 || id.(int64) > 10 {
+				continue
+			}
+			policy := service.DMPolicyEveryone
+			if id == int64(8) {
+				policy = service.DMPolicyContacts
+			}
+			rows = append(rows, []driver.Value{id, "user@example.com", "User " + strconv.FormatInt(id.(int64), 10), "", "", "user", id == int64(10), "everyone", policy})
+		}
+		return rows
+	})
+	db.onQuery("SELECT 1 FROM contacts", func(args []driver.Value) [][]driver.Value {
+		if ct.contacts[pair(args)] {
+			return [][]driver.Value{{int64(1)}}
+		}
+		return nil
+	})
+	db.onQuery("SELECT contact_id FROM contacts", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for id := int64(7); id <= 10; id++ {
+			if ct.contacts[[2]int64{args[0].(int64), id}] {
+				rows = append(rows, []driver.Value{id})
+			}
+		}
+		return rows
+	})
+	db.onQuery("FROM contact_requests", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for req := range ct.requests {
+			if req[0] == args[0] || req[1] == args[0] {
+				rows = append(rows, []driver.Value{req[0], req[1], time.Now()})
+			}
+		}
+		return rows
+	})
+	db.onExec("DELETE FROM contact_requests", func(args []driver.Value) error {
+		if !ct.requests[pair(args)] {
+			return errNoRowsAffected
+		}
+		delete(ct.requests, pair(args))
+		return nil
+	})
+	db.onExec("INSERT INTO contact_requests", func(args []driver.Value) error {
+		if ct.requests[pair(args)] {
+			return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+		}
+		ct.requests[pair(args)] = true
+		return nil
+	})
+	db.onExec("INSERT IGNORE INTO contacts", func(args []driver.Value) error {
+		ct.contacts[pair(args)] = true
+		ct.contacts[pair(args[2:])] = true
+		return nil
+	})
+	db.onExec("DELETE FROM contacts", func(args []driver.Value) error {
+		if !ct.contacts[pair(args)] {
+			return errNoRowsAffected
+		}
+		delete(ct.contacts, pair(args))
+		delete(ct.contacts, pair(args[2:]))
+		return nil
+	})
+	return ct
+}
+
+// call runs a contact handler as userID with the other user in the path
+func (ct *contactsTest) call(t *testing.T, handle func(http.ResponseWriter, *http.Request), userID, otherID int) *httptest.ResponseRecorder {
+	t.Helper()
+	req := withClaims(t, httptest.NewRequest(http.MethodPost, "/contacts/"+strconv.Itoa(otherID), nil), userID, "s1")
+	req.SetPathValue("id", strconv.Itoa(otherID))
+	rec := httptest.NewRecorder()
+	handle(rec, req)
+	return rec
+}
+
+// eventTypes returns the types of the frames a user got so far
+func eventTypes(t *testing.T, frames []json.RawMessage) []string {
+	t.Helper()
+	var types []string
+	for _, frame := range frames {
+		var ev struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(frame, &ev); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func TestContactRequests(t *testing.T) {
+	ct := newContactsTest(t)
+	pool := newPool()
+	conns := map[int]*websocket.Conn{}
+	for _, userID := range []int{7, 8, 9} {
+		conns[userID] = connectClient(t, pool, userID)
+	}
+	svc := ct.svc
+	send := func(w http.ResponseWriter, r *http.Request) { HandleSendContactRequest(pool, w, r, svc) }
+	cancel := func(w http.ResponseWriter, r *http.Request) { HandleCancelContactRequest(pool, w, r, svc) }
+	accept := func(w http.ResponseWriter, r *http.Request) { HandleAnswerContactRequest(pool, w, r, svc, true) }
+	decline := func(w http.ResponseWriter, r *http.Request) { HandleAnswerContactRequest(pool, w, r, svc, false) }
+	remove := func(w http.ResponseWriter, r *http.Request) { HandleRemoveContact(pool, w, r, svc) }
+	events := func(userID int) []string {
+		t.Helper()
+		return eventTypes(t, receivedEvents(t, pool, userID, conns[userID]))
+	}
+
+	if rec := ct.call(t, send, 7, 8); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"accepted":false`) {
+		t.Fatalf("send: %d %s", rec.Code, rec.Body)
+	}
+	if got := events(8); !slices.Equal(got, []string{eventContactRequest}) {
+		t.Errorf("receiver got %v", got)
+	}
+	for _, tt := range []struct {
+		name          string
+		userID, other int
+		want          int
+	}{
+		{"same request again", 7, 8, http.StatusConflict},
+		{"request to yourself", 7, 7, http.StatusBadRequest},
+		{"request to a disabled user", 7, 10, http.StatusNotFound},
+		{"request to an unknown user", 7, 11, http.StatusNotFound},
+	} {
+		if rec := ct.call(t, send, tt.userID, tt.other); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// The receiver sees the request without the sender's private fields
+	rec := httptest.NewRecorder()
+	HandleContactRequests(rec, withClaims(t, httptest.NewRequest(http.MethodGet, "/contact-requests", nil), 8, "s1"), svc)
+	var requests contactRequestsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&requests); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests.Incoming) != 1 || requests.Incoming[0].User.ID != "7" || requests.Incoming[0].User.Email != "" || len(requests.Outgoing) != 0 {
+		t.Errorf("requests of the receiver = %+v", requests)
+	}
+
+	// A crossing request accepts the pending one
+	if rec := ct.call(t, send, 8, 7); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"accepted":true`) {
+		t.Fatalf("crossing request: %d %s", rec.Code, rec.Body)
+	}
+	if got := events(7); !slices.Equal(got, []string{eventContactAccepted}) {
+		t.Errorf("first sender got %v", got)
+	}
+	if !ct.contacts[[2]int64{7, 8}] || !ct.contacts[[2]int64{8, 7}] || len(ct.requests) != 0 {
+		t.Fatalf("contacts %v, requests %v", ct.contacts, ct.requests)
+	}
+	if rec := ct.call(t, send, 7, 8); rec.Code != http.StatusConflict {
+		t.Errorf("request to a contact: status %d, want 409", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	HandleContacts(rec, withClaims(t, httptest.NewRequest(http.MethodGet, "/contacts", nil), 7, "s1"), svc)
+	var contacts struct {
+		Contacts []service.User `json:"contacts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&contacts); err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts.Contacts) != 1 || contacts.Contacts[0].ID != "8" {
+		t.Errorf("contacts = %+v", contacts.Contacts)
+	}
+
+	// Removing a contact removes it for both sides
+	if rec := ct.call(t, remove, 8, 7); rec.Code != http.StatusNoContent {
+		t.Fatalf("remove: status %d", rec.Code)
+	}
+	if len(ct.contacts) != 0 {
+		t.Errorf("contacts after removal = %v", ct.contacts)
+	}
+	if got := events(7); !slices.Equal(got, []string{eventContactRemoved}) {
+		t.Errorf("removed contact got %v", got)
+	}
+	if rec := ct.call(t, remove, 8, 7); rec.Code != http.StatusNotFound {
+		t.Errorf("second removal: status %d, want 404", rec.Code)
+	}
+
+	// Declines are silent, cancels reach the receiver
+	ct.call(t, send, 9, 7)
+	events(7)
+	if rec := ct.call(t, decline, 7, 9); rec.Code != http.StatusNoContent {
+		t.Fatalf("decline: status %d", rec.Code)
+	}
+	if got := events(9); len(got) != 0 {
+		t.Errorf("declined sender got %v", got)
+	}
+	if rec := ct.call(t, accept, 7, 9); rec.Code != http.StatusNotFound {
+		t.Errorf("accepting a declined request: status %d, want 404", rec.Code)
+	}
+	ct.call(t, send, 9, 7)
+	events(7)
+	if rec := ct.call(t, cancel, 9, 7); rec.Code != http.StatusNoContent {
+		t.Fatalf("cancel: status %d", rec.Code)
+	}
+	if got := events(7); !slices.Equal(got, []string{eventContactRequestCanceled}) {
+		t.Errorf("receiver of a canceled request got %v", got)
+	}
+	if rec := ct.call(t, cancel, 9, 7); rec.Code != http.StatusNotFound {
+		t.Errorf("second cancel: status %d, want 404", rec.Code)
+	}
+
+	ct.call(t, send, 9, 7)
+	if rec := ct.call(t, accept, 7, 9); rec.Code != http.StatusNoContent {
+		t.Fatalf("accept: status %d", rec.Code)
+	}
+	if got := events(9); !slices.Equal(got, []string{eventContactAccepted}) {
+		t.Errorf("accepted sender got %v", got)
+	}
+}
+
+func TestDirectMessagePolicy(t *testing.T) {
+	ct := newContactsTest(t)
+	ct.db.onQuery("SELECT last_seq FROM conversations", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1)}}
+	})
+	for _, tt := range []struct {
+		senderID, receiverID int
+		want                 bool
+	}{
+		{7, 9, true},
+		{7, 8, false},
+		{7, 10, false},
+	} {
+		if allowed, err := ct.svc.CanDirectMessage(tt.senderID, tt.receiverID); err != nil || allowed != tt.want {
+			t.Errorf("CanDirectMessage(%d, %d) = %v, %v, want %v", tt.senderID, tt.receiverID, allowed, err, tt.want)
+		}
+	}
+
+	pool := newPool()
+	sender, receiver := connectClient(t, pool, 7), connectClient(t, pool, 8)
+	cfg := &config.MessageConfig{MaxLength: 100}
+	frame := []byte(`{"type":"message","to":8,"body":"hi"}`)
+
+	handleFrame(pool, ct.svc, nil, cfg, 7, frame)
+	if frames := receivedEvents(t, pool, 7, sender); len(frames) != 1 || !strings.Contains(string(frames[0]), "receiver only accepts messages from contacts") {
+		t.Errorf("sender got %s", frames)
+	}
+	if frames := receivedEvents(t, pool, 8, receiver); len(frames) != 0 {
+		t.Errorf("receiver got %s", frames)
+	}
+	if inserts := ct.db.executed("INSERT INTO messages"); len(inserts) != 0 {
+		t.Fatalf("%d messages stored, want none", len(inserts))
+	}
+
+	// Contacts get through
+	ct.contacts[[2]int64{7, 8}], ct.contacts[[2]int64{8, 7}] = true, true
+	handleFrame(pool, ct.svc, nil, cfg, 7, frame)
+	if got := eventTypes(t, receivedEvents(t, pool, 8, receiver)); !slices.Equal(got, []string{eventMessage}) {
+		t.Errorf("receiver got %v", got)
+	}
+	if inserts := ct.db.executed("INSERT INTO messages"); len(inserts) != 1 {
+		t.Errorf("%d messages stored, want 1", len(inserts))
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+const (
+	defaultConversationPageSize = 30
+	maxConversationPageSize     = 100
+	maxRoomNameLength           = 100
+	maxRoomMembers              = 100
+)
+
+// conversationResponse is a conversation with the profiles of its first
+// members. Members who no longer exist are left out.
+type conversationResponse struct {
+	service.Conversation
+	Participants []service.User `json:"participants"`
+}
+
+type conversationListResponse struct {
+	Conversations []conversationResponse `json:"conversations"`
+	NextCursor    string                 `json:"next_cursor,omitempty"`
+}
+
+// encodeConversationCursor makes an opaque cursor pointing after a conversation
+func encodeConversationCursor(c service.Conversation) string {
+	pinned := 0
+	if c.Pinned {
+		pinned = 1
+	}
+	raw := fmt.Sprintf("%d:%d:%d", pinned, c.LastActivityAt.Unix(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeConversationCursor(cursor string) (*service.ConversationCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	pinned, err := strconv.ParseBool(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	activity, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &service.ConversationCursor{Pinned: pinned, LastActivityAt: time.Unix(activity, 0).UTC(), ID: id}, true
+}
+
+// pathConversationID parses the {id} path parameter of conversation routes
+func pathConversationID(r *http.Request) (int64, bool) {
+	conversationID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return conversationID, err == nil && conversationID > 0
+}
+
+// conversationResponses adds the participants' public profiles to
+// conversations
+func conversationResponses(svc *service.Service, conversations []service.Conversation) []conversationResponse {
+	var ids []int
+	for _, c := range conversations {
+		ids = append(ids, c.MemberIDs...)
+	}
+	profiles, err := svc.GetUserProfiles(ids)
+	if err != nil {
+		log.Printf("Error loading conversation participants: %v", err)
+	}
+
+	responses := make([]conversationResponse, 0, len(conversations))
+	for _, c := range conversations {
+		item := conversationResponse{Conversation: c, Participants: []service.User{}}
+		for _, id := range c.MemberIDs {
+			if user, ok := profiles[id]; ok {
+				item.Participants = append(item.Participants, publicProfile(user))
+			}
+		}
+		responses = append(responses, item)
+	}
+	return responses
+}
+
+// HandleConversations lists the caller's conversations: pinned first, then the
+// most recently active, with their last message, unread count and first
+// participants. archived=true lists the archive instead. Conversations with a
+// blocked user are left out.
+func HandleConversations(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	q := r.URL.Query()
+
+	limit := defaultConversationPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxConversationPageSize)
+	}
+	var after *service.ConversationCursor
+	if v := q.Get("cursor"); v != "" {
+		var ok bool
+		if after, ok = decodeConversationCursor(v); !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	var archived bool
+	if v := q.Get("archived"); v != "" {
+		var err error
+		if archived, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid archived filter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Fetch one extra conversation to know whether there is a next page
+	conversations, err := svc.ListConversations(claims.UserID(), archived, after, limit+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var response conversationListResponse
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		response.NextCursor = encodeConversationCursor(conversations[len(conversations)-1])
+	}
+	response.Conversations = conversationResponses(svc, conversations)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleCreateRoom creates a room with the caller and the given members.
+// Members must accept direct messages from the caller and have no block with
+// them. Connected members are notified.
+func HandleCreateRoom(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	userID := claims.UserID()
+
+	var req struct {
+		Name    string `json:"name"`
+		Members []int  `json:"members"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxRoomNameLength {
+		http.Error(w, fmt.Sprintf("name must be between 1 and %d characters", maxRoomNameLength), http.StatusBadRequest)
+		return
+	}
+
+	seen := map[int]bool{userID: true}
+	var members []int
+	for _, id := range req.Members {
+		if !seen[id] {
+			seen[id] = true
+			members = append(members, id)
+		}
+	}
+	if len(members) > maxRoomMembers {
+		http.Error(w, fmt.Sprintf("a room can start with at most %d members", maxRoomMembers), http.StatusBadRequest)
+		return
+	}
+	for _, id := range members {
+		blocked, err := svc.IsBlocked(userID, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		allowed, err := svc.CanDirectMessage(userID, id)
+		if err != nil && !errors.Is(err, service.ErrUserNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Blocks are reported like unknown users so they are not revealed
+		if blocked || errors.Is(err, service.ErrUserNotFound) {
+			http.Error(w, fmt.Sprintf("user %d not found", id), http.StatusNotFound)
+			return
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("user %d cannot be added to the room", id), http.StatusForbidden)
+			return
+		}
+	}
+
+	room, err := svc.CreateRoom(userID, req.Name, members)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := conversationResponses(svc, []service.Conversation{*room})[0]
+	for _, id := range members {
+		pool.notify(id, eventConversationCreated, response)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleConversationSetting pins, archives or mutes a conversation for the
+// caller, or undoes it
+func HandleConversationSetting(w http.ResponseWriter, r *http.Request, svc *service.Service, setting string, on bool) {
+	claims := claimsFromContext(r.Context())
+	conversationID, ok := pathConversationID(r)
+	if !ok {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := svc.SetConversationSetting(claims.UserID(), conversationID, setting, on); err != nil {
+		if errors.Is(err, service.ErrConversationNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
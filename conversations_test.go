@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+)
+
+// unreadTest is room 50 with members 7, 8 and 9 and the read markers of the
+// members. Messages 1 and 2 by user 7 are read by 7 and 9 but not by 8.
+type unreadTest struct {
+	mu       sync.Mutex
+	senders  map[int64]int64
+	lastID   int64
+	markers  map[int64]int64
+	rebuilds int
+}
+
+func newUnreadTest(db *fakeDB) *unreadTest {
+	ut := &unreadTest{
+		senders: map[int64]int64{1: 7, 2: 7},
+		lastID:  2,
+		markers: map[int64]int64{7: 2, 8: 0, 9: 2},
+	}
+	seq := int64(2)
+	db.onQuery("FOR SHARE", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(7)}, {int64(8)}, {int64(9)}}
+	})
+	db.onQuery("SELECT last_seq FROM conversations", func([]driver.Value) [][]driver.Value {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		seq++
+		return [][]driver.Value{{seq}}
+	})
+	db.onQuery("SELECT m.conversation_id, COUNT(msg.id)", func(args []driver.Value) [][]driver.Value {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		ut.rebuilds++
+		if n := ut.unread(args[0]); n > 0 {
+			return [][]driver.Value{{int64(50), n}}
+		}
+		return nil
+	})
+	db.onQuery("SELECT COUNT(msg.id)", func(args []driver.Value) [][]driver.Value {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		return [][]driver.Value{{ut.unread(args[1])}}
+	})
+	db.onQuery("SELECT c.last_message_id FROM conversations c", func(args []driver.Value) [][]driver.Value {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		if _, ok := ut.markers[args[0].(int64)]; !ok || args[1] != int64(50) {
+			return nil
+		}
+		return [][]driver.Value{{ut.lastID}}
+	})
+	db.onQuery("SELECT COUNT(*) FROM messages WHERE id = ? AND conversation_id = ?", func(args []driver.Value) [][]driver.Value {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		if _, ok := ut.senders[args[0].(int64)]; ok && args[1] == int64(50) {
+			return [][]driver.Value{{int64(1)}}
+		}
+		return [][]driver.Value{{int64(0)}}
+	})
+	db.onQuery("SELECT last_read_message_id FROM conversation_members", func(args []driver.Value) [][]driver.Value {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		return [][]driver.Value{{ut.markers[args[1].(int64)]}}
+	})
+	db.onQuery("JOIN conversations c ON c.id = m.conversation_id", func(args []driver.Value) [][]driver.Value {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		return [][]driver.Value{{int64(50), service.ConversationRoom, "Team", nil, ut.lastID, seq, time.Now(), ut.markers[args[0].(int64)], false, false, false}}
+	})
+	db.onQuery("FROM messages WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{messageRow(args[0].(int64), "latest")}
+	})
+	db.onExec("SET last_read_message_id = GREATEST", func(args []driver.Value) error {
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		user := args[2].(int64)
+		ut.markers[user] = max(ut.markers[user], args[0].(int64))
+		return nil
+	})
+	return ut
+}
+
+// unread counts the messages after a member's read marker that others sent.
+// The caller holds ut.mu.
+func (ut *unreadTest) unread(userID driver.Value) int64 {
+	var n int64
+	for id, senderID := range ut.senders {
+		if id > ut.markers[userID.(int64)] && senderID != userID {
+			n++
+		}
+	}
+	return n
+}
+
+// send stores a room message from user 7
+func (ut *unreadTest) send(t *testing.T, svc *service.Service) int64 {
+	t.Helper()
+	msg, err := svc.CreateRoomMessage(7, 50, "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	ut.senders[msg.ID] = 7
+	ut.lastID = msg.ID
+	return msg.ID
+}
+
+func (ut *unreadTest) rebuilt() int {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	n := ut.rebuilds
+	ut.rebuilds = 0
+	return n
+}
+
+func TestUnreadCounters(t *testing.T) {
+	db := newFakeDB()
+	svc, rdb := newTestService(t, db)
+	ut := newUnreadTest(db)
+	counts := func(userID int) map[int64]int64 {
+		t.Helper()
+		counts, err := svc.GetUnreadCounts(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return counts
+	}
+
+	// The counters are rebuilt from the read markers once, then cached
+	if got := counts(8); !maps.Equal(got, map[int64]int64{50: 2}) || ut.rebuilt() != 1 {
+		t.Fatalf("unread counts of user 8 = %v", got)
+	}
+	if ttl := rdb.ttl("user:unread:8"); ttl <= 0 || ttl > 24*time.Hour {
+		t.Errorf("unread counters cached for %v", ttl)
+	}
+	if got := counts(8); !maps.Equal(got, map[int64]int64{50: 2}) || ut.rebuilt() != 0 {
+		t.Errorf("cached unread counts of user 8 = %v", got)
+	}
+
+	// A new message bumps cached counters and leaves the others to be rebuilt
+	first := ut.send(t, svc)
+	if h := rdb.hash("user:unread:8"); h["50"] != "3" {
+		t.Errorf("cached counters of user 8 = %v", h)
+	}
+	for _, key := range []string{"user:unread:7", "user:unread:9"} {
+		if h := rdb.hash(key); h != nil {
+			t.Errorf("%s cached as %v", key, h)
+		}
+	}
+	if got := counts(9); !maps.Equal(got, map[int64]int64{50: 1}) || ut.rebuilt() != 1 {
+		t.Errorf("unread counts of user 9 = %v", got)
+	}
+	// The sender has nothing unread, the hash is kept to avoid recounting
+	if got := counts(7); len(got) != 0 || rdb.hash("user:unread:7") == nil {
+		t.Errorf("unread counts of the sender = %v, cached %v", got, rdb.hash("user:unread:7"))
+	}
+	ut.rebuilt()
+	second := ut.send(t, svc)
+
+	// Reading moves the marker forward only
+	pool := newPool()
+	conn := connectClient(t, pool, 8)
+	cfg := &config.MessageConfig{MaxLength: 100}
+	read := func(frame string) readEvent {
+		t.Helper()
+		handleFrame(pool, svc, nil, cfg, 8, []byte(frame))
+		frames := receivedEvents(t, pool, 8, conn)
+		var ev struct {
+			Type string    `json:"type"`
+			Data readEvent `json:"data"`
+		}
+		if len(frames) != 1 {
+			t.Fatalf("read answered with %s", frames)
+		}
+		if err := json.Unmarshal(frames[0], &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != eventConversationRead {
+			t.Fatalf("read answered with %s", frames[0])
+		}
+		return ev.Data
+	}
+	id := strconv.FormatInt(first, 10)
+	if ev := read(`{"type":"read","conversation_id":50,"message_id":` + id + `}`); ev.LastReadMessageID != first || ev.Unread != 1 {
+		t.Errorf("read up to %d: %+v", first, ev)
+	}
+	if ev := read(`{"type":"read","conversation_id":50,"message_id":1}`); ev.LastReadMessageID != first || ev.Unread != 1 {
+		t.Errorf("read of an older message: %+v", ev)
+	}
+	if got := counts(8); !maps.Equal(got, map[int64]int64{50: 1}) {
+		t.Errorf("unread counts after reading = %v", got)
+	}
+	if ev := read(`{"type":"read","conversation_id":50}`); ev.LastReadMessageID != second || ev.Unread != 0 {
+		t.Errorf("read of everything: %+v", ev)
+	}
+	if got := counts(8); len(got) != 0 || ut.rebuilt() != 0 {
+		t.Errorf("unread counts after reading everything = %v", got)
+	}
+
+	for frame, want := range map[string]string{
+		`{"type":"read","conversation_id":50,"message_id":99}`: service.ErrMessageNotFound.Error(),
+		`{"type":"read","conversation_id":51}`:                 service.ErrConversationNotFound.Error(),
+	} {
+		handleFrame(pool, svc, nil, cfg, 8, []byte(frame))
+		if frames := receivedEvents(t, pool, 8, conn); len(frames) != 1 || !strings.Contains(string(frames[0]), want) {
+			t.Errorf("%s answered with %s, want %q", frame, frames, want)
+		}
+	}
+
+	// A failed update drops the counters so they are rebuilt
+	rdb.fail("EVALSHA")
+	ut.send(t, svc)
+	if h := rdb.hash("user:unread:8"); h != nil {
+		t.Errorf("counters kept after a failed update: %v", h)
+	}
+
+	// The conversation list carries the unread count and last message
+	rec := httptest.NewRecorder()
+	HandleConversations(rec, withClaims(t, httptest.NewRequest(http.MethodGet, "/conversations", nil), 8, "s1"), svc)
+	var response conversationListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Conversations) != 1 {
+		t.Fatalf("conversations = %+v", response.Conversations)
+	}
+	if c := response.Conversations[0]; c.Unread != 1 || c.LastMessage == nil || c.LastMessage.Body != "latest" {
+		t.Errorf("conversation = %+v", c)
+	}
+	if ut.rebuilt() != 1 {
+		t.Error("unread counts were not rebuilt after the failed update")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Event types pushed to clients over /ws as JSON frames
+const (
+	eventError                  = "error"
+	eventMessage                = "message"
+	eventMessageEdited          = "message_edited"
+	eventMessageDeleted         = "message_deleted"
+	eventMessageUpdated         = "message_updated"
+	eventReaction               = "reaction"
+	eventThreadUpdated          = "thread_updated"
+	eventConversationRead       = "conversation_read"
+	eventConversationCreated    = "conversation_created"
+	eventSyncComplete           = "sync_complete"
+	eventContactRequest         = "contact_request"
+	eventContactRequestCanceled = "contact_request_canceled"
+	eventContactAccepted        = "contact_accepted"
+	eventContactRemoved         = "contact_removed"
+)
+
+// event is the JSON frame the server pushes to clients
+type event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// errorEvent tells a client why one of its frames was rejected
+type errorEvent struct {
+	Error string `json:"error"`
+}
+
+// SendEvent pushes a JSON event to a connected user. It fails if the user is
+// not connected.
+func (pool *Pool) SendEvent(userID int, eventType string, data interface{}) error {
+	frame, err := json.Marshal(event{Type: eventType, Data: data})
+	if err != nil {
+		return fmt.Errorf("error encoding event: %v", err)
+	}
+	// Frames held back during a sync are matched against the replay by the
+	// sequence number of the change they carry
+	pending := pendingFrame{frame: string(frame)}
+	switch ev := data.(type) {
+	case messageEvent:
+		pending.conversationID = ev.ConversationID
+		pending.seq = ev.LatestSeq()
+	case reactionEvent:
+		pending.conversationID = ev.ConversationID
+		pending.seq = ev.Seq
+	case threadEvent:
+		pending.conversationID = ev.ConversationID
+		pending.seq = ev.Seq
+	}
+	return pool.deliver(strconv.Itoa(userID), pending)
+}
+
+// notify pushes an event to a user if they are connected. Offline users pick
+// the change up from the REST API instead.
+func (pool *Pool) notify(userID int, eventType string, data interface{}) {
+	pool.SendEvent(userID, eventType, data)
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gitnoober/chat-go/service"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestService returns a service backed by db and an in-memory Redis
+func newTestService(t *testing.T, db *fakeDB) (*service.Service, *fakeRedis) {
+	t.Helper()
+	mysqlDB := sql.OpenDB(db)
+	t.Cleanup(func() { mysqlDB.Close() })
+
+	rdb := newFakeRedis()
+	client := redis.NewClient(&redis.Options{
+		Addr:             "fake-redis",
+		Protocol:         2,
+		DisableIndentity: true,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, server := net.Pipe()
+			go rdb.serve(server)
+			return conn, nil
+		},
+	})
+	t.Cleanup(func() { client.Close() })
+	return service.NewService(mysqlDB, client), rdb
+}
+
+// withClaims authenticates a request as the user on the session, like
+// requireAuth does with a valid access token
+func withClaims(t *testing.T, r *http.Request, userID int, sessionID string) *http.Request {
+	t.Helper()
+	token, err := generateToken(userID, sessionID, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := validateAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+}
+
+// fakeDB is a database/sql connector answering the queries of a test. A query
+// is answered by the first handler whose match it contains, or with no rows.
+// Every exec is recorded and succeeds unless an onExec handler fails it.
+type fakeDB struct {
+	mu       sync.Mutex
+	queries  []fakeQuery
+	handlers []fakeExecHandler
+	execs    []fakeExec
+	nextID   int64
+}
+
+type fakeExecHandler struct {
+	match  string
+	handle func(args []driver.Value) error
+}
+
+type fakeQuery struct {
+	match  string
+	answer func(args []driver.Value) [][]driver.Value
+}
+
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{nextID: 100}
+}
+
+// onQuery answers queries containing match
+func (db *fakeDB) onQuery(match string, answer func(args []driver.Value) [][]driver.Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, fakeQuery{match: match, answer: answer})
+}
+
+// errNoRowsAffected makes an onExec handler report an exec that matched no rows
+var errNoRowsAffected = errors.New("no rows affected")
+
+// onExec runs handle for execs containing match. An error fails the exec,
+// except errNoRowsAffected.
+func (db *fakeDB) onExec(match string, handle func(args []driver.Value) error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.handlers = append(db.handlers, fakeExecHandler{match: match, handle: handle})
+}
+
+// executed returns the execs whose query contains match
+func (db *fakeDB) executed(match string) []fakeExec {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var execs []fakeExec
+	for _, e := range db.execs {
+		if strings.Contains(e.query, match) {
+			execs = append(execs, e)
+		}
+	}
+	return execs
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return fakeDriver{db: db} }
+
+type fakeDriver struct{ db *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{db: d.db}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake db does not prepare statements")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	args := namedValues(named)
+	c.db.mu.Lock()
+	var answer func([]driver.Value) [][]driver.Value
+	for _, q := range c.db.queries {
+		if strings.Contains(query, q.match) {
+			answer = q.answer
+			break
+		}
+	}
+	c.db.mu.Unlock()
+	if answer == nil {
+		return &fakeRows{}, nil
+	}
+	return &fakeRows{rows: answer(args)}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	args := namedValues(named)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.execs = append(c.db.execs, fakeExec{query: query, args: args})
+	affected := int64(1)
+	for _, h := range c.db.handlers {
+		if strings.Contains(query, h.match) {
+			if err := h.handle(args); err == errNoRowsAffected {
+				affected = 0
+			} else if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	c.db.nextID++
+	return fakeResult{id: c.db.nextID, affected: affected}, nil
+}
+
+func namedValues(named []driver.NamedValue) []driver.Value {
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		args[i] = nv.Value
+	}
+	return args
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeResult struct{ id, affected int64 }
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = "c" + strconv.Itoa(i)
+	}
+	return cols
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+// fakeRedis serves the string, set and hash commands the handlers use over
+// RESP2. Keys expire on a fake clock that only moves with advance. Scripts are
+// not run; EVAL recognizes the unread counter scripts by the command they
+// guard.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+	hashes  map[string]map[string]string
+	failing map[string]bool
+	expires map[string]time.Time
+	now     time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: map[string]string{},
+		sets:    map[string]map[string]bool{},
+		hashes:  map[string]map[string]string{},
+		failing: map[string]bool{},
+		expires: map[string]time.Time{},
+		now:     time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// advance moves the clock keys expire on
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// expire drops the keys whose time to live ran out
+func (f *fakeRedis) expire() {
+	for k, at := range f.expires {
+		if !f.now.Before(at) {
+			delete(f.strings, k)
+			delete(f.sets, k)
+			delete(f.hashes, k)
+			delete(f.expires, k)
+		}
+	}
+}
+
+// exists reports whether a key holds a value
+func (f *fakeRedis) exists(key string) bool {
+	_, isString := f.strings[key]
+	_, isSet := f.sets[key]
+	_, isHash := f.hashes[key]
+	return isString || isSet || isHash
+}
+
+// fail makes every following call of a command return an error
+func (f *fakeRedis) fail(command string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[strings.ToUpper(command)] = true
+}
+
+// get returns a string value
+func (f *fakeRedis) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.strings[key]
+	return v, ok
+}
+
+// hash returns a copy of a hash, or nil
+func (f *fakeRedis) hash(key string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire()
+	if f.hashes[key] == nil {
+		return nil
+	}
+	h := map[string]string{}
+	for field, v := range f.hashes[key] {
+		h[field] = v
+	}
+	return h
+}
+
+// ttl returns the time to live left on a key, or 0 for none
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if at, ok := f.expires[key]; ok {
+		return at.Sub(f.now)
+	}
+	return 0
+}
+
+// set stores a string value
+func (f *fakeRedis) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.strings[key] = value
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch name := strings.ToUpper(args[0]); {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			reply = "+OK\r\n"
+		case name == "EXEC":
+			replies := make([]string, len(queued))
+			for i, cmd := range queued {
+				replies[i] = f.exec(cmd)
+			}
+			inMulti = false
+			reply = fmt.Sprintf("*%d\r\n%s", len(replies), strings.Join(replies, ""))
+		case name == "DISCARD":
+			inMulti, queued = false, nil
+			reply = "+OK\r\n"
+		case inMulti:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = f.exec(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("bad command header %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad bulk header %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulkReply(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func intReply(n int) string {
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+const nilReply = "$-1\r\n"
+
+// hincrby adds to a hash field. The caller holds f.mu.
+func (f *fakeRedis) hincrby(key, field string, by int) int {
+	if f.hashes[key] == nil {
+		f.hashes[key] = map[string]string{}
+	}
+	n, _ := strconv.Atoi(f.hashes[key][field])
+	f.hashes[key][field] = strconv.Itoa(n + by)
+	return n + by
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+	}
+	if f.failing[strings.ToUpper(args[0])] {
+		return "-ERR injected failure\r\n"
+	}
+	f.expire()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if v, ok := f.strings[key]; ok {
+			return bulkReply(v)
+		}
+		return nilReply
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, k := range args[1:] {
+			if v, ok := f.strings[k]; ok {
+				reply += bulkReply(v)
+			} else {
+				reply += nilReply
+			}
+		}
+		return reply
+	case "GETDEL":
+		v, ok := f.strings[key]
+		if !ok {
+			return nilReply
+		}
+		delete(f.strings, key)
+		delete(f.expires, key)
+		return bulkReply(v)
+	case "SET":
+		_, exists := f.strings[key]
+		var ttl time.Duration
+		keepTTL := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exists {
+					return nilReply
+				}
+			case "XX":
+				if !exists {
+					return nilReply
+				}
+			case "EX", "PX":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(n) * time.Millisecond
+				if strings.ToUpper(args[i]) == "EX" {
+					ttl = time.Duration(n) * time.Second
+				}
+				i++
+			case "KEEPTTL":
+				keepTTL = true
+			}
+		}
+		f.strings[key] = args[2]
+		if ttl > 0 {
+			f.expires[key] = f.now.Add(ttl)
+		} else if !keepTTL {
+			delete(f.expires, key)
+		}
+		return "+OK\r\n"
+	case "INCR":
+		n, _ := strconv.Atoi(f.strings[key])
+		f.strings[key] = strconv.Itoa(n + 1)
+		return intReply(n + 1)
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if f.exists(k) {
+				n++
+			}
+			delete(f.strings, k)
+			delete(f.sets, k)
+			delete(f.hashes, k)
+			delete(f.expires, k)
+		}
+		return intReply(n)
+	case "EXPIRE":
+		if !f.exists(key) {
+			return intReply(0)
+		}
+		seconds, _ := strconv.Atoi(args[2])
+		f.expires[key] = f.now.Add(time.Duration(seconds) * time.Second)
+		return intReply(1)
+	case "TTL":
+		if !f.exists(key) {
+			return intReply(-2)
+		}
+		at, ok := f.expires[key]
+		if !ok {
+			return intReply(-1)
+		}
+		return intReply(int((at.Sub(f.now) + time.Second - 1) / time.Second))
+	case "SADD":
+		if f.sets[key] == nil {
+			f.sets[key] = map[string]bool{}
+		}
+		n := 0
+		for _, m := range args[2:] {
+			if !f.sets[key][m] {
+				f.sets[key][m] = true
+				n++
+			}
+		}
+		return intReply(n)
+	case "SREM":
+		n := 0
+		for _, m := range args[2:] {
+			if f.sets[key][m] {
+				delete(f.sets[key], m)
+				n++
+			}
+		}
+		return intReply(n)
+	case "SMEMBERS":
+		var members []string
+		for m := range f.sets[key] {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		reply := fmt.Sprintf("*%d\r\n", len(members))
+		for _, m := range members {
+			reply += bulkReply(m)
+		}
+		return reply
+	case "HSET":
+		if f.hashes[key] == nil {
+			f.hashes[key] = map[string]string{}
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := f.hashes[key][args[i]]; !ok {
+				n++
+			}
+			f.hashes[key][args[i]] = args[i+1]
+		}
+		return intReply(n)
+	case "HINCRBY":
+		by, _ := strconv.Atoi(args[3])
+		return intReply(f.hincrby(key, args[2], by))
+	case "HGETALL":
+		var fields []string
+		for field := range f.hashes[key] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		reply := fmt.Sprintf("*%d\r\n", 2*len(fields))
+		for _, field := range fields {
+			reply += bulkReply(field) + bulkReply(f.hashes[key][field])
+		}
+		return reply
+	case "EVALSHA":
+		return "-NOSCRIPT No matching script\r\n"
+	case "EVAL":
+		// EVAL script 1 key field value, run only on an existing hash
+		script, key := args[1], args[3]
+		if !f.exists(key) {
+			return intReply(0)
+		}
+		switch {
+		case strings.Contains(script, `"HINCRBY"`):
+			by, _ := strconv.Atoi(args[5])
+			return intReply(f.hincrby(key, args[4], by))
+		case strings.Contains(script, `"HSET"`):
+			f.hashes[key][args[4]] = args[5]
+			return intReply(0)
+		}
+		return "-ERR unknown script\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
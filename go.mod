@@ -7,15 +7,15 @@ require gorm.io/driver/mysql v1.5.7
 require (
 	github.com/benbjohnson/clock v1.3.0 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/coder/websocket v1.8.12 // indirect
+	github.com/coder/websocket v1.8.12
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/go-sql-driver/mysql v1.7.0 // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
+	github.com/go-sql-driver/mysql v1.7.0
+	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/redis/go-redis/v9 v9.6.1 // indirect
-	go.uber.org/ratelimit v0.3.1 // indirect
+	github.com/joho/godotenv v1.5.1
+	github.com/redis/go-redis/v9 v9.6.1
+	go.uber.org/ratelimit v0.3.1
 	golang.org/x/crypto v0.27.0
 	gorm.io/gorm v1.25.7 // indirect
 )
@@ -2,9 +2,7 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -12,17 +10,15 @@ import (
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/gitnoober/chat-go/config"
 	"github.com/gitnoober/chat-go/service"
 	thirdparty "github.com/gitnoober/chat-go/third-party"
-	"github.com/redis/go-redis/v9"
+	utils "github.com/gitnoober/chat-go/utils"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func createUser(w http.ResponseWriter, r *http.Request, svc *service.Service) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// HandleCreateUser signs up a new user
+func HandleCreateUser(w http.ResponseWriter, r *http.Request, svc *service.Service) {
 	var user service.User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
@@ -56,25 +52,12 @@ func createUser(w http.ResponseWriter, r *http.Request, svc *service.Service) {
 
 }
 
-func getUser(w http.ResponseWriter, r *http.Request, svc *service.Service) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	tokenString := r.Header.Get("Authorization")
-	log.Printf("Token: %s", tokenString)
-	claims, err := validateJWT(tokenString)
-	log.Printf("Claims: %v", claims)
-	log.Printf("Error: %v", err)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-	userID := int(claims["sub"].(float64))
-	log.Printf("User ID: %d", userID)
+// HandleGetUser returns the caller's own profile
+func HandleGetUser(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
 
 	// Get user from service
-	user, err := svc.GetUserByID(userID)
+	user, err := svc.GetUserProfile(claims.UserID())
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -84,90 +67,46 @@ func getUser(w http.ResponseWriter, r *http.Request, svc *service.Service) {
 	json.NewEncoder(w).Encode(user)
 }
 
-func getAllActiveConn(pool *Pool, w http.ResponseWriter, svc *service.Service) {
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
-
-	ids := make([]string, 0, len(pool.clients))
-	for id := range pool.clients {
-		ids = append(ids, id)
-	}
-	log.Printf("ids: %v", ids)
-
-	userList := make([]service.User, 0, len(ids))
-
-	for _, id := range ids {
-		userID, err := strconv.Atoi(id)
-		if err != nil {
-			http.Error(w, "Invalid user ID", http.StatusBadRequest)
-			continue
-		}
-		user, err := svc.GetUserByID(userID)
-		if err != nil {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-		userList = append(userList, *user)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(userList)
-}
+// Handle incoming websocket connections
+func HandleWebSocket(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, opts *websocket.AcceptOptions, blobs thirdparty.BlobStore, msgCfg *config.MessageConfig) {
+	claims := claimsFromContext(r.Context())
 
-func HandleGetAllActiveConn(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Revoked sessions must not reconnect with a still unexpired access token
+	session, err := svc.GetSession(claims.SessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	tokenString := r.Header.Get("Authorization")
-	_, err := validateJWT(tokenString)
-	if err != nil {
+	if session == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	log.Printf("pool: %v", pool)
-	getAllActiveConn(pool, w, svc)
-}
-
-func HandleUser(w http.ResponseWriter, r *http.Request, svc *service.Service) {
-	switch requestType := r.Method; requestType {
-	case http.MethodPost:
-		log.Print("Inside POST method")
-		createUser(w, r, svc)
-	case http.MethodGet:
-		log.Print("Inside GET method")
-		getUser(w, r, svc)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
-}
 
-// Handle incoming websocket connections
-func HandleWebSocket(pool *Pool, w http.ResponseWriter, r *http.Request) {
-	tokenString := r.URL.Query().Get("token")
-	// Log the connection request
-	log.Printf("Received WebSocket connection request with token: %s", tokenString)
-
-	// claims, err := validateJWT(tokenString)
-	claims, err := validateJWT(tokenString)
+	// Reconnecting clients pass the last sequence number they got per
+	// conversation to have missed messages replayed
+	resume, err := parseResume(r.URL.Query().Get("resume"))
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	conn, err := websocket.Accept(w, r, nil)
+	conn, err := websocket.Accept(w, r, opts)
 	if err != nil {
 		log.Printf("Websocket connection err: %v", err)
 		return
 	}
 
-	ID := claims["sub"].(float64)
-	clientID := strconv.Itoa(int(ID))
+	clientID := strconv.Itoa(claims.UserID())
 	client := &Client{
-		ID:   clientID,
-		Conn: conn,
+		ID:        clientID,
+		SessionID: session.ID,
+		Conn:      conn,
+		syncing:   len(resume) > 0,
 	}
 	pool.AddClient(client)
+	if client.syncing {
+		syncConversations(pool, svc, client, claims.UserID(), resume)
+	}
 
 	log.Printf("Client added to pool: %v", pool)
 
@@ -195,65 +134,129 @@ func HandleWebSocket(pool *Pool, w http.ResponseWriter, r *http.Request) {
 
 		// log.Println("Received message:", string(message))
 
-		// Assume the message format is "receiverID:message"
-		parts := splitMessage(string(message))
-		if len(parts) != 2 {
-			log.Println("Invalid message format")
-			continue
-		}
-		receiverID, msg := parts[0], parts[1]
-
-		// Send the message to the intended recipient
-		if err := pool.SendMessage(receiverID, msg); err != nil {
-			log.Printf("Send message error: %v", err)
-		}
+		handleFrame(pool, svc, blobs, msgCfg, claims.UserID(), message)
 	}
 }
 
-func HandleLogin(w http.ResponseWriter, r *http.Request, svc *service.Service) {
-	emailID := r.URL.Query().Get("email")
+func HandleLogin(w http.ResponseWriter, r *http.Request, svc *service.Service, cfg *config.LockoutConfig, mfaCfg *config.MFAConfig) {
+	emailID := r.FormValue("email")
 	if emailID == "" {
 		http.Error(w, "Email is required", http.StatusBadRequest)
 		return
 	}
-	userID, err := svc.GetUserByEmail(emailID)
+	password := r.FormValue("password")
+	if password == "" {
+		http.Error(w, "Password is required", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	locked, err := loginLockRemaining(svc, emailID, ip)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if locked > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.Seconds())+1))
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
 		return
 	}
 
-	password := r.URL.Query().Get("password")
-	if password == "" {
-		http.Error(w, "Password is required", http.StatusBadRequest)
+	// Unknown accounts and wrong passwords must look the same to the caller
+	user, err := svc.GetUserForLogin(emailID)
+	if err == nil && user.Password == "" {
+		// Accounts created through an identity provider have no password
+		err = service.ErrUserNotFound
+	}
+	if err != nil {
+		compareDummyPassword(password)
+	} else {
+		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	}
+	if err != nil {
+		recordLoginFailure(svc, cfg, emailID, ip)
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
-	user, uErr := svc.GetUserByID(userID)
-	if uErr != nil {
-		http.Error(w, "User not found", http.StatusUnauthorized)
+	resetLoginFailures(svc, emailID)
+
+	userID, err := strconv.Atoi(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	completeLogin(w, r, userID, svc, mfaCfg)
+}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+// completeLogin finishes a login whose first factor succeeded. Accounts with
+// two-factor authentication get an mfa_pending token instead of real tokens.
+func completeLogin(w http.ResponseWriter, r *http.Request, userID int, svc *service.Service, mfaCfg *config.MFAConfig) {
+	mfa, err := svc.GetMFA(userID)
 	if err != nil {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if mfa != nil && mfa.Enabled {
+		mfaToken, err := generateMFAPendingToken(userID, mfaCfg.PendingTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response := map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	issueTokens(w, r, userID, svc)
+}
 
-	accessToken, err := generateToken(userID)
+// issueTokens starts a new session and writes its access and refresh token pair
+func issueTokens(w http.ResponseWriter, r *http.Request, userID int, svc *service.Service) {
+	user, err := svc.GetUserByID(userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if user.Disabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
 
-	refreshToken, err := generateRefreshToken(userID)
+	sessionID, err := newTokenID()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rErr := addRefreshToken(refreshToken, svc)
-	if rErr != nil {
-		http.Error(w, rErr.Error(), http.StatusInternalServerError)
+	accessToken, err := generateToken(userID, sessionID, user.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	refreshToken, err := generateRefreshToken(userID, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	session := service.Session{
+		ID:               sessionID,
+		UserID:           userID,
+		DeviceName:       deviceName(r),
+		UserAgent:        r.UserAgent(),
+		IP:               clientIP(r),
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		RefreshTokenHash: utils.GenerateSHA256Hash(refreshToken),
+	}
+	if err := svc.CreateSession(session, refreshTokenExpiration); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -266,24 +269,37 @@ func HandleLogin(w http.ResponseWriter, r *http.Request, svc *service.Service) {
 }
 
 func HandleRefreshToken(w http.ResponseWriter, r *http.Request, svc *service.Service) {
-	refreshToken := r.URL.Query().Get("refresh_token")
-	claims, err := validateJWT(refreshToken)
+	refreshToken := r.FormValue("refresh_token")
+	claims, err := validateRefreshJWT(refreshToken)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	isUserAuth, rErr := validateRefreshToken(refreshToken, svc)
+	session, rErr := validateRefreshToken(claims, refreshToken, svc)
 	if rErr != nil {
 		http.Error(w, rErr.Error(), http.StatusInternalServerError)
 		return
 	}
-	if !isUserAuth {
+	if session == nil {
 		http.Error(w, "Unauthorized! Log in Again!", http.StatusUnauthorized)
 		return
 	}
+	if err := svc.TouchSession(*session); err != nil {
+		log.Printf("Error updating session: %v", err)
+	}
 
-	userID := int(claims["sub"].(float64))
-	accessToken, err := generateToken(userID)
+	// Pick up role changes and disabled accounts on every refresh
+	user, err := svc.GetUserByID(claims.UserID())
+	if err != nil {
+		http.Error(w, "Unauthorized! Log in Again!", http.StatusUnauthorized)
+		return
+	}
+	if user.Disabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	accessToken, err := generateToken(claims.UserID(), claims.SessionID, user.Role)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -294,26 +310,3 @@ func HandleRefreshToken(w http.ResponseWriter, r *http.Request, svc *service.Ser
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
-
-func healthCheckHandler(db *sql.DB, redisDB *redis.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// Check MySQL database connection
-		if err := db.Ping(); err != nil {
-			http.Error(w, fmt.Sprintf("Database unreachable: %v", err), http.StatusServiceUnavailable)
-			return
-		}
-
-		// Check Redis connection
-		if err := redisDB.Ping(context.Background()).Err(); err != nil {
-			http.Error(w, fmt.Sprintf("Redis unreachable: %v", err), http.StatusServiceUnavailable)
-			return
-		}
-
-		// All checks passed
-		duration := time.Since(start)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "OK - Database and Redis are reachable. Response time: %v", duration)
-	}
-}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// readinessCheck is a single dependency reported by /readyz
+type readinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// health serves the liveness and readiness probes
+type health struct {
+	checks       []readinessCheck
+	shuttingDown atomic.Bool
+}
+
+func newHealth(db *sql.DB, redisDB *redis.Client) *health {
+	return &health{
+		checks: []readinessCheck{
+			{Name: "mysql", Check: db.PingContext},
+			{Name: "redis", Check: func(ctx context.Context) error {
+				return redisDB.Ping(ctx).Err()
+			}},
+		},
+	}
+}
+
+// markShuttingDown flips readiness so load balancers stop sending new traffic
+func (h *health) markShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// HandleLivez reports that the process is up and serving requests
+func (h *health) HandleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+}
+
+// HandleReadyz runs every dependency check concurrently, each with its own
+// timeout, and reports 503 if any fails or the server is shutting down
+func (h *health) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	response := readinessResponse{
+		Status: "ready",
+		Checks: make(map[string]checkResult, len(h.checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.Check(ctx)
+			result := checkResult{
+				Status:    "ok",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			response.Checks[c.Name] = result
+			if err != nil {
+				response.Status = "not_ready"
+			}
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	if h.shuttingDown.Load() {
+		response.Status = "shutting_down"
+	}
+	status := http.StatusOK
+	if response.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	failing := false
+	h := &health{checks: []readinessCheck{
+		{Name: "mysql", Check: func(context.Context) error { return nil }},
+		{Name: "redis", Check: func(ctx context.Context) error {
+			if failing {
+				return errors.New("connection refused")
+			}
+			return nil
+		}},
+		// Checks are cut off when the probe gives up
+		{Name: "slow", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			if !failing {
+				return nil
+			}
+			return ctx.Err()
+		}},
+	}}
+
+	probe := func() (int, readinessResponse) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		rec := httptest.NewRecorder()
+		h.HandleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx))
+		var response readinessResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, response
+	}
+
+	code, response := probe()
+	if code != http.StatusOK || response.Status != "ready" || len(response.Checks) != 3 {
+		t.Fatalf("healthy: %d %+v", code, response)
+	}
+	if response.Checks["slow"].LatencyMS < 10 {
+		t.Errorf("slow check latency %vms", response.Checks["slow"].LatencyMS)
+	}
+
+	failing = true
+	code, response = probe()
+	if code != http.StatusServiceUnavailable || response.Status != "not_ready" {
+		t.Fatalf("failing: %d %+v", code, response)
+	}
+	if c := response.Checks["redis"]; c.Status != "error" || c.Error != "connection refused" {
+		t.Errorf("redis check = %+v", c)
+	}
+	if c := response.Checks["slow"]; c.Status != "error" || c.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("timed out check = %+v", c)
+	}
+	if c := response.Checks["mysql"]; c.Status != "ok" {
+		t.Errorf("mysql check = %+v", c)
+	}
+
+	// Shutting down turns readiness off while liveness stays up
+	failing = false
+	h.markShuttingDown()
+	if code, response = probe(); code != http.StatusServiceUnavailable || response.Status != "shutting_down" {
+		t.Errorf("shutting down: %d %+v", code, response)
+	}
+	rec := httptest.NewRecorder()
+	h.HandleLivez(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("livez while shutting down: %d", rec.Code)
+	}
+}
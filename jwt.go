@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/gitnoober/chat-go/service"
@@ -49,74 +52,180 @@ func validateTestJWT(tokenString string) (jwt.MapClaims, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
-// Validate JWT token and return claims
-func validateJWT(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+// Token types carried in the typ claim. Every endpoint accepts exactly one of
+// them, so a refresh or mfa_pending token can never be used as an access token.
+const (
+	accessTokenType     = "access"
+	refreshTokenType    = "refresh"
+	mfaPendingTokenType = "mfa_pending"
+)
 
+// Issuer and audience stamped into and required on every token
+var (
+	tokenIssuer   = "chat-go"
+	tokenAudience = "chat-go"
+)
+
+// Claims are the typed claims of every token we issue
+type Claims struct {
+	Type        string   `json:"typ"`
+	SessionID   string   `json:"sid,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"perms,omitempty"`
+	jwt.RegisteredClaims
+
+	userID int
+}
+
+// UserID returns the numeric user ID from the sub claim
+func (c *Claims) UserID() int {
+	return c.userID
+}
+
+// Validate an access token and return its claims
+func validateAccessToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, accessTokenType)
+}
+
+// Validate the signature and type of a refresh token. Whether it was revoked
+// is checked separately by validateRefreshToken.
+func validateRefreshJWT(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, refreshTokenType)
+}
+
+// Validate an mfa_pending token issued after a successful password check
+func validateMFAPendingToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, mfaPendingTokenType)
+}
+
+// Parse and verify a token, requiring the given type, our issuer and audience
+func parseToken(tokenString, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, verificationKey,
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(tokenAudience),
+		jwt.WithExpirationRequired(),
+	)
 	if err != nil || !token.Valid {
 		return nil, fmt.Errorf("invalid token: %v", err)
 	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid claims")
+	if claims.Type != tokenType {
+		return nil, fmt.Errorf("invalid token type: %q", claims.Type)
 	}
-	log.Printf("Claims later part: %v", claims)
-
+	if claims.ID == "" {
+		return nil, fmt.Errorf("invalid token: missing jti")
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return nil, fmt.Errorf("invalid token: bad subject")
+	}
+	claims.userID = userID
 	return claims, nil
 }
 
-func generateToken(userID int) (string, error) {
-	claims := jwt.MapClaims{
-		"sub": userID,
-		"iat": time.Now().Unix(),
-		"exp": time.Now().Add(accessTokenExpiration).Unix(),
+// Sign claims with the current key, or with jwtSecret when HS256 is configured
+func signToken(claims jwt.Claims) (string, error) {
+	if signingKeys == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(jwtSecret)
 	}
+	key := signingKeys.current()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+// Pick the key a token was signed with, rejecting algorithms we did not configure
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if signingKeys == nil {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key := signingKeys.lookup(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key: %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Private.Public(), nil
 }
 
-func generateRefreshToken(userID int) (string, error) {
-	claims := jwt.MapClaims{
-		"sub": userID,
-		"iat": time.Now().Unix(),
-		"exp": time.Now().Add(refreshTokenExpiration).Unix(), // 7 days
+// newTokenID returns a random identifier for the jti and sid claims
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating token id: %v", err)
 	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+// newClaims fills in the claims shared by every token type
+func newClaims(userID int, tokenType, sessionID string, ttl time.Duration) (*Claims, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Claims{
+		Type:      tokenType,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   strconv.Itoa(userID),
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{tokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}, nil
 }
 
-func validateRefreshToken(tokenString string, svc *service.Service) (bool, error) {
-	if tokenString == "" {
-		return false, nil
+// generateToken issues an access token carrying the user's role and its permissions
+func generateToken(userID int, sessionID, role string) (string, error) {
+	claims, err := newClaims(userID, accessTokenType, sessionID, accessTokenExpiration)
+	if err != nil {
+		return "", err
 	}
-	hash := utils.GenerateMD5Hash(tokenString)
-	val, err := svc.GetRedisData(hash)
+	claims.Role = role
+	claims.Permissions = permissionsFor(role)
+	return signToken(claims)
+}
+
+func generateRefreshToken(userID int, sessionID string) (string, error) {
+	claims, err := newClaims(userID, refreshTokenType, sessionID, refreshTokenExpiration) // 7 days
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	log.Println("result:", val)
-	if val == "1" {
-		return true, nil
+	return signToken(claims)
+}
+
+func generateMFAPendingToken(userID int, ttl time.Duration) (string, error) {
+	claims, err := newClaims(userID, mfaPendingTokenType, "", ttl)
+	if err != nil {
+		return "", err
 	}
-	return false, nil
+	return signToken(claims)
 }
 
-func addRefreshToken(tokenString string, svc *service.Service) error {
-	if tokenString == "" {
-		return nil
+// validateRefreshToken checks that the refresh token still belongs to a live
+// session, i.e. that the session was not revoked or replaced
+func validateRefreshToken(claims *Claims, tokenString string, svc *service.Service) (*service.Session, error) {
+	if claims.SessionID == "" {
+		return nil, nil
 	}
-	hash := utils.GenerateMD5Hash(tokenString)
-	err := svc.SetRedisData(hash, "1", refreshTokenExpiration)
+	session, err := svc.GetSession(claims.SessionID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if session == nil || session.UserID != claims.UserID() {
+		return nil, nil
+	}
+	if !utils.ConstantTimeEqual(session.RefreshTokenHash, utils.GenerateSHA256Hash(tokenString)) {
+		return nil, nil
 	}
-	return nil
+	return session, nil
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestTokenTypesAreNotInterchangeable(t *testing.T) {
+	access, err := generateToken(7, "s1", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := generateRefreshToken(7, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := generateMFAPendingToken(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validators := map[string]func(string) (*Claims, error){
+		accessTokenType:     validateAccessToken,
+		refreshTokenType:    validateRefreshJWT,
+		mfaPendingTokenType: validateMFAPendingToken,
+	}
+	tokens := map[string]string{accessTokenType: access, refreshTokenType: refresh, mfaPendingTokenType: pending}
+	for tokenType, token := range tokens {
+		for validatorType, validate := range validators {
+			claims, err := validate(token)
+			if tokenType != validatorType {
+				if err == nil {
+					t.Errorf("%s token accepted as %s token", tokenType, validatorType)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s token rejected: %v", tokenType, err)
+				continue
+			}
+			if claims.UserID() != 7 || claims.Issuer != tokenIssuer || claims.ID == "" {
+				t.Errorf("%s claims = %+v", tokenType, claims)
+			}
+		}
+	}
+
+	claims, err := validateAccessToken(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.SessionID != "s1" || claims.Role != "admin" || !slices.Equal(claims.Permissions, permissionsFor("admin")) || len(claims.Permissions) == 0 {
+		t.Errorf("access claims = %+v", claims)
+	}
+	other, err := validateRefreshJWT(refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ID == other.ID {
+		t.Error("two tokens share a jti")
+	}
+}
+
+func TestParseTokenRejectsBadClaims(t *testing.T) {
+	sign := func(change func(c *Claims)) string {
+		t.Helper()
+		claims, err := newClaims(7, accessTokenType, "s1", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change(claims)
+		token, err := signToken(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if _, err := validateAccessToken(sign(func(*Claims) {})); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	for name, token := range map[string]string{
+		"other issuer":     sign(func(c *Claims) { c.Issuer = "someone-else" }),
+		"other audience":   sign(func(c *Claims) { c.Audience = jwt.ClaimStrings{"someone-else"} }),
+		"no jti":           sign(func(c *Claims) { c.ID = "" }),
+		"no expiry":        sign(func(c *Claims) { c.ExpiresAt = nil }),
+		"expired":          sign(func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }),
+		"no type":          sign(func(c *Claims) { c.Type = "" }),
+		"text subject":     sign(func(c *Claims) { c.Subject = "ada" }),
+		"zero subject":     sign(func(c *Claims) { c.Subject = "0" }),
+		"unsigned":         unsignedToken(t),
+		"garbage":          "not.a.token",
+		"tampered payload": tamper(sign(func(*Claims) {})),
+	} {
+		if _, err := validateAccessToken(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+// unsignedToken returns a valid access token with the "none" algorithm
+func unsignedToken(t *testing.T) string {
+	t.Helper()
+	claims, err := newClaims(7, accessTokenType, "s1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// tamper changes the payload of a signed token and keeps its signature
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	other, _ := generateToken(8, "s1", "admin")
+	parts[1] = strings.Split(other, ".")[1]
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	utils "github.com/gitnoober/chat-go/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	loginFailAccountPrefix = "login:fail:acct:"
+	loginFailIPPrefix      = "login:fail:ip:"
+	loginLockAccountPrefix = "login:lock:acct:"
+	loginLockIPPrefix      = "login:lock:ip:"
+)
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyPassword burns the same bcrypt cost as a real comparison so that
+// unknown accounts cannot be told apart from wrong passwords by response time
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// accountKey normalizes an email so the counters cannot be dodged by changing case
+func accountKey(email string) string {
+	return utils.GenerateMD5Hash(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// clientIP returns the remote address of the request without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginLockRemaining returns how long the account or IP is still locked out for
+func loginLockRemaining(svc *service.Service, email, ip string) (time.Duration, error) {
+	acctTTL, err := svc.GetRedisTTL(loginLockAccountPrefix + accountKey(email))
+	if err != nil {
+		return 0, err
+	}
+	ipTTL, err := svc.GetRedisTTL(loginLockIPPrefix + ip)
+	if err != nil {
+		return 0, err
+	}
+	if ipTTL > acctTTL {
+		return ipTTL, nil
+	}
+	return acctTTL, nil
+}
+
+// lockoutDuration doubles the lockout for every failure past the threshold
+func lockoutDuration(cfg *config.LockoutConfig, failures, threshold int64) time.Duration {
+	lock := cfg.BaseLockout
+	for i := threshold; i < failures && lock < cfg.MaxLockout; i++ {
+		lock *= 2
+	}
+	if lock > cfg.MaxLockout {
+		lock = cfg.MaxLockout
+	}
+	return lock
+}
+
+// recordLoginFailure bumps the per-account and per-IP counters and locks either
+// one out once it passes its threshold
+func recordLoginFailure(svc *service.Service, cfg *config.LockoutConfig, email, ip string) {
+	acct := accountKey(email)
+	acctFailures, err := svc.IncrRedisCounter(loginFailAccountPrefix+acct, cfg.Window)
+	if err != nil {
+		log.Printf("Error recording login failure: %v", err)
+		return
+	}
+	if acctFailures >= int64(cfg.MaxAccountAttempts) {
+		lock := lockoutDuration(cfg, acctFailures, int64(cfg.MaxAccountAttempts))
+		if err := svc.SetRedisData(loginLockAccountPrefix+acct, "1", lock); err != nil {
+			log.Printf("Error locking account: %v", err)
+		} else {
+			log.Printf("[security] account locked: account=%s ip=%s failures=%d duration=%v", acct, ip, acctFailures, lock)
+		}
+	}
+
+	ipFailures, err := svc.IncrRedisCounter(loginFailIPPrefix+ip, cfg.Window)
+	if err != nil {
+		log.Printf("Error recording login failure: %v", err)
+		return
+	}
+	if ipFailures >= int64(cfg.MaxIPAttempts) {
+		lock := lockoutDuration(cfg, ipFailures, int64(cfg.MaxIPAttempts))
+		if err := svc.SetRedisData(loginLockIPPrefix+ip, "1", lock); err != nil {
+			log.Printf("Error locking ip: %v", err)
+		} else {
+			log.Printf("[security] ip locked: ip=%s failures=%d duration=%v", ip, ipFailures, lock)
+		}
+	}
+}
+
+// resetLoginFailures clears the account counter after a successful login
+func resetLoginFailures(svc *service.Service, email string) {
+	if err := svc.DeleteRedisData(loginFailAccountPrefix + accountKey(email)); err != nil {
+		log.Printf("Error resetting login failures: %v", err)
+	}
+}
+
+// unlockAccount lifts an account lockout and clears its failure counter
+func unlockAccount(svc *service.Service, email string) error {
+	acct := accountKey(email)
+	return svc.DeleteRedisData(loginLockAccountPrefix+acct, loginFailAccountPrefix+acct)
+}
+
+// HandleUnlock lets the security team lift a lockout early. It is only enabled
+// when LOGIN_UNLOCK_KEY is configured and expects it in the X-Unlock-Key header.
+func HandleUnlock(w http.ResponseWriter, r *http.Request, svc *service.Service, cfg *config.LockoutConfig) {
+	if cfg.UnlockKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !utils.ConstantTimeEqual(r.Header.Get("X-Unlock-Key"), cfg.UnlockKey) {
+		log.Printf("[security] rejected unlock attempt: ip=%s", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if err := unlockAccount(svc, email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[security] account unlocked: account=%s ip=%s", accountKey(email), clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
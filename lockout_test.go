@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+)
+
+func testLockoutConfig() *config.LockoutConfig {
+	return &config.LockoutConfig{
+		MaxAccountAttempts: 3,
+		MaxIPAttempts:      5,
+		Window:             15 * time.Minute,
+		BaseLockout:        time.Minute,
+		MaxLockout:         time.Hour,
+		UnlockKey:          "unlock",
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	cfg := testLockoutConfig()
+	for failures, want := range map[int64]time.Duration{
+		3:  time.Minute,
+		4:  2 * time.Minute,
+		5:  4 * time.Minute,
+		9:  time.Hour,
+		50: time.Hour,
+	} {
+		if got := lockoutDuration(cfg, failures, 3); got != want {
+			t.Errorf("lockoutDuration(%d failures) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	svc, rdb := newTestService(t, newFakeDB())
+	cfg := testLockoutConfig()
+	locked := func(email, ip string) time.Duration {
+		t.Helper()
+		d, err := loginLockRemaining(svc, email, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// The account locks on the third failure, whatever the case of the email
+	recordLoginFailure(svc, cfg, "a@example.com", "10.0.0.1")
+	recordLoginFailure(svc, cfg, "A@Example.com", "10.0.0.2")
+	if d := locked("a@example.com", "10.0.0.3"); d != 0 {
+		t.Fatalf("locked for %v below the threshold", d)
+	}
+	recordLoginFailure(svc, cfg, "a@example.com ", "10.0.0.3")
+	if d := locked("a@example.com", "10.0.0.4"); d != time.Minute {
+		t.Fatalf("locked for %v at the threshold, want 1m", d)
+	}
+
+	// The lockout expires, and the next failure doubles it
+	rdb.advance(time.Minute)
+	if d := locked("a@example.com", "10.0.0.4"); d != 0 {
+		t.Fatalf("still locked for %v after the lockout", d)
+	}
+	recordLoginFailure(svc, cfg, "a@example.com", "10.0.0.4")
+	if d := locked("a@example.com", "10.0.0.4"); d != 2*time.Minute {
+		t.Fatalf("locked for %v after another failure, want 2m", d)
+	}
+
+	// Failures are forgotten after the window
+	rdb.advance(cfg.Window)
+	recordLoginFailure(svc, cfg, "a@example.com", "10.0.0.5")
+	if d := locked("a@example.com", "10.0.0.5"); d != 0 {
+		t.Fatalf("locked for %v after the window passed", d)
+	}
+
+	// An IP that tries many accounts is locked for all of them
+	for i := 0; i < cfg.MaxIPAttempts; i++ {
+		recordLoginFailure(svc, cfg, strings.Repeat("b", i+1)+"@example.com", "10.0.0.9")
+	}
+	if d := locked("c@example.com", "10.0.0.9"); d != time.Minute {
+		t.Fatalf("ip locked for %v, want 1m", d)
+	}
+
+	// A successful login clears the account counter
+	recordLoginFailure(svc, cfg, "d@example.com", "10.0.1.1")
+	recordLoginFailure(svc, cfg, "d@example.com", "10.0.1.1")
+	resetLoginFailures(svc, "d@example.com")
+	recordLoginFailure(svc, cfg, "d@example.com", "10.0.1.1")
+	if d := locked("d@example.com", "10.0.1.2"); d != 0 {
+		t.Fatalf("locked for %v after a successful login reset the counter", d)
+	}
+}
+
+func TestHandleUnlock(t *testing.T) {
+	svc, _ := newTestService(t, newFakeDB())
+	cfg := testLockoutConfig()
+	for i := 0; i < cfg.MaxAccountAttempts; i++ {
+		recordLoginFailure(svc, cfg, "a@example.com", "10.0.0.1")
+	}
+
+	unlock := func(cfg *config.LockoutConfig, key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/unlock", strings.NewReader("email=a@example.com"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Unlock-Key", key)
+		rec := httptest.NewRecorder()
+		HandleUnlock(rec, req, svc, cfg)
+		return rec.Code
+	}
+	disabled := testLockoutConfig()
+	disabled.UnlockKey = ""
+	if code := unlock(disabled, ""); code != http.StatusNotFound {
+		t.Errorf("unlock without a configured key: status %d, want 404", code)
+	}
+	if code := unlock(cfg, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("unlock with a wrong key: status %d, want 401", code)
+	}
+	if d, _ := loginLockRemaining(svc, "a@example.com", "10.0.0.2"); d == 0 {
+		t.Fatal("account unlocked by a rejected request")
+	}
+	if code := unlock(cfg, "unlock"); code != http.StatusNoContent {
+		t.Fatalf("unlock: status %d, want 204", code)
+	}
+	if d, _ := loginLockRemaining(svc, "a@example.com", "10.0.0.2"); d != 0 {
+		t.Errorf("still locked for %v after unlock", d)
+	}
+}
@@ -8,22 +8,54 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/coder/websocket"
 	"github.com/joho/godotenv"
-	"go.uber.org/ratelimit"
 
 	"github.com/gitnoober/chat-go/config"
 	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
 )
 
 
 // Client represents a websocket client
 type Client struct {
-	ID   string
-	Conn *websocket.Conn
+	ID        string
+	SessionID string
+	Conn      *websocket.Conn
+	// While syncing, missed messages are replayed and live frames wait in
+	// pending. Both are guarded by the pool lock.
+	syncing bool
+	pending []pendingFrame
+}
+
+// pendingFrame is a live frame held back while its client is syncing. Seq is
+// set for messages so frames already replayed can be skipped.
+type pendingFrame struct {
+	conversationID int64
+	seq            int64
+	frame          string
+}
+
+// write sends a text frame to the client
+func (client *Client) write(frame string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	w, err := client.Conn.Writer(ctx, websocket.MessageText)
+	if err != nil {
+		return fmt.Errorf("failed to get writer: %w", err)
+	}
+	defer w.Close()
+
+	// Write the message
+	if _, err := w.Write([]byte(frame)); err != nil {
+		return fmt.Errorf("error sending message: %v", err)
+	}
+	return nil
 }
 
 // Pool manages all active connections
@@ -55,30 +87,93 @@ func (pool *Pool) RemoveClient(clientID string) {
 	delete(pool.clients, clientID)
 }
 
+// ClientIDs returns a snapshot of the IDs of all connected clients
+func (pool *Pool) ClientIDs() []string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	ids := make([]string, 0, len(pool.clients))
+	for id := range pool.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Close the connection of a client if it belongs to the given session
+func (pool *Pool) DisconnectSession(userID int, sessionID string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	client, ok := pool.clients[strconv.Itoa(userID)]
+	if ok && client.SessionID == sessionID {
+		client.Conn.Close(websocket.StatusPolicyViolation, "session revoked")
+	}
+}
+
+// Close the connection of a user, reporting whether they were connected
+func (pool *Pool) DisconnectUser(userID int, reason string) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	client, ok := pool.clients[strconv.Itoa(userID)]
+	if ok {
+		client.Conn.Close(websocket.StatusPolicyViolation, reason)
+	}
+	return ok
+}
+
 // Send a message to a specific client
 func (pool *Pool) SendMessage(ReceiverID string, message string) error {
+	return pool.deliver(ReceiverID, pendingFrame{frame: message})
+}
+
+// deliver writes a frame to a client, or holds it back while the client is
+// syncing
+func (pool *Pool) deliver(receiverID string, frame pendingFrame) error {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-
-	receiver, ok := pool.clients[ReceiverID]
+	receiver, ok := pool.clients[receiverID]
 	if !ok {
-		fmt.Printf("client not found: %s", ReceiverID)
+		return fmt.Errorf("client not found: %s", receiverID)
 	}
-	w, err := receiver.Conn.Writer(ctx, websocket.MessageText)
-	if err != nil {
-		return fmt.Errorf("failed to get writer: %w", err)
+	if receiver.syncing {
+		receiver.pending = append(receiver.pending, frame)
+		return nil
 	}
-	defer w.Close()
+	return receiver.write(frame.frame)
+}
 
-	// Write the message
-	if _, err := w.Write([]byte(message)); err != nil {
-		return fmt.Errorf("error sending message: %v", err)
+// beginSync holds back live frames to a connected client until endSync
+func (pool *Pool) beginSync(clientID string) *Client {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	client, ok := pool.clients[clientID]
+	if !ok {
+		return nil
 	}
+	client.syncing = true
+	return client
+}
 
-	return nil
+// endSync sends the frames held back during a sync and resumes live
+// delivery. Messages up to the replayed sequence numbers are skipped since
+// the client already got them.
+func (pool *Pool) endSync(client *Client, replayed map[int64]int64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, p := range client.pending {
+		if p.seq != 0 && p.seq <= replayed[p.conversationID] {
+			continue
+		}
+		if err := client.write(p.frame); err != nil {
+			log.Printf("Send message error: %v", err)
+		}
+	}
+	client.pending = nil
+	client.syncing = false
 }
 
 // Splitmessage
@@ -107,9 +202,10 @@ func init() {
         log.Fatalf("Error loading .env file: %v", err)
     }
 
-    // Set jwtSecret from environment variable
+    // Set jwtSecret from environment variable, it is only needed for HS256
     secret := os.Getenv("JWT_SECRET")
-    if secret == "" {
+    alg := os.Getenv("JWT_ALGORITHM")
+    if secret == "" && (alg == "" || alg == "HS256") {
         log.Fatalf("JWT_SECRET environment variable not set")
     }
     jwtSecret = []byte(secret)
@@ -133,63 +229,105 @@ func main() {
 	redisDB := config.ConnectRedis(cfg)
 	svc := service.NewService(db, redisDB)
 
-	pool := newPool()
-
-	rl := ratelimit.New(100) // per second
-
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		rl.Take()
-		HandleWebSocket(pool, w, r)
-	})
-	http.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
-		rl.Take()
-		HandleUser(w, r, svc)
-	})
-	http.HandleFunc("/online-users", func(w http.ResponseWriter, r *http.Request) {
-		rl.Take()
-		HandleGetAllActiveConn(pool, w, r, svc)
-	})
-	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		rl.Take()
-		HandleLogin(w, r, svc)
-	})
-	http.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
-		rl.Take()
-		HandleRefreshToken(w, r, svc)
-	})
-
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		healthCheckHandler(db, redisDB)
-	})
+	tokenIssuer = cfg.JWTConfig.Issuer
+	tokenAudience = cfg.JWTConfig.Audience
+	if cfg.JWTConfig.Algorithm != "HS256" {
+		signingKeys, err = newKeyRing(cfg.JWTConfig, svc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go signingKeys.run()
+	}
 
+	pool := newPool()
+	oidcProviders := newOIDCProviders(cfg.OIDCConfig)
+	probes := newHealth(db, redisDB)
+	mailer := thirdparty.NewMailer(cfg.MailConfig.SMTPAddr, cfg.MailConfig.From, cfg.MailConfig.Username, cfg.MailConfig.Password)
+	blobs, err := newBlobStore(cfg.UploadConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signer, err := newURLSigner(cfg.UploadConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go sweepUnsentUploads(svc, blobs, cfg.UploadConfig)
 
 	srv := &http.Server{
-		Addr:         ":8080",
+		Addr:         cfg.TLSConfig.HTTPAddr,
+		Handler:      newRouter(cfg, svc, pool, oidcProviders, mailer, blobs, signer, probes),
 		WriteTimeout: 10 * time.Second,
 		ReadTimeout:  10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
+	// With TLS enabled the app is served on HTTPSAddr and HTTPAddr only
+	// redirects to it
+	var redirectSrv *http.Server
+	if cfg.TLSConfig.Enabled() {
+		certs, err := newCertReloader(cfg.TLSConfig.CertFile, cfg.TLSConfig.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go certs.watch(cfg.TLSConfig.ReloadInterval)
+
+		srv.Addr = cfg.TLSConfig.HTTPSAddr
+		srv.TLSConfig = newTLSConfig(certs)
+
+		if cfg.TLSConfig.RedirectHTTP {
+			redirectSrv = &http.Server{
+				Addr:         cfg.TLSConfig.HTTPAddr,
+				Handler:      httpsRedirectHandler(cfg.TLSConfig.HTTPSAddr),
+				WriteTimeout: 10 * time.Second,
+				ReadTimeout:  10 * time.Second,
+			}
+		}
+	}
+
 	// Channel to listen for interrupt signals
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
 
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-sigs
 		log.Println("Received shutdown signal, shutting down gracefully.....")
 
+		// Report not-ready first so load balancers stop routing new traffic
+		probes.markShuttingDown()
+		time.Sleep(cfg.HTTPConfig.ShutdownDrainDelay)
+
 		// Create a context for shutdown
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
+		if redirectSrv != nil {
+			redirectSrv.Shutdown(ctx)
+		}
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Fatalf("Server forced to shutdown: %v", err)
 		}
 		log.Println("Server gracefully shutdown")
 	}()
 
-	log.Println("Starting server on :8080")
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if redirectSrv != nil {
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", redirectSrv.Addr)
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to listen and serve redirects: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("Starting server on %s (tls=%t)", srv.Addr, srv.TLSConfig != nil)
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to listen and serve: %v", err)
 	}
+	<-shutdownDone
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+)
+
+type messageListResponse struct {
+	Messages []service.Message `json:"messages"`
+	// NextBefore is passed as before to load older messages
+	NextBefore int64 `json:"next_before,omitempty"`
+}
+
+type messageHistoryResponse struct {
+	Message *service.Message      `json:"message"`
+	Edits   []service.MessageEdit `json:"edits"`
+}
+
+// pathMessageID parses the {id} path parameter of message routes
+func pathMessageID(r *http.Request) (int64, bool) {
+	messageID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return messageID, err == nil && messageID > 0
+}
+
+// writeMessageError maps message errors to HTTP statuses
+func writeMessageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, service.ErrNotMessageAuthor), errors.Is(err, service.ErrEditWindowExpired):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, service.ErrMessageDeleted):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, service.ErrTooManyReactions):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// decorateMessages fills in the reaction summaries, as seen by viewerID, and
+// the attachments of messages returned by the history APIs
+func decorateMessages(svc *service.Service, viewerID int, msgs []*service.Message) error {
+	ids := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	summaries, err := svc.GetReactionSummaries(ids, viewerID)
+	if err != nil {
+		return err
+	}
+	attachments, err := svc.GetMessageAttachments(ids)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		msg.Reactions = summaries[msg.ID]
+		msg.Attachments = attachments[msg.ID]
+	}
+	return nil
+}
+
+// HandleEditMessage is the REST equivalent of the edit frame
+func HandleEditMessage(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, cfg *config.MessageConfig) {
+	claims := claimsFromContext(r.Context())
+	messageID, ok := pathMessageID(r)
+	if !ok {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateMessageBody(cfg, req.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg, err := editMessage(pool, svc, cfg, claims.UserID(), messageID, req.Body)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// HandleDeleteMessage is the REST equivalent of the delete frame
+func HandleDeleteMessage(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, blobs thirdparty.BlobStore, cfg *config.MessageConfig) {
+	claims := claimsFromContext(r.Context())
+	messageID, ok := pathMessageID(r)
+	if !ok {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := deleteMessage(pool, svc, blobs, cfg, claims.UserID(), messageID); err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMessageHistory returns a message with its previous versions. Only the
+// members of its conversation can see it.
+func HandleMessageHistory(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	messageID, ok := pathMessageID(r)
+	if !ok {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := participantMessage(svc, claims.UserID(), messageID)
+	if err == nil && msg.DeletedAt != nil {
+		err = service.ErrMessageDeleted
+	}
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+
+	edits, err := svc.ListMessageEdits(messageID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messageHistoryResponse{Message: msg, Edits: edits})
+}
+
+// HandleListMessages returns the direct messages between the caller and the
+// user in with, or the messages of the conversation in conversation, newest
+// first, each with its reactions and attachments. Room messages from users
+// with a block with the caller are left out.
+func HandleListMessages(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	q := r.URL.Query()
+
+	var otherID int
+	var conversationID int64
+	var err error
+	switch {
+	case q.Has("with") && q.Has("conversation"):
+		http.Error(w, "Pass either with or conversation", http.StatusBadRequest)
+		return
+	case q.Has("conversation"):
+		if conversationID, err = strconv.ParseInt(q.Get("conversation"), 10, 64); err != nil || conversationID <= 0 {
+			http.Error(w, "Invalid conversation", http.StatusBadRequest)
+			return
+		}
+	default:
+		if otherID, err = strconv.Atoi(q.Get("with")); err != nil || otherID <= 0 {
+			http.Error(w, "Invalid with", http.StatusBadRequest)
+			return
+		}
+	}
+	var before int64
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before <= 0 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultMessagePageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxMessagePageSize)
+	}
+
+	blockedIDs, err := svc.BlockedEitherIDs(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := messageListResponse{Messages: []service.Message{}}
+	if conversationID != 0 || !slices.Contains(blockedIDs, otherID) {
+		// Fetch one extra message to know whether there are older ones
+		var messages []service.Message
+		if conversationID != 0 {
+			messages, err = svc.ListConversationMessages(claims.UserID(), conversationID, before, limit+1)
+		} else {
+			messages, err = svc.ListDirectMessages(claims.UserID(), otherID, before, limit+1)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(messages) > limit {
+			messages = messages[:limit]
+			response.NextBefore = messages[len(messages)-1].ID
+		}
+		for _, msg := range messages {
+			if !slices.Contains(blockedIDs, msg.SenderID) {
+				response.Messages = append(response.Messages, msg)
+			}
+		}
+	}
+
+	msgs := make([]*service.Message, len(response.Messages))
+	for i := range response.Messages {
+		msgs[i] = &response.Messages[i]
+	}
+	if err := decorateMessages(svc, claims.UserID(), msgs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleReaction is the REST equivalent of the react and unreact frames
+func HandleReaction(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service, cfg *config.MessageConfig, add bool) {
+	claims := claimsFromContext(r.Context())
+	messageID, ok := pathMessageID(r)
+	if !ok {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	emoji := r.PathValue("emoji")
+	if err := validateEmoji(emoji); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := reactToMessage(pool, svc, cfg, claims.UserID(), messageID, emoji, add); err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
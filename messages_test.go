@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+// messagesTest is a direct conversation 50 between users 7 and 8 holding
+// message 41 by user 7 sent a minute ago, 42 by user 7 sent two hours ago,
+// the tombstone 43 by user 7 and 44 by user 8. Edits and deletions change the
+// stored rows. Sequence numbers are handed out from 11 on.
+type messagesTest struct {
+	svc  *service.Service
+	db   *fakeDB
+	pool *Pool
+	cfg  *config.MessageConfig
+
+	mu   sync.Mutex
+	rows map[int64][]driver.Value
+}
+
+func newMessagesTest(t *testing.T) *messagesTest {
+	t.Helper()
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	mt := &messagesTest{
+		svc:  svc,
+		db:   db,
+		pool: newPool(),
+		cfg:  &config.MessageConfig{MaxLength: 100, EditWindow: time.Hour, MaxReactions: 2},
+		rows: map[int64][]driver.Value{},
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for id, m := range map[int64]struct {
+		senderID int64
+		body     string
+		sent     time.Time
+		deleted  driver.Value
+	}{
+		41: {7, "helo", now.Add(-time.Minute), nil},
+		42: {7, "old", now.Add(-2 * time.Hour), nil},
+		43: {7, "", now.Add(-time.Minute), now},
+		44: {8, "hi", now.Add(-time.Minute), nil},
+	} {
+		mt.rows[id] = []driver.Value{id, m.senderID, 15 - m.senderID, int64(50), id - 40, nil, m.body, m.sent, nil, m.deleted, nil, nil, int64(0), nil}
+	}
+
+	seq := int64(10)
+	db.onQuery("SELECT conversation_id FROM messages WHERE id = ?", func(args []driver.Value) [][]driver.Value {
+		if mt.row(args[0]) == nil {
+			return nil
+		}
+		return [][]driver.Value{{int64(50)}}
+	})
+	db.onQuery("SELECT last_seq FROM conversations", func([]driver.Value) [][]driver.Value {
+		mt.mu.Lock()
+		defer mt.mu.Unlock()
+		seq++
+		return [][]driver.Value{{seq}}
+	})
+	db.onQuery("SELECT id FROM messages WHERE id = ? FOR UPDATE", func(args []driver.Value) [][]driver.Value {
+		if mt.row(args[0]) == nil {
+			return nil
+		}
+		return [][]driver.Value{{args[0]}}
+	})
+	db.onQuery("FROM messages WHERE id = ?", func(args []driver.Value) [][]driver.Value {
+		if row := mt.row(args[0]); row != nil {
+			return [][]driver.Value{row}
+		}
+		return nil
+	})
+	db.onQuery("SELECT COUNT(msg.id)", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(0)}}
+	})
+	db.onQuery("FROM message_edits", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, e := range db.executed("INSERT INTO message_edits") {
+			if e.args[0] == args[0] {
+				rows = append(rows, []driver.Value{e.args[1], e.args[2]})
+			}
+		}
+		return rows
+	})
+	db.onExec("UPDATE messages SET body = ?, edited_at = ?", func(args []driver.Value) error {
+		mt.update(args[3], func(row []driver.Value) {
+			row[5], row[6], row[8] = args[2], args[0], args[1]
+		})
+		return nil
+	})
+	db.onExec("UPDATE messages SET body = '', deleted_at = ?", func(args []driver.Value) error {
+		mt.update(args[2], func(row []driver.Value) {
+			row[5], row[6], row[9] = args[1], "", args[0]
+		})
+		return nil
+	})
+	return mt
+}
+
+// row returns a copy of the stored row of a message, or nil
+func (mt *messagesTest) row(id driver.Value) []driver.Value {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if row, ok := mt.rows[id.(int64)]; ok {
+		return append([]driver.Value(nil), row...)
+	}
+	return nil
+}
+
+func (mt *messagesTest) update(id driver.Value, change func(row []driver.Value)) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	change(mt.rows[id.(int64)])
+}
+
+// call runs a message handler as userID with the message in the path
+func (mt *messagesTest) call(t *testing.T, handle func(http.ResponseWriter, *http.Request), userID int, messageID int64, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	id := strconv.FormatInt(messageID, 10)
+	req := withClaims(t, httptest.NewRequest(http.MethodPost, "/messages/"+id, strings.NewReader(body)), userID, "s1")
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	handle(rec, req)
+	return rec
+}
+
+// changedMessages returns the messages of the frames of type eventType a
+// user got so far
+func changedMessages(t *testing.T, pool *Pool, userID int, conn *websocket.Conn, eventType string) []service.Message {
+	t.Helper()
+	var msgs []service.Message
+	for _, frame := range receivedEvents(t, pool, userID, conn) {
+		var ev struct {
+			Type string          `json:"type"`
+			Data service.Message `json:"data"`
+		}
+		if err := json.Unmarshal(frame, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type == eventType {
+			msgs = append(msgs, ev.Data)
+		}
+	}
+	return msgs
+}
+
+func TestEditMessage(t *testing.T) {
+	mt := newMessagesTest(t)
+	conns := map[int]*websocket.Conn{7: connectClient(t, mt.pool, 7), 8: connectClient(t, mt.pool, 8)}
+
+	handleFrame(mt.pool, mt.svc, nil, mt.cfg, 7, []byte(`{"type":"edit","message_id":41,"body":"hello"}`))
+	for userID, conn := range conns {
+		msgs := changedMessages(t, mt.pool, userID, conn, eventMessageEdited)
+		if len(msgs) != 1 || msgs[0].ID != 41 || msgs[0].Body != "hello" || msgs[0].EditedAt == nil || msgs[0].ChangeSeq != 11 {
+			t.Errorf("user %d got edits %+v", userID, msgs)
+		}
+	}
+	if edits := mt.db.executed("INSERT INTO message_edits"); len(edits) != 1 || edits[0].args[0] != int64(41) || edits[0].args[1] != "helo" {
+		t.Fatalf("history = %v, want the previous body of 41", edits)
+	}
+
+	// The receiver sees the previous versions
+	rec := mt.call(t, func(w http.ResponseWriter, r *http.Request) { HandleMessageHistory(w, r, mt.svc) }, 8, 41, "")
+	var history messageHistoryResponse
+	if err := json.NewDecoder(rec.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if history.Message.Body != "hello" || len(history.Edits) != 1 || history.Edits[0].Body != "helo" {
+		t.Errorf("history = %+v", history)
+	}
+
+	edit := func(w http.ResponseWriter, r *http.Request) { HandleEditMessage(mt.pool, w, r, mt.svc, mt.cfg) }
+	for _, tt := range []struct {
+		name      string
+		userID    int
+		messageID int64
+		body      string
+		want      int
+	}{
+		{"edit by the receiver", 8, 41, `{"body":"mine now"}`, http.StatusForbidden},
+		{"edit after the window", 7, 42, `{"body":"too late"}`, http.StatusForbidden},
+		{"edit of a deleted message", 7, 43, `{"body":"back"}`, http.StatusGone},
+		{"edit of an unknown message", 7, 45, `{"body":"nobody"}`, http.StatusNotFound},
+		{"empty body", 7, 41, `{"body":""}`, http.StatusBadRequest},
+		{"body over the limit", 7, 41, `{"body":"` + strings.Repeat("x", 101) + `"}`, http.StatusBadRequest},
+	} {
+		if rec := mt.call(t, edit, tt.userID, tt.messageID, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if edits := mt.db.executed("INSERT INTO message_edits"); len(edits) != 1 {
+		t.Errorf("%d history entries after refused edits, want 1", len(edits))
+	}
+	if msgs := changedMessages(t, mt.pool, 8, conns[8], eventMessageEdited); len(msgs) != 0 {
+		t.Errorf("refused edits were pushed: %+v", msgs)
+	}
+
+	// A refused edit frame is answered with the reason
+	handleFrame(mt.pool, mt.svc, nil, mt.cfg, 8, []byte(`{"type":"edit","message_id":41,"body":"mine now"}`))
+	if frames := receivedEvents(t, mt.pool, 8, conns[8]); len(frames) != 1 || !bytes.Contains(frames[0], []byte(service.ErrNotMessageAuthor.Error())) {
+		t.Errorf("receiver got %s", frames)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	mt := newMessagesTest(t)
+	conns := map[int]*websocket.Conn{7: connectClient(t, mt.pool, 7), 8: connectClient(t, mt.pool, 8)}
+	blobs, err := thirdparty.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remove := func(w http.ResponseWriter, r *http.Request) {
+		HandleDeleteMessage(mt.pool, w, r, mt.svc, blobs, mt.cfg)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		userID    int
+		messageID int64
+		want      int
+	}{
+		{"deletion by the receiver", 8, 41, http.StatusForbidden},
+		{"deletion after the window", 7, 42, http.StatusForbidden},
+		{"deletion of a deleted message", 7, 43, http.StatusGone},
+		{"deletion of an unknown message", 7, 45, http.StatusNotFound},
+	} {
+		if rec := mt.call(t, remove, tt.userID, tt.messageID, ""); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if deletes := mt.db.executed("UPDATE messages SET body = ''"); len(deletes) != 0 {
+		t.Fatalf("%d messages deleted by refused requests", len(deletes))
+	}
+
+	if rec := mt.call(t, remove, 7, 41, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d", rec.Code)
+	}
+	for userID, conn := range conns {
+		msgs := changedMessages(t, mt.pool, userID, conn, eventMessageDeleted)
+		if len(msgs) != 1 || msgs[0].ID != 41 || msgs[0].Body != "" || msgs[0].DeletedAt == nil || msgs[0].ChangeSeq == 0 {
+			t.Errorf("user %d got deletions %+v", userID, msgs)
+		}
+	}
+	// The history goes with the message
+	for _, query := range []string{"DELETE FROM message_edits", "DELETE FROM message_reactions", "DELETE FROM attachments"} {
+		if execs := mt.db.executed(query); len(execs) != 1 || execs[0].args[0] != int64(41) {
+			t.Errorf("%s: %v", query, execs)
+		}
+	}
+	rec := mt.call(t, func(w http.ResponseWriter, r *http.Request) { HandleMessageHistory(w, r, mt.svc) }, 8, 41, "")
+	if rec.Code != http.StatusGone {
+		t.Errorf("history of a deleted message: status %d, want 410", rec.Code)
+	}
+	if rec := mt.call(t, remove, 7, 41, ""); rec.Code != http.StatusGone {
+		t.Errorf("second deletion: status %d, want 410", rec.Code)
+	}
+}
+
+func TestReactionCap(t *testing.T) {
+	mt := newMessagesTest(t)
+	conns := map[int]*websocket.Conn{7: connectClient(t, mt.pool, 7), 8: connectClient(t, mt.pool, 8)}
+	// reactions holds user:emoji entries of message 41 in the order they were added
+	var reactions []string
+	mt.db.onQuery("COUNT(DISTINCT emoji)", func(args []driver.Value) [][]driver.Value {
+		distinct, present := map[string]bool{}, 0
+		for _, r := range reactions {
+			emoji := r[strings.Index(r, ":")+1:]
+			distinct[emoji] = true
+			if emoji == args[0] {
+				present++
+			}
+		}
+		return [][]driver.Value{{int64(len(distinct)), int64(present)}}
+	})
+	mt.db.onQuery("FROM message_reactions", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		index := map[string]int{}
+		for _, r := range reactions {
+			userID, emoji, _ := strings.Cut(r, ":")
+			i, ok := index[emoji]
+			if !ok {
+				i = len(rows)
+				index[emoji] = i
+				rows = append(rows, []driver.Value{int64(41), emoji, int64(0), false})
+			}
+			rows[i][2] = rows[i][2].(int64) + 1
+			if userID == strconv.FormatInt(args[0].(int64), 10) {
+				rows[i][3] = true
+			}
+		}
+		return rows
+	})
+	mt.db.onExec("INSERT IGNORE INTO message_reactions", func(args []driver.Value) error {
+		r := strconv.FormatInt(args[1].(int64), 10) + ":" + args[2].(string)
+		if slices.Contains(reactions, r) {
+			return errNoRowsAffected
+		}
+		reactions = append(reactions, r)
+		return nil
+	})
+	mt.db.onExec("DELETE FROM message_reactions WHERE message_id = ? AND user_id = ?", func(args []driver.Value) error {
+		r := strconv.FormatInt(args[1].(int64), 10) + ":" + args[2].(string)
+		i := slices.Index(reactions, r)
+		if i < 0 {
+			return errNoRowsAffected
+		}
+		reactions = slices.Delete(reactions, i, i+1)
+		return nil
+	})
+
+	react := func(userID int, frameType, emoji string) {
+		t.Helper()
+		handleFrame(mt.pool, mt.svc, nil, mt.cfg, userID, []byte(`{"type":"`+frameType+`","message_id":41,"emoji":"`+emoji+`"}`))
+	}
+	received := func(userID int) []reactionEvent {
+		t.Helper()
+		var events []reactionEvent
+		for _, frame := range receivedEvents(t, mt.pool, userID, conns[userID]) {
+			var ev struct {
+				Type string        `json:"type"`
+				Data reactionEvent `json:"data"`
+			}
+			if err := json.Unmarshal(frame, &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Type != eventReaction {
+				t.Errorf("user %d got %s", userID, frame)
+				continue
+			}
+			events = append(events, ev.Data)
+		}
+		return events
+	}
+
+	react(8, frameReact, "👍")
+	react(7, frameReact, "❤️")
+	for userID := range conns {
+		events := received(userID)
+		if len(events) != 2 || events[0].Seq != 11 || events[1].Seq != 12 || events[1].ConversationID != 50 {
+			t.Fatalf("user %d got %+v", userID, events)
+		}
+		if got := events[1].Reactions; len(got) != 2 || got[0] != (service.ReactionSummary{Emoji: "👍", Count: 1}) || got[1] != (service.ReactionSummary{Emoji: "❤️", Count: 1}) {
+			t.Errorf("user %d got summary %+v", userID, got)
+		}
+	}
+
+	// A third emoji is over the cap, for frames and REST alike
+	handleFrame(mt.pool, mt.svc, nil, mt.cfg, 8, []byte(`{"type":"react","message_id":41,"emoji":"🎉"}`))
+	if frames := receivedEvents(t, mt.pool, 8, conns[8]); len(frames) != 1 || !bytes.Contains(frames[0], []byte(service.ErrTooManyReactions.Error())) {
+		t.Errorf("reaction over the cap answered with %s", frames)
+	}
+	req := withClaims(t, httptest.NewRequest(http.MethodPut, "/messages/41/reactions/🎉", nil), 8, "s1")
+	req.SetPathValue("id", "41")
+	req.SetPathValue("emoji", "🎉")
+	rec := httptest.NewRecorder()
+	HandleReaction(mt.pool, rec, req, mt.svc, mt.cfg, true)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("REST reaction over the cap: status %d, want 409", rec.Code)
+	}
+	if events := received(7); len(events) != 0 {
+		t.Errorf("refused reactions were pushed: %+v", events)
+	}
+
+	// Emoji already on the message can still be added
+	react(7, frameReact, "👍")
+	if events := received(8); len(events) != 1 || events[0].Reactions[0].Count != 2 {
+		t.Errorf("second 👍: %+v", events)
+	}
+	// Repeating a reaction changes nothing
+	react(7, frameReact, "👍")
+	if events := received(8); len(events) != 1 || events[0].Seq != 0 {
+		t.Errorf("repeated reaction: %+v", events)
+	}
+
+	// Removing the only ❤️ frees a slot
+	react(7, frameUnreact, "❤️")
+	react(8, frameReact, "🎉")
+	if events := received(8); len(events) != 2 || len(events[1].Reactions) != 2 || events[1].Reactions[1].Emoji != "🎉" {
+		t.Errorf("reaction after freeing a slot: %+v", events)
+	}
+
+	// The history API marks the viewer's own reactions
+	msgs := []*service.Message{{ID: 41}}
+	if err := decorateMessages(mt.svc, 7, msgs); err != nil {
+		t.Fatal(err)
+	}
+	want := []service.ReactionSummary{{Emoji: "👍", Count: 2, Reacted: true}, {Emoji: "🎉", Count: 1}}
+	if !slices.Equal(msgs[0].Reactions, want) {
+		t.Errorf("reactions seen by user 7 = %+v, want %+v", msgs[0].Reactions, want)
+	}
+
+	received(7)
+	handleFrame(mt.pool, mt.svc, nil, mt.cfg, 7, []byte(`{"type":"react","message_id":43,"emoji":"👍"}`))
+	if frames := receivedEvents(t, mt.pool, 7, conns[7]); len(frames) != 1 || !bytes.Contains(frames[0], []byte(service.ErrMessageDeleted.Error())) {
+		t.Errorf("reaction to a deleted message answered with %s", frames)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	utils "github.com/gitnoober/chat-go/utils"
+)
+
+const (
+	recoveryCodeCount = 10
+	totpSkew          = 1
+	mfaFailPrefix     = "login:fail:mfa:"
+	mfaLockPrefix     = "login:lock:mfa:"
+	mfaUsedStepPrefix = "mfa:used:"
+)
+
+// HandleMFAEnroll generates a new TOTP secret for the caller. The secret stays
+// pending until it is confirmed through HandleMFAVerify.
+func HandleMFAEnroll(w http.ResponseWriter, r *http.Request, svc *service.Service, cfg *config.MFAConfig) {
+	claims := claimsFromContext(r.Context())
+	userID := claims.UserID()
+
+	mfa, err := svc.GetMFA(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mfa != nil && mfa.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	user, err := svc.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := svc.SetPendingMFASecret(userID, secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{
+		"secret":           secret,
+		"provisioning_uri": utils.TOTPProvisioningURI(cfg.Issuer, user.Email, secret),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleMFAVerify confirms a pending secret with a code from the authenticator
+// app, enables two-factor authentication and returns the recovery codes once.
+func HandleMFAVerify(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	userID := claims.UserID()
+
+	code := r.FormValue("code")
+	if code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+
+	mfa, err := svc.GetMFA(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mfa == nil {
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusBadRequest)
+		return
+	}
+	if mfa.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if _, ok := utils.ValidateTOTP(mfa.Secret, code, time.Now(), totpSkew); !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, c := range codes {
+		hashes = append(hashes, utils.GenerateSHA256Hash(c))
+	}
+	if err := svc.EnableMFA(userID, hashes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[security] mfa enabled: user=%d", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// HandleLoginMFA is the second login step. It only accepts the mfa_pending token
+// from HandleLogin together with a TOTP code or an unused recovery code.
+func HandleLoginMFA(w http.ResponseWriter, r *http.Request, svc *service.Service, cfg *config.LockoutConfig) {
+	claims, err := validateMFAPendingToken(r.FormValue("mfa_token"))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID := claims.UserID()
+
+	code := r.FormValue("code")
+	recoveryCode := strings.ToLower(strings.TrimSpace(r.FormValue("recovery_code")))
+	if code == "" && recoveryCode == "" {
+		http.Error(w, "Code or recovery code is required", http.StatusBadRequest)
+		return
+	}
+
+	failKey := fmt.Sprintf("%s%d", mfaFailPrefix, userID)
+	lockKey := fmt.Sprintf("%s%d", mfaLockPrefix, userID)
+	locked, err := svc.GetRedisTTL(lockKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if locked > 0 {
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	mfa, err := svc.GetMFA(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mfa == nil || !mfa.Enabled {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var ok bool
+	if code != "" {
+		var step int64
+		step, ok = utils.ValidateTOTP(mfa.Secret, code, time.Now(), totpSkew)
+		if ok {
+			// Each code may only be used once, even within its validity window
+			usedKey := fmt.Sprintf("%s%d:%d", mfaUsedStepPrefix, userID, step)
+			ok, err = svc.SetRedisDataNX(usedKey, "1", time.Duration(2*totpSkew+1)*30*time.Second)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	} else {
+		ok, err = svc.UseRecoveryCode(userID, utils.GenerateSHA256Hash(recoveryCode))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			log.Printf("[security] recovery code used: user=%d ip=%s", userID, clientIP(r))
+		}
+	}
+
+	if !ok {
+		failures, err := svc.IncrRedisCounter(failKey, cfg.Window)
+		if err != nil {
+			log.Printf("Error recording mfa failure: %v", err)
+		} else if failures >= int64(cfg.MaxAccountAttempts) {
+			lock := lockoutDuration(cfg, failures, int64(cfg.MaxAccountAttempts))
+			if err := svc.SetRedisData(lockKey, "1", lock); err != nil {
+				log.Printf("Error locking mfa: %v", err)
+			} else {
+				log.Printf("[security] mfa locked: user=%d ip=%s failures=%d duration=%v", userID, clientIP(r), failures, lock)
+			}
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err := svc.DeleteRedisData(failKey); err != nil {
+		log.Printf("Error resetting mfa failures: %v", err)
+	}
+
+	issueTokens(w, r, userID, svc)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"database/sql/driver"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// currentTOTP computes the code of a base32 secret for the current time step
+func currentTOTP(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestHandleLoginMFA(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	db.onQuery("FROM user_mfa", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(7), secret, true}}
+	})
+	db.onQuery("FROM users WHERE id = ?", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(7), "ada@example.com", "", "Ada", "", "", "user", false, "everyone", "everyone"}}
+	})
+	cfg := testLockoutConfig()
+
+	mfaToken, err := generateMFAPendingToken(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(token, code string) int {
+		form := url.Values{"mfa_token": {token}, "code": {code}}
+		req := httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		HandleLoginMFA(rec, req, svc, cfg)
+		return rec.Code
+	}
+
+	// Only the mfa_pending token is accepted
+	access, err := generateToken(7, "s1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := currentTOTP(t, secret)
+	if status := login(access, code); status != http.StatusUnauthorized {
+		t.Errorf("login with an access token: status %d, want 401", status)
+	}
+
+	if status := login(mfaToken, code); status != http.StatusOK {
+		t.Fatalf("login with a valid code: status %d, want 200", status)
+	}
+	// A code works once, even within its validity window
+	if status := login(mfaToken, code); status != http.StatusUnauthorized {
+		t.Errorf("replayed code: status %d, want 401", status)
+	}
+
+	// Wrong codes lock the second step out, counting the replay
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 1; i < cfg.MaxAccountAttempts; i++ {
+		login(mfaToken, wrong)
+	}
+	if status := login(mfaToken, currentTOTP(t, secret)); status != http.StatusTooManyRequests {
+		t.Errorf("login after %d failures: status %d, want 429", cfg.MaxAccountAttempts, status)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/ratelimit"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	claimsKey
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// middleware wraps a handler with extra behaviour
+type middleware func(http.Handler) http.Handler
+
+// chain applies middlewares so that the first one listed runs first
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// requestIDFromContext returns the ID assigned by withRequestID
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// claimsFromContext returns the caller identity stored by requireAuth
+func claimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey).(*Claims)
+	return claims
+}
+
+// withRequestID tags every request with an ID, reusing the caller's X-Request-ID if present
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// withRecovery turns a panicking handler into a 500 instead of a dropped connection
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("Panic serving %s %s [%s]: %v\n%s", r.Method, r.URL.Path, requestIDFromContext(r.Context()), err, debug.Stack())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder captures the status and size of a response for the access log.
+// It passes hijacking through so WebSocket upgrades keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// withAccessLog logs one line per request. Only the path is logged, never the
+// query string, since it may carry credentials.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("%s %s %d %dB %v ip=%s id=%s", r.Method, r.URL.Path, rec.status, rec.bytes, time.Since(start), clientIP(r), requestIDFromContext(r.Context()))
+	})
+}
+
+// withCORS answers preflight requests and sets CORS headers for allowed origins
+func withCORS(cfg *config.HTTPConfig) middleware {
+	allowAny := slices.Contains(cfg.AllowedOrigins, "*")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || (!allowAny && !slices.Contains(cfg.AllowedOrigins, origin)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			h.Set("Access-Control-Expose-Headers", requestIDHeader)
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+				h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+requestIDHeader)
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withRateLimit blocks until the shared limiter lets the request through
+func withRateLimit(rl ratelimit.Limiter) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rl.Take()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bearerToken reads the access token from an "Authorization: Bearer <token>"
+// header. A bare token without the scheme is still accepted for older clients.
+func bearerToken(r *http.Request) string {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return auth
+}
+
+// authenticate validates the access token found by tokenFrom, checks that its
+// session is still live and stores the claims in the request context
+func authenticate(svc *service.Service, tokenFrom func(*http.Request) string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := validateAccessToken(tokenFrom(r))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chat-go"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			active, err := sessionActive(svc, claims)
+			if err != nil {
+				log.Printf("Error checking session: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if !active {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chat-go", error="invalid_token"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+		})
+	}
+}
+
+// sessionActive reports whether the session of a token was not revoked and its
+// user is not disabled or deleted and still has the role of the token. Access
+// tokens outlive a revocation or demotion, so this is checked on every
+// request. Both lookups are served from Redis: sessions live there and the
+// user comes from the cached profile, which is invalidated when the account is
+// disabled or deleted.
+func sessionActive(svc *service.Service, claims *Claims) (bool, error) {
+	if claims.SessionID == "" {
+		return false, nil
+	}
+	session, err := svc.GetSession(claims.SessionID)
+	if err != nil {
+		return false, err
+	}
+	if session == nil || session.UserID != claims.UserID() {
+		return false, nil
+	}
+	user, err := svc.GetUserProfile(claims.UserID())
+	if errors.Is(err, service.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !user.Disabled && user.Role == claims.Role, nil
+}
+
+// requireAuth authenticates the caller with the bearer token in the Authorization header
+func requireAuth(svc *service.Service) middleware {
+	return authenticate(svc, bearerToken)
+}
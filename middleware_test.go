@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+)
+
+func TestAuthenticateChecksSession(t *testing.T) {
+	db := newFakeDB()
+	svc, rdb := newTestService(t, db)
+	// User 7 is enabled, user 8 disabled, user 9 deleted and user 10 an admin
+	db.onQuery("FROM users WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, id := range args {
+			switch id {
+			case int64(7):
+				rows = append(rows, []driver.Value{id, "ada@example.com", "Ada", "", "", "user", false, "everyone", "everyone"})
+			case int64(8):
+				rows = append(rows, []driver.Value{id, "bob@example.com", "Bob", "", "", "user", true, "everyone", "everyone"})
+			case int64(10):
+				rows = append(rows, []driver.Value{id, "cy@example.com", "Cy", "", "", "admin", false, "everyone", "everyone"})
+			}
+		}
+		return rows
+	})
+	for userID, sessionID := range map[int]string{7: "live", 8: "disabled", 9: "deleted", 10: "admin"} {
+		session := service.Session{ID: sessionID, UserID: userID, CreatedAt: time.Now()}
+		if err := svc.CreateSession(session, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := requireAuth(svc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(claimsFromContext(r.Context()).UserID())
+	}))
+	call := func(userID int, sessionID, role string) int {
+		token, err := generateToken(userID, sessionID, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/user", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name      string
+		userID    int
+		sessionID string
+		role      string
+		want      int
+	}{
+		{"live session", 7, "live", "user", http.StatusOK},
+		{"revoked session", 7, "revoked", "user", http.StatusUnauthorized},
+		{"no session", 7, "", "user", http.StatusUnauthorized},
+		{"session of another user", 9, "live", "user", http.StatusUnauthorized},
+		{"disabled user", 8, "disabled", "user", http.StatusUnauthorized},
+		{"deleted user", 9, "deleted", "user", http.StatusUnauthorized},
+		{"admin", 10, "admin", "admin", http.StatusOK},
+		{"demoted admin", 7, "live", "admin", http.StatusUnauthorized},
+		{"promoted user", 10, "admin", "user", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := call(tt.userID, tt.sessionID, tt.role); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Revoking the live session locks its access token out right away
+	if err := svc.DeleteSession(7, "live"); err != nil {
+		t.Fatal(err)
+	}
+	if got := call(7, "live", "user"); got != http.StatusUnauthorized {
+		t.Errorf("after revocation: status = %d, want 401", got)
+	}
+	if _, ok := rdb.get("session:live"); ok {
+		t.Errorf("session still stored after revocation")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for header, want := range map[string]string{
+		"Bearer abc":   "abc",
+		"bearer  abc ": "abc",
+		"abc":          "abc",
+		"":             "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/user", nil)
+		r.Header.Set("Authorization", header)
+		if got := bearerToken(r); got != want {
+			t.Errorf("bearerToken(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestRequestIDAndRecovery(t *testing.T) {
+	var seen string
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+	}), withRequestID, withRecovery)
+
+	for _, tt := range []struct {
+		given string
+		reuse bool
+	}{
+		{"client-id", true},
+		{"", false},
+		{strings.Repeat("x", 65), false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(requestIDHeader, tt.given)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		got := w.Header().Get(requestIDHeader)
+		if got == "" || got != seen || (got == tt.given) != tt.reuse {
+			t.Errorf("request id for %q = %q (context %q)", tt.given, got, seen)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Code != http.StatusInternalServerError || w.Header().Get(requestIDHeader) == "" {
+		t.Errorf("panicking handler: status %d, request id %q", w.Code, w.Header().Get(requestIDHeader))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	db.onQuery("FROM users WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], "ada@example.com", "Ada", "", "", "user", false, "everyone", "everyone"}}
+	})
+	if err := svc.CreateSession(service.Session{ID: "s1", UserID: 7}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.LoadConfig()
+	cfg.HTTPConfig.AllowedOrigins = []string{"https://app.example.com"}
+	router := newRouter(cfg, svc, newPool(), nil, nil, nil, nil, nil)
+	token, err := generateToken(7, "s1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	bearer := http.Header{"Authorization": {"Bearer " + token}}
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		want   int
+	}{
+		{"no token", http.MethodGet, "/sessions", nil, http.StatusUnauthorized},
+		{"token", http.MethodGet, "/sessions", bearer, http.StatusOK},
+		{"wrong method", http.MethodPut, "/sessions", bearer, http.StatusMethodNotAllowed},
+		{"unknown path", http.MethodGet, "/nowhere", bearer, http.StatusNotFound},
+		{"missing permission", http.MethodGet, "/admin/users", bearer, http.StatusForbidden},
+	} {
+		w := serve(tt.method, tt.path, tt.header)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, w.Code, tt.want)
+		}
+		if w.Header().Get(requestIDHeader) == "" {
+			t.Errorf("%s: no request id", tt.name)
+		}
+	}
+	if w := serve(http.MethodGet, "/sessions", nil); w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+
+	// Preflights are answered for allowed origins only
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		return serve(http.MethodOptions, "/sessions", http.Header{"Origin": {origin}, "Access-Control-Request-Method": {"GET"}})
+	}
+	if w := preflight("https://app.example.com"); w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("allowed preflight: status %d, headers %v", w.Code, w.Header())
+	}
+	if w := preflight("https://evil.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight of another origin allowed: %v", w.Header())
+	}
+}
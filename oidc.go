@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+const (
+	oidcStatePrefix = "oidc:state:"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// oidcState is what we remember between redirecting to the provider and its
+// callback. LinkUserID is set when a signed in user links the identity.
+type oidcState struct {
+	Provider     string `json:"provider"`
+	CodeVerifier string `json:"code_verifier"`
+	Nonce        string `json:"nonce"`
+	LinkUserID   int    `json:"link_user_id,omitempty"`
+}
+
+var (
+	errUnverifiedEmail     = errors.New("identity provider did not return a verified email")
+	errAccountExists       = errors.New("an account with this email already exists, sign in and link the provider from your account")
+	errProviderUnavailable = errors.New("identity provider unavailable")
+)
+
+func newOIDCProviders(cfgs []*config.OIDCProviderConfig) map[string]*thirdparty.OIDCProvider {
+	providers := make(map[string]*thirdparty.OIDCProvider, len(cfgs))
+	for _, c := range cfgs {
+		provider := thirdparty.NewOIDCProvider(c.Name, c.Issuer, c.ClientID, c.ClientSecret, c.RedirectURL, c.Scopes)
+		provider.LinkByEmail = c.LinkByEmail
+		providers[c.Name] = provider
+	}
+	return providers
+}
+
+// oidcAuthURL stores a new single use state and returns the provider URL the
+// user signs in at
+func oidcAuthURL(ctx context.Context, svc *service.Service, provider *thirdparty.OIDCProvider, linkUserID int) (string, error) {
+	state, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	verifier, challenge, err := thirdparty.NewPKCEVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(oidcState{Provider: provider.Name, CodeVerifier: verifier, Nonce: nonce, LinkUserID: linkUserID})
+	if err != nil {
+		return "", err
+	}
+	if err := svc.SetRedisData(oidcStatePrefix+state, string(data), oidcStateTTL); err != nil {
+		return "", err
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, challenge)
+	if err != nil {
+		log.Printf("OIDC start error: %v", err)
+		return "", errProviderUnavailable
+	}
+	return authURL, nil
+}
+
+// HandleOIDCStart redirects the user to their identity provider
+func HandleOIDCStart(w http.ResponseWriter, r *http.Request, svc *service.Service, providers map[string]*thirdparty.OIDCProvider) {
+	provider, ok := providers[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	authURL, err := oidcAuthURL(r.Context(), svc, provider, 0)
+	if err != nil {
+		if errors.Is(err, errProviderUnavailable) {
+			http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// HandleOIDCLink starts linking an identity of the provider to the signed in
+// caller after re-authenticating them. It returns the URL to sign in at
+// since the request carries a bearer token and cannot be a plain redirect.
+func HandleOIDCLink(w http.ResponseWriter, r *http.Request, svc *service.Service, providers map[string]*thirdparty.OIDCProvider, cfg *config.AccountConfig) {
+	claims := claimsFromContext(r.Context())
+	provider, ok := providers[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !reauthenticate(w, svc, claims, req.CurrentPassword, cfg) {
+		return
+	}
+
+	authURL, err := oidcAuthURL(r.Context(), svc, provider, claims.UserID())
+	if err != nil {
+		if errors.Is(err, errProviderUnavailable) {
+			http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"auth_url": authURL})
+}
+
+// HandleOIDCCallback completes the authorization code flow and logs in the
+// user the external identity belongs to. When the flow was started by
+// HandleOIDCLink the identity is linked to that user instead.
+func HandleOIDCCallback(w http.ResponseWriter, r *http.Request, svc *service.Service, providers map[string]*thirdparty.OIDCProvider, mfaCfg *config.MFAConfig) {
+	provider, ok := providers[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		http.Error(w, "Sign in failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	// The state is single use, a replayed callback finds nothing
+	raw, err := svc.GetRedisDataAndDelete(oidcStatePrefix + r.URL.Query().Get("state"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var state oidcState
+	if raw == "" || json.Unmarshal([]byte(raw), &state) != nil || state.Provider != provider.Name {
+		http.Error(w, "Invalid or expired state", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	identity, err := provider.Exchange(ctx, r.URL.Query().Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("[security] oidc login failed: provider=%s ip=%s err=%v", provider.Name, clientIP(r), err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if state.LinkUserID != 0 {
+		linkOIDCIdentity(w, svc, provider.Name, identity, state.LinkUserID)
+		return
+	}
+
+	userID, err := resolveOIDCUser(svc, provider, identity)
+	if err != nil {
+		if errors.Is(err, errUnverifiedEmail) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errAccountExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	completeLogin(w, r, userID, svc, mfaCfg)
+}
+
+// linkOIDCIdentity links an identity to the user who started the link flow
+func linkOIDCIdentity(w http.ResponseWriter, svc *service.Service, provider string, identity *thirdparty.OIDCIdentity, userID int) {
+	linkedID, err := svc.GetUserIDByIdentity(provider, identity.Subject)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if linkedID != 0 && linkedID != userID {
+		http.Error(w, "Identity is linked to another account", http.StatusConflict)
+		return
+	}
+	if linkedID == 0 {
+		if err := svc.LinkIdentity(provider, identity.Subject, userID, identity.Email); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[security] identity linked: provider=%s user=%d", provider, userID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resolveOIDCUser finds the user linked to an identity. An unlinked identity
+// with a verified email gets a new user. If the email belongs to an existing
+// account the identity has to be linked explicitly, unless the provider is
+// trusted to link by email and the account does not use MFA.
+func resolveOIDCUser(svc *service.Service, provider *thirdparty.OIDCProvider, identity *thirdparty.OIDCIdentity) (int, error) {
+	userID, err := svc.GetUserIDByIdentity(provider.Name, identity.Subject)
+	if err != nil || userID != 0 {
+		return userID, err
+	}
+	if identity.Email == "" || !identity.EmailVerified {
+		return 0, errUnverifiedEmail
+	}
+
+	userID, err = svc.GetUserByEmail(identity.Email)
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		userID, err = createOIDCUser(svc, identity)
+	case err == nil:
+		err = checkLinkByEmail(svc, provider, userID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := svc.LinkIdentity(provider.Name, identity.Subject, userID, identity.Email); err != nil {
+		return 0, err
+	}
+	log.Printf("[security] identity linked: provider=%s user=%d", provider.Name, userID)
+	return userID, nil
+}
+
+// checkLinkByEmail decides whether an identity may sign in to the existing
+// account with its email. A matching email alone would let anyone who controls
+// the address at the provider take over the account.
+func checkLinkByEmail(svc *service.Service, provider *thirdparty.OIDCProvider, userID int) error {
+	if !provider.LinkByEmail {
+		return errAccountExists
+	}
+	mfa, err := svc.GetMFA(userID)
+	if err != nil {
+		return err
+	}
+	if mfa != nil && mfa.Enabled {
+		return errAccountExists
+	}
+	return nil
+}
+
+// createOIDCUser creates a local user for an identity. It has no password, so
+// it can only sign in through the provider until the user sets one.
+func createOIDCUser(svc *service.Service, identity *thirdparty.OIDCIdentity) (int, error) {
+	name := identity.Name
+	if name == "" {
+		name = identity.Email
+	}
+	user := service.User{
+		Email:      identity.Email,
+		Name:       name,
+		ProfileURL: thirdparty.GetRandomProfilePicture(identity.Email),
+	}
+	if err := svc.CreateUser(user); err != nil {
+		return 0, err
+	}
+	return svc.GetUserByEmail(identity.Email)
+}
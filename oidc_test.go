@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	oidcTestClientID = "chat-go"
+	oidcTestCode     = "auth-code"
+	oidcTestEmail    = "ada@example.com"
+	oidcTestPassword = "correct horse"
+)
+
+// fakeIdP serves discovery, JWKS and token endpoints. The token endpoint
+// checks the PKCE verifier against the challenge of the last authorization
+// request and answers with claims signed by idToken.
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu        sync.Mutex
+	challenge string
+	claims    jwt.MapClaims
+	idToken   func(claims jwt.MapClaims) string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{t: t, key: key, kid: "key-1"}
+	idp.idToken = func(claims jwt.MapClaims) string { return idp.sign(claims, idp.key, idp.kid) }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": idp.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != oidcTestCode || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(idp.claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) sign(claims jwt.MapClaims, key *rsa.PrivateKey, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed
+}
+
+func (idp *fakeIdP) provider() *thirdparty.OIDCProvider {
+	return thirdparty.NewOIDCProvider("test", idp.server.URL, oidcTestClientID, "", "https://chat.example.com/auth/test/callback", []string{"openid", "email"})
+}
+
+// authorized records the authorization request the user was redirected to,
+// prepares valid claims for it and returns its state
+func (idp *fakeIdP) authorized(t *testing.T, authURL string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, idp.server.URL+"/authorize") {
+		t.Fatalf("unexpected auth URL %q", authURL)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.challenge = u.Query().Get("code_challenge")
+	idp.claims = jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            oidcTestClientID,
+		"sub":            "subject-1",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          u.Query().Get("nonce"),
+		"email":          oidcTestEmail,
+		"email_verified": true,
+		"name":           "Ada",
+	}
+	return u.Query().Get("state")
+}
+
+// oidcTest wires the OIDC handlers to a fake IdP, database and Redis. The
+// database knows user 7 with oidcTestEmail and oidcTestPassword.
+type oidcTest struct {
+	t         *testing.T
+	idp       *fakeIdP
+	db        *fakeDB
+	svc       *service.Service
+	rdb       *fakeRedis
+	provider  *thirdparty.OIDCProvider
+	providers map[string]*thirdparty.OIDCProvider
+	// passwordHash is user 7's password, empty for an account without one
+	passwordHash string
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	idp := newFakeIdP(t)
+	db := newFakeDB()
+	svc, rdb := newTestService(t, db)
+	provider := idp.provider()
+	ot := &oidcTest{
+		t:         t,
+		idp:       idp,
+		db:        db,
+		svc:       svc,
+		rdb:       rdb,
+		provider:  provider,
+		providers: map[string]*thirdparty.OIDCProvider{"test": provider},
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(oidcTestPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot.passwordHash = string(hash)
+	db.onQuery("FROM users WHERE id = ?", func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], oidcTestEmail, ot.passwordHash, "Ada", "", "", "user", false, "everyone", "everyone"}}
+	})
+	return ot
+}
+
+// existingUser makes oidcTestEmail belong to user 7
+func (ot *oidcTest) existingUser() {
+	ot.db.onQuery("SELECT id FROM users WHERE email = ?", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(7)}}
+	})
+}
+
+// linkedTo links the IdP subject to a user
+func (ot *oidcTest) linkedTo(userID int) {
+	ot.db.onQuery("FROM user_identities", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(userID)}}
+	})
+}
+
+// start begins a login and returns its state
+func (ot *oidcTest) start() string {
+	ot.t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/auth/test/start", nil)
+	r.SetPathValue("provider", "test")
+	w := httptest.NewRecorder()
+	HandleOIDCStart(w, r, ot.svc, ot.providers)
+	if w.Code != http.StatusFound {
+		ot.t.Fatalf("start status = %d: %s", w.Code, w.Body)
+	}
+	return ot.idp.authorized(ot.t, w.Header().Get("Location"))
+}
+
+// link begins linking the provider to a signed in user and returns the state
+func (ot *oidcTest) link(userID int, password string) (string, *httptest.ResponseRecorder) {
+	ot.t.Helper()
+	body := strings.NewReader(`{"current_password":"` + password + `"}`)
+	r := withClaims(ot.t, httptest.NewRequest(http.MethodPost, "/user/identities/test", body), userID, "session-1")
+	r.SetPathValue("provider", "test")
+	w := httptest.NewRecorder()
+	HandleOIDCLink(w, r, ot.svc, ot.providers, &config.AccountConfig{ReauthWindow: 10 * time.Minute})
+	if w.Code != http.StatusOK {
+		return "", w
+	}
+	var resp struct {
+		AuthURL string `json:"auth_url"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		ot.t.Fatal(err)
+	}
+	return ot.idp.authorized(ot.t, resp.AuthURL), w
+}
+
+// callback returns from the provider with the state and code
+func (ot *oidcTest) callback(provider, state, code string) *httptest.ResponseRecorder {
+	ot.t.Helper()
+	q := url.Values{"state": {state}, "code": {code}}
+	r := httptest.NewRequest(http.MethodGet, "/auth/"+provider+"/callback?"+q.Encode(), nil)
+	r.SetPathValue("provider", provider)
+	w := httptest.NewRecorder()
+	HandleOIDCCallback(w, r, ot.svc, ot.providers, &config.MFAConfig{PendingTTL: time.Minute})
+	return w
+}
+
+// loggedIn checks that a callback issued a token pair for the user
+func (ot *oidcTest) loggedIn(w *httptest.ResponseRecorder, userID int) {
+	ot.t.Helper()
+	if w.Code != http.StatusOK {
+		ot.t.Fatalf("callback status = %d: %s", w.Code, w.Body)
+	}
+	var tokens map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+		ot.t.Fatal(err)
+	}
+	claims, err := validateAccessToken(tokens["access_token"])
+	if err != nil {
+		ot.t.Fatalf("invalid access token: %v", err)
+	}
+	if claims.UserID() != userID {
+		ot.t.Fatalf("logged in as user %d, want %d", claims.UserID(), userID)
+	}
+}
+
+// links returns the user IDs identities were linked to
+func (ot *oidcTest) links() []driver.Value {
+	var userIDs []driver.Value
+	for _, e := range ot.db.executed("INSERT INTO user_identities") {
+		userIDs = append(userIDs, e.args[2])
+	}
+	return userIDs
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	ot := newOIDCTest(t)
+	ot.linkedTo(7)
+
+	if w := ot.callback("other", ot.start(), oidcTestCode); w.Code != http.StatusNotFound {
+		t.Errorf("unknown provider status = %d, want 404", w.Code)
+	}
+	if w := ot.callback("test", "", oidcTestCode); w.Code != http.StatusBadRequest {
+		t.Errorf("missing state status = %d, want 400", w.Code)
+	}
+	if w := ot.callback("test", "forged", oidcTestCode); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown state status = %d, want 400", w.Code)
+	}
+
+	// A state issued for another provider is refused
+	ot.rdb.set(oidcStatePrefix+"elsewhere", `{"provider":"corp","code_verifier":"v","nonce":"n"}`)
+	if w := ot.callback("test", "elsewhere", oidcTestCode); w.Code != http.StatusBadRequest {
+		t.Errorf("foreign state status = %d, want 400", w.Code)
+	}
+
+	// The provider reporting an error fails the login
+	r := httptest.NewRequest(http.MethodGet, "/auth/test/callback?error=access_denied", nil)
+	r.SetPathValue("provider", "test")
+	w := httptest.NewRecorder()
+	HandleOIDCCallback(w, r, ot.svc, ot.providers, &config.MFAConfig{})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("provider error status = %d, want 401", w.Code)
+	}
+
+	// A state works once
+	state := ot.start()
+	ot.loggedIn(ot.callback("test", state, oidcTestCode), 7)
+	if w := ot.callback("test", state, oidcTestCode); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed state status = %d, want 400", w.Code)
+	}
+}
+
+func TestOIDCCallbackPKCE(t *testing.T) {
+	ot := newOIDCTest(t)
+	ot.linkedTo(7)
+
+	// The verifier stored with the state must match the challenge sent to the
+	// provider, a swapped one fails the code exchange
+	state := ot.start()
+	ot.rdb.set(oidcStatePrefix+state, `{"provider":"test","code_verifier":"swapped","nonce":"n"}`)
+	if w := ot.callback("test", state, oidcTestCode); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", w.Code)
+	}
+	if w := ot.callback("test", ot.start(), "stolen-code"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong code status = %d, want 401", w.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsInvalidIDTokens(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		idToken func(idp *fakeIdP, claims jwt.MapClaims) string
+	}{
+		{"bad signature", func(idp *fakeIdP, claims jwt.MapClaims) string {
+			return idp.sign(claims, otherKey, idp.kid)
+		}},
+		{"unknown kid", func(idp *fakeIdP, claims jwt.MapClaims) string {
+			return idp.sign(claims, idp.key, "key-unknown")
+		}},
+		{"wrong audience", func(idp *fakeIdP, claims jwt.MapClaims) string {
+			claims["aud"] = "another-client"
+			return idp.sign(claims, idp.key, idp.kid)
+		}},
+		{"wrong issuer", func(idp *fakeIdP, claims jwt.MapClaims) string {
+			claims["iss"] = "https://evil.example.com"
+			return idp.sign(claims, idp.key, idp.kid)
+		}},
+		{"wrong nonce", func(idp *fakeIdP, claims jwt.MapClaims) string {
+			claims["nonce"] = "replayed"
+			return idp.sign(claims, idp.key, idp.kid)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ot := newOIDCTest(t)
+			ot.linkedTo(7)
+			ot.idp.idToken = func(claims jwt.MapClaims) string { return tt.idToken(ot.idp, claims) }
+
+			if w := ot.callback("test", ot.start(), oidcTestCode); w.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want 401", w.Code)
+			}
+			if len(ot.rdb.sets) != 0 {
+				t.Fatalf("a session was created")
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackUnverifiedEmail(t *testing.T) {
+	ot := newOIDCTest(t)
+	ot.existingUser()
+	state := ot.start()
+	ot.idp.claims["email_verified"] = false
+
+	if w := ot.callback("test", state, oidcTestCode); w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", w.Code)
+	}
+	if links := ot.links(); len(links) != 0 {
+		t.Fatalf("identity linked to %v", links)
+	}
+}
+
+func TestOIDCCallbackNewUser(t *testing.T) {
+	ot := newOIDCTest(t)
+	// The email is unknown until the user is created
+	ot.db.onQuery("SELECT id FROM users WHERE email = ?", func([]driver.Value) [][]driver.Value {
+		if len(ot.db.executed("INSERT INTO users")) == 0 {
+			return nil
+		}
+		return [][]driver.Value{{int64(9)}}
+	})
+
+	ot.loggedIn(ot.callback("test", ot.start(), oidcTestCode), 9)
+	if users := ot.db.executed("INSERT INTO users"); users[0].args[1] != "" {
+		t.Fatalf("new user was given a password")
+	}
+	if links := ot.links(); len(links) != 1 || links[0] != int64(9) {
+		t.Fatalf("identity linked to %v, want user 9", links)
+	}
+}
+
+func TestOIDCCallbackExistingAccount(t *testing.T) {
+	t.Run("not linked by email", func(t *testing.T) {
+		ot := newOIDCTest(t)
+		ot.existingUser()
+		if w := ot.callback("test", ot.start(), oidcTestCode); w.Code != http.StatusConflict {
+			t.Fatalf("status = %d, want 409", w.Code)
+		}
+		if links := ot.links(); len(links) != 0 {
+			t.Fatalf("identity linked to %v", links)
+		}
+	})
+
+	t.Run("trusted provider", func(t *testing.T) {
+		ot := newOIDCTest(t)
+		ot.existingUser()
+		ot.provider.LinkByEmail = true
+		ot.loggedIn(ot.callback("test", ot.start(), oidcTestCode), 7)
+		if links := ot.links(); len(links) != 1 || links[0] != int64(7) {
+			t.Fatalf("identity linked to %v, want user 7", links)
+		}
+	})
+
+	t.Run("trusted provider with mfa", func(t *testing.T) {
+		ot := newOIDCTest(t)
+		ot.existingUser()
+		ot.provider.LinkByEmail = true
+		ot.db.onQuery("FROM user_mfa", func([]driver.Value) [][]driver.Value {
+			return [][]driver.Value{{int64(7), "secret", true}}
+		})
+		if w := ot.callback("test", ot.start(), oidcTestCode); w.Code != http.StatusConflict {
+			t.Fatalf("status = %d, want 409", w.Code)
+		}
+		if links := ot.links(); len(links) != 0 {
+			t.Fatalf("identity linked to %v", links)
+		}
+	})
+}
+
+func TestOIDCLink(t *testing.T) {
+	ot := newOIDCTest(t)
+	ot.existingUser()
+
+	if _, w := ot.link(7, "wrong password"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password status = %d, want 401", w.Code)
+	}
+
+	state, _ := ot.link(7, oidcTestPassword)
+	if w := ot.callback("test", state, oidcTestCode); w.Code != http.StatusNoContent {
+		t.Fatalf("link status = %d: %s", w.Code, w.Body)
+	}
+	if links := ot.links(); len(links) != 1 || links[0] != int64(7) {
+		t.Fatalf("identity linked to %v, want user 7", links)
+	}
+
+	// An identity already linked to another account stays with it
+	ot.linkedTo(8)
+	state, _ = ot.link(7, oidcTestPassword)
+	if w := ot.callback("test", state, oidcTestCode); w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", w.Code)
+	}
+}
+
+func TestOIDCLinkWithoutPassword(t *testing.T) {
+	ot := newOIDCTest(t)
+	ot.existingUser()
+	ot.passwordHash = ""
+
+	// Accounts without a password re-authenticate by signing in again
+	session := service.Session{ID: "session-1", UserID: 7, CreatedAt: time.Now().Add(-time.Hour)}
+	if err := ot.svc.CreateSession(session, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, w := ot.link(7, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("old session status = %d, want 401", w.Code)
+	}
+
+	session.CreatedAt = time.Now()
+	if err := ot.svc.CreateSession(session, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	state, w := ot.link(7, "")
+	if state == "" {
+		t.Fatalf("recent session status = %d: %s", w.Code, w.Body)
+	}
+	if w := ot.callback("test", state, oidcTestCode); w.Code != http.StatusNoContent {
+		t.Fatalf("link status = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+const (
+	defaultOnlinePageSize = 50
+	maxOnlinePageSize     = 200
+)
+
+// onlineUserError reports a connected user whose profile could not be returned
+type onlineUserError struct {
+	UserID string `json:"user_id"`
+	Error  string `json:"error"`
+}
+
+type onlineUsersResponse struct {
+	Users []service.User `json:"users"`
+	// Errors lists users that matched but could not be returned. They do not
+	// fail the whole response.
+	Errors     []onlineUserError `json:"errors"`
+	Online     int               `json:"online"`
+	Matched    int               `json:"matched"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// onlineFilter narrows the online users list
+type onlineFilter struct {
+	namePrefix   string
+	contactsOnly bool
+	// roomID limits the list to the members of a conversation of the caller
+	roomID int64
+}
+
+// encodeOnlineCursor makes an opaque cursor pointing after a user ID
+func encodeOnlineCursor(userID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID)))
+}
+
+func decodeOnlineCursor(cursor string) (int, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, false
+	}
+	userID, err := strconv.Atoi(string(raw))
+	return userID, err == nil
+}
+
+// parseOnlineQuery reads limit, cursor and filters from the query string
+func parseOnlineQuery(r *http.Request) (limit, after int, filter onlineFilter, errMsg string) {
+	q := r.URL.Query()
+	limit = defaultOnlinePageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, filter, "Invalid limit"
+		}
+		limit = min(n, maxOnlinePageSize)
+	}
+	if v := q.Get("cursor"); v != "" {
+		var ok bool
+		if after, ok = decodeOnlineCursor(v); !ok {
+			return 0, 0, filter, "Invalid cursor"
+		}
+	}
+	filter.namePrefix = strings.ToLower(strings.TrimSpace(q.Get("name")))
+	if v := q.Get("contacts"); v != "" {
+		var err error
+		if filter.contactsOnly, err = strconv.ParseBool(v); err != nil {
+			return 0, 0, filter, "Invalid contacts filter"
+		}
+	}
+	if v := q.Get("room"); v != "" {
+		var err error
+		if filter.roomID, err = strconv.ParseInt(v, 10, 64); err != nil || filter.roomID <= 0 {
+			return 0, 0, filter, "Invalid room filter"
+		}
+	}
+	return limit, after, filter, ""
+}
+
+// HandleOnlineUsers lists the public profiles of connected users ordered by ID
+// with cursor pagination. Profiles that cannot be loaded are reported per item
+// in errors.
+func HandleOnlineUsers(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	limit, after, filter, errMsg := parseOnlineQuery(r)
+	if errMsg != "" {
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	// Snapshot the pool so no lock is held while talking to Redis and MySQL
+	clientIDs := pool.ClientIDs()
+	response := onlineUsersResponse{
+		Users:  []service.User{},
+		Errors: []onlineUserError{},
+		Online: len(clientIDs),
+	}
+
+	userIDs := make([]int, 0, len(clientIDs))
+	for _, id := range clientIDs {
+		userID, err := strconv.Atoi(id)
+		if err != nil {
+			response.Errors = append(response.Errors, onlineUserError{UserID: id, Error: "invalid user ID"})
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+
+	// Users with a block between them and the caller are never listed
+	callerID := claimsFromContext(r.Context()).UserID()
+	blockedIDs, err := svc.BlockedEitherIDs(callerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(blockedIDs) > 0 {
+		sort.Ints(blockedIDs)
+		userIDs = subtractSorted(userIDs, blockedIDs)
+	}
+
+	if filter.contactsOnly {
+		contactIDs, err := svc.ListContactIDs(callerID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userIDs = intersectSorted(userIDs, contactIDs)
+	}
+	if filter.roomID != 0 {
+		memberIDs, err := svc.ListConversationMemberIDs(filter.roomID, callerID)
+		if err != nil {
+			if errors.Is(err, service.ErrConversationNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userIDs = intersectSorted(userIDs, memberIDs)
+	}
+
+	// Without a name filter only the requested page needs profiles
+	candidates := userIDs
+	if filter.namePrefix == "" {
+		response.Matched = len(userIDs)
+		start := sort.SearchInts(userIDs, after+1)
+		end := min(start+limit, len(userIDs))
+		candidates = userIDs[start:end]
+		if end < len(userIDs) && len(candidates) > 0 {
+			response.NextCursor = encodeOnlineCursor(candidates[len(candidates)-1])
+		}
+	}
+
+	profiles, err := svc.GetUserProfiles(candidates)
+	if err != nil {
+		log.Printf("Error loading online user profiles: %v", err)
+	}
+
+	if filter.namePrefix == "" {
+		for _, id := range candidates {
+			user, ok := profiles[id]
+			if !ok {
+				response.Errors = append(response.Errors, onlineUserError{UserID: strconv.Itoa(id), Error: profileError(err)})
+				continue
+			}
+			response.Users = append(response.Users, publicProfile(user))
+		}
+	} else {
+		var matched []service.User
+		for _, id := range candidates {
+			user, ok := profiles[id]
+			if !ok {
+				response.Errors = append(response.Errors, onlineUserError{UserID: strconv.Itoa(id), Error: profileError(err)})
+				continue
+			}
+			if strings.HasPrefix(strings.ToLower(user.Name), filter.namePrefix) {
+				matched = append(matched, publicProfile(user))
+			}
+		}
+		response.Matched = len(matched)
+		start := sort.Search(len(matched), func(i int) bool {
+			id, _ := strconv.Atoi(matched[i].ID)
+			return id > after
+		})
+		end := min(start+limit, len(matched))
+		response.Users = append(response.Users, matched[start:end]...)
+		if end < len(matched) && end > start {
+			lastID, _ := strconv.Atoi(matched[end-1].ID)
+			response.NextCursor = encodeOnlineCursor(lastID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// profileError describes why a profile is missing from a batch lookup
+func profileError(batchErr error) string {
+	if batchErr != nil {
+		return "profile unavailable"
+	}
+	return "user not found"
+}
+
+// intersectSorted returns the IDs present in both ascending slices
+func intersectSorted(a, b []int) []int {
+	out := make([]int, 0, min(len(a), len(b)))
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// subtractSorted returns the IDs of a that are not in b, both ascending
+func subtractSorted(a, b []int) []int {
+	out := make([]int, 0, len(a))
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
+}
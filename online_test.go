@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestHandleOnlineUsers(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	// User 11 has a block with the caller 7, and user 12 has no profile
+	names := map[int64]string{7: "Ada", 8: "Bob", 9: "Bea", 10: "Carl", 11: "Bo"}
+	db.onQuery("FROM users WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, id := range args {
+			if name, ok := names[id.(int64)]; ok {
+				rows = append(rows, []driver.Value{id, "user@example.com", name, "", "", "user", false, "everyone", "everyone"})
+			}
+		}
+		return rows
+	})
+	db.onQuery("UNION SELECT user_id FROM user_blocks", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(11)}}
+	})
+	db.onQuery("SELECT contact_id FROM contacts", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(8)}, {int64(10)}}
+	})
+	db.onQuery("SELECT user_id FROM conversation_members WHERE conversation_id = ?", func(args []driver.Value) [][]driver.Value {
+		if args[0] != int64(50) {
+			return nil
+		}
+		return [][]driver.Value{{int64(7)}, {int64(8)}, {int64(9)}}
+	})
+	pool := newPool()
+	for _, id := range []string{"12", "bad", "7", "11", "10", "9", "8"} {
+		pool.AddClient(&Client{ID: id})
+	}
+
+	list := func(query string) (int, onlineUsersResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		HandleOnlineUsers(pool, rec, withClaims(t, httptest.NewRequest(http.MethodGet, "/online-users"+query, nil), 7, "s1"), svc)
+		var response onlineUsersResponse
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, response
+	}
+	ids := func(response onlineUsersResponse) []string {
+		var ids []string
+		for _, u := range response.Users {
+			ids = append(ids, u.ID)
+		}
+		return ids
+	}
+	errorIDs := func(response onlineUsersResponse) []string {
+		var ids []string
+		for _, e := range response.Errors {
+			ids = append(ids, e.UserID)
+		}
+		return ids
+	}
+
+	// Pages follow the user IDs. Bad IDs and missing profiles are reported
+	// per item, and blocked users are left out.
+	var pages [][]string
+	var missing []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		code, response := list("?limit=2&cursor=" + cursor)
+		if code != http.StatusOK {
+			t.Fatalf("page %d: status %d", i, code)
+		}
+		if response.Online != 7 || response.Matched != 5 {
+			t.Errorf("page %d: online %d, matched %d, want 7 and 5", i, response.Online, response.Matched)
+		}
+		pages = append(pages, ids(response))
+		missing = append(missing, errorIDs(response)...)
+		if cursor = response.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if want := [][]string{{"7", "8"}, {"9", "10"}, nil}; !slices.EqualFunc(pages, want, slices.Equal[[]string]) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+	slices.Sort(missing)
+	if want := []string{"12", "bad", "bad", "bad"}; !slices.Equal(missing, want) {
+		t.Errorf("errors = %v, want %v", missing, want)
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"?name=b", []string{"8", "9"}},
+		{"?name=b&limit=1", []string{"8"}},
+		{"?contacts=true", []string{"8", "10"}},
+		{"?room=50", []string{"7", "8", "9"}},
+		{"?room=50&name=BE", []string{"9"}},
+	} {
+		code, response := list(tt.query)
+		if code != http.StatusOK || !slices.Equal(ids(response), tt.want) {
+			t.Errorf("%s: status %d, users %v, want %v", tt.query, code, ids(response), tt.want)
+		}
+	}
+	if _, response := list("?name=b&limit=1"); response.Matched != 2 || response.NextCursor == "" {
+		t.Errorf("name filter page: matched %d, cursor %q", response.Matched, response.NextCursor)
+	}
+
+	for query, want := range map[string]int{
+		"?limit=0":       http.StatusBadRequest,
+		"?cursor=%21%21": http.StatusBadRequest,
+		"?contacts=x":    http.StatusBadRequest,
+		"?room=51":       http.StatusNotFound,
+	} {
+		if code, _ := list(query); code != want {
+			t.Errorf("%s: status %d, want %d", query, code, want)
+		}
+	}
+}
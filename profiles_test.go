@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUserProfileCache(t *testing.T) {
+	db := newFakeDB()
+	svc, rdb := newTestService(t, db)
+	var mu sync.Mutex
+	names := map[int64]string{7: "Ada", 8: "Bob"}
+	var queried [][]driver.Value
+	db.onQuery("FROM users WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		queried = append(queried, args)
+		var rows [][]driver.Value
+		for _, id := range args {
+			if name, ok := names[id.(int64)]; ok {
+				rows = append(rows, []driver.Value{id, "user@example.com", name, "", "", "user", false, "everyone", "everyone"})
+			}
+		}
+		return rows
+	})
+	lookups := func() [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		q := queried
+		queried = nil
+		return q
+	}
+
+	// Missing profiles are loaded with one query, unknown users are left out
+	profiles, err := svc.GetUserProfiles([]int{7, 8, 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[7].Name != "Ada" || profiles[8].Name != "Bob" {
+		t.Fatalf("profiles = %+v", profiles)
+	}
+	if q := lookups(); len(q) != 1 || len(q[0]) != 3 {
+		t.Fatalf("lookups = %v, want one query for 3 users", q)
+	}
+	if cached, ok := rdb.get("user:profile:7"); !ok || strings.Contains(cached, "password") {
+		t.Errorf("cached profile = %q", cached)
+	}
+
+	// Cached profiles are not queried again
+	profiles, err = svc.GetUserProfiles([]int{7, 8, 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := lookups(); len(q) != 1 || len(q[0]) != 1 || q[0][0] != int64(9) {
+		t.Errorf("lookups = %v, want only the unknown user", q)
+	}
+	if len(profiles) != 2 {
+		t.Errorf("profiles = %+v", profiles)
+	}
+
+	// An update is read after the profile is invalidated
+	mu.Lock()
+	names[7] = "Ada L."
+	mu.Unlock()
+	if err := svc.InvalidateUserProfile(7); err != nil {
+		t.Fatal(err)
+	}
+	user, err := svc.GetUserProfile(7)
+	if err != nil || user.Name != "Ada L." {
+		t.Fatalf("GetUserProfile = %+v, %v", user, err)
+	}
+	if _, err := svc.GetUserProfile(9); err == nil {
+		t.Error("GetUserProfile of an unknown user succeeded")
+	}
+	lookups()
+
+	// A failing cache falls back to MySQL
+	rdb.fail("MGET")
+	profiles, err = svc.GetUserProfiles([]int{7, 8})
+	if err != nil || len(profiles) != 2 {
+		t.Fatalf("GetUserProfiles with a failing cache = %+v, %v", profiles, err)
+	}
+	if q := lookups(); len(q) != 1 || len(q[0]) != 2 {
+		t.Errorf("lookups = %v, want both users from MySQL", q)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+const (
+	// maxResumeConversations bounds the conversations of one sync
+	maxResumeConversations = 100
+	// maxReplayMessages bounds the messages replayed per conversation and sync,
+	// new or changed
+	maxReplayMessages = 500
+)
+
+// syncEvent is the payload of a sync_complete frame
+type syncEvent struct {
+	// Seqs is the last sequence number the client has per conversation
+	Seqs map[int64]int64 `json:"seqs"`
+	// Truncated lists conversations with more missed messages than are
+	// replayed at once. Clients sync them again from the returned seq.
+	Truncated []int64 `json:"truncated,omitempty"`
+}
+
+// parseResume reads the "conversationID:seq,..." list of the resume parameter
+func parseResume(v string) (map[int64]int64, error) {
+	seqs := map[int64]int64{}
+	if v == "" {
+		return seqs, nil
+	}
+	for _, item := range strings.Split(v, ",") {
+		conv, seq, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid resume entry: %q", item)
+		}
+		conversationID, err := strconv.ParseInt(conv, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resume entry: %q", item)
+		}
+		if seqs[conversationID], err = strconv.ParseInt(seq, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid resume entry: %q", item)
+		}
+	}
+	return validateResume(seqs)
+}
+
+// validateResume checks the sequence numbers a client resumes from
+func validateResume(seqs map[int64]int64) (map[int64]int64, error) {
+	if len(seqs) > maxResumeConversations {
+		return nil, fmt.Errorf("at most %d conversations can be resumed at once", maxResumeConversations)
+	}
+	for conversationID, seq := range seqs {
+		if conversationID <= 0 || seq < 0 {
+			return nil, fmt.Errorf("invalid resume entry: %d:%d", conversationID, seq)
+		}
+	}
+	return seqs, nil
+}
+
+// syncConversations replays the messages a syncing client missed after the
+// given sequence numbers, from MySQL, then resumes live delivery. New messages
+// are sent as message frames and older ones that were edited, deleted or
+// reacted to since as message_updated frames with their current state. Live
+// frames held back meanwhile follow the replay, without the changes it already
+// covered. Live frames of truncated conversations are dropped too since the
+// client syncs them again. Room messages from users with a block with the
+// client are skipped, as they are live.
+func syncConversations(pool *Pool, svc *service.Service, client *Client, userID int, seqs map[int64]int64) {
+	replayed := make(map[int64]int64, len(seqs))
+	ev := syncEvent{Seqs: map[int64]int64{}}
+	defer func() {
+		for _, conversationID := range ev.Truncated {
+			replayed[conversationID] = math.MaxInt64
+		}
+		pool.endSync(client, replayed)
+	}()
+
+	mutedIDs, err := svc.ListMutedIDs(userID)
+	if err != nil {
+		log.Printf("Error checking mutes: %v", err)
+	}
+	blockedIDs, err := svc.BlockedEitherIDs(userID)
+	if err != nil {
+		log.Printf("Error checking blocks: %v", err)
+	}
+
+	for conversationID, seq := range seqs {
+		replayed[conversationID] = seq
+		messages, err := svc.ListMessagesAfterSeq(userID, conversationID, seq, maxReplayMessages+1)
+		if err != nil {
+			log.Printf("Error replaying conversation %d: %v", conversationID, err)
+			ev.Seqs[conversationID] = seq
+			ev.Truncated = append(ev.Truncated, conversationID)
+			continue
+		}
+		if len(messages) > maxReplayMessages {
+			messages = messages[:maxReplayMessages]
+			ev.Truncated = append(ev.Truncated, conversationID)
+		}
+		if len(messages) == 0 {
+			ev.Seqs[conversationID] = seq
+			continue
+		}
+
+		msgs := make([]*service.Message, len(messages))
+		for i := range messages {
+			msgs[i] = &messages[i]
+		}
+		if err := decorateMessages(svc, userID, msgs); err != nil {
+			log.Printf("Error loading replayed messages: %v", err)
+		}
+		conversationMuted, err := svc.IsConversationMuted(userID, conversationID)
+		if err != nil {
+			log.Printf("Error checking conversation mutes: %v", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.SenderID != userID && slices.Contains(blockedIDs, msg.SenderID) {
+				replayed[conversationID] = msg.LatestSeq()
+				continue
+			}
+			e := event{Type: eventMessageUpdated, Data: messageEvent{Message: msg}}
+			if msg.Seq > seq {
+				muted := conversationMuted || (msg.SenderID != userID && slices.Contains(mutedIDs, msg.SenderID))
+				e = event{Type: eventMessage, Data: messageEvent{Message: msg, Muted: muted}}
+			}
+			frame, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("Error encoding event: %v", err)
+				return
+			}
+			// Live frames are held back, so nothing else writes to the client
+			if err := client.write(string(frame)); err != nil {
+				log.Printf("Send message error: %v", err)
+				return
+			}
+			replayed[conversationID] = msg.LatestSeq()
+		}
+		ev.Seqs[conversationID] = replayed[conversationID]
+	}
+
+	frame, err := json.Marshal(event{Type: eventSyncComplete, Data: ev})
+	if err != nil {
+		log.Printf("Error encoding event: %v", err)
+		return
+	}
+	if err := client.write(string(frame)); err != nil {
+		log.Printf("Send message error: %v", err)
+	}
+}
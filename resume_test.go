@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+func TestSyncReplaysChanges(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	sent := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	db.onQuery("change_seq > ?", func(args []driver.Value) [][]driver.Value {
+		if args[0] != int64(50) || args[1] != int64(4) {
+			return nil
+		}
+		// Message 5 is new, message 3 was edited after the client's seq
+		edited := []driver.Value{int64(3), int64(8), nil, int64(50), int64(3), int64(6), "fixed", sent, sent.Add(time.Minute), nil, nil, nil, int64(0), nil}
+		return [][]driver.Value{messageRow(5, "new"), edited}
+	})
+
+	pool := newPool()
+	conn := connectClient(t, pool, 7)
+	client := pool.beginSync("7")
+
+	// Live frames held back during the sync: the edit is covered by the
+	// replay, the later reaction is not
+	pool.SendEvent(7, eventMessageEdited, messageEvent{Message: &service.Message{ID: 3, ConversationID: 50, Seq: 3, ChangeSeq: 6, Body: "fixed"}})
+	pool.SendEvent(7, eventReaction, reactionEvent{MessageID: 5, Emoji: "👍", Added: true, ConversationID: 50, Seq: 7})
+
+	syncConversations(pool, svc, client, 7, map[int64]int64{50: 4})
+
+	var got []event
+	for _, frame := range receivedEvents(t, pool, 7, conn) {
+		var ev struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(frame, &ev); err != nil {
+			t.Fatal(err)
+		}
+		var data map[string]any
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, event{Type: ev.Type, Data: data})
+	}
+
+	want := []struct {
+		typ   string
+		field string
+		value any
+	}{
+		{eventMessage, "id", float64(5)},
+		{eventMessageUpdated, "change_seq", float64(6)},
+		{eventSyncComplete, "seqs", map[string]any{"50": float64(6)}},
+		{eventReaction, "seq", float64(7)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames %+v, want %d", len(got), got, len(want))
+	}
+	for i, w := range want {
+		data := got[i].Data.(map[string]any)
+		if got[i].Type != w.typ {
+			t.Errorf("frame %d type = %q, want %q", i, got[i].Type, w.typ)
+			continue
+		}
+		if b, _ := json.Marshal(data[w.field]); string(b) != mustJSON(t, w.value) {
+			t.Errorf("frame %d %s = %s, want %s", i, w.field, b, mustJSON(t, w.value))
+		}
+	}
+	if body := got[1].Data.(map[string]any)["body"]; body != "fixed" {
+		t.Errorf("updated message body = %v, want the edited one", body)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/coder/websocket"
+	"go.uber.org/ratelimit"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+// newRouter registers every endpoint with its method and middleware, and wraps
+// the mux in the middleware shared by all requests
+func newRouter(cfg *config.Config, svc *service.Service, pool *Pool, oidcProviders map[string]*thirdparty.OIDCProvider, mailer thirdparty.Mailer, blobs thirdparty.BlobStore, signer *urlSigner, h *health) http.Handler {
+	mux := http.NewServeMux()
+	rl := ratelimit.New(100) // per second
+
+	// public endpoints are rate limited, authed ones also require an access token
+	public := func(h http.HandlerFunc) http.Handler {
+		return chain(h, withRateLimit(rl))
+	}
+	authed := func(h http.HandlerFunc, mws ...middleware) http.Handler {
+		return chain(h, append([]middleware{withRateLimit(rl), requireAuth(svc)}, mws...)...)
+	}
+
+	wsOpts := &websocket.AcceptOptions{
+		OriginPatterns: cfg.HTTPConfig.WSOriginPatterns,
+		Subprotocols:   []string{wsSubprotocol},
+	}
+	mux.Handle("GET /ws", chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleWebSocket(pool, w, r, svc, wsOpts, blobs, cfg.MessageConfig)
+	}), withRateLimit(rl), authenticateWebSocket(svc)))
+	mux.Handle("POST /ws-ticket", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleWSTicket(w, r, svc, cfg.HTTPConfig.WSTicketTTL)
+	}))
+
+	mux.Handle("POST /user", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleCreateUser(w, r, svc)
+	}))
+	mux.Handle("GET /user", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleGetUser(w, r, svc)
+	}))
+	mux.Handle("PATCH /user", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleUpdateProfile(w, r, svc)
+	}))
+	mux.Handle("DELETE /user", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleDeleteUser(pool, w, r, svc, blobs, cfg.AccountConfig)
+	}))
+	mux.Handle("PUT /user/password", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleChangePassword(pool, w, r, svc, cfg.AccountConfig)
+	}))
+	mux.Handle("PUT /user/email", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleChangeEmail(w, r, svc, mailer, cfg.AccountConfig)
+	}))
+	mux.Handle("POST /user/identities/{provider}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleOIDCLink(w, r, svc, oidcProviders, cfg.AccountConfig)
+	}))
+	mux.Handle("POST /user/email/verify", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleVerifyEmail(w, r, svc)
+	}))
+	// The link mailed for an email change, answered with a confirmation form
+	mux.Handle("GET /verify-email", public(HandleVerifyEmailPage))
+	mux.Handle("POST /verify-email", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleVerifyEmailForm(w, r, svc)
+	}))
+	mux.Handle("GET /users/search", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleUserSearch(w, r, svc)
+	}))
+	mux.Handle("GET /contacts", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleContacts(w, r, svc)
+	}))
+	mux.Handle("DELETE /contacts/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleRemoveContact(pool, w, r, svc)
+	}))
+	mux.Handle("GET /contacts/requests", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleContactRequests(w, r, svc)
+	}))
+	mux.Handle("POST /contacts/requests/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleSendContactRequest(pool, w, r, svc)
+	}))
+	mux.Handle("DELETE /contacts/requests/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleCancelContactRequest(pool, w, r, svc)
+	}))
+	mux.Handle("POST /contacts/requests/{id}/accept", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAnswerContactRequest(pool, w, r, svc, true)
+	}))
+	mux.Handle("POST /contacts/requests/{id}/decline", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAnswerContactRequest(pool, w, r, svc, false)
+	}))
+	mux.Handle("GET /blocks", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleBlocks(w, r, svc)
+	}))
+	mux.Handle("PUT /blocks/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleBlock(w, r, svc, true)
+	}))
+	mux.Handle("DELETE /blocks/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleBlock(w, r, svc, false)
+	}))
+	mux.Handle("GET /mutes", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleMutes(w, r, svc)
+	}))
+	mux.Handle("PUT /mutes/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleMute(w, r, svc, true)
+	}))
+	mux.Handle("DELETE /mutes/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleMute(w, r, svc, false)
+	}))
+	mux.Handle("GET /conversations", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleConversations(w, r, svc)
+	}))
+	mux.Handle("POST /conversations", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleCreateRoom(pool, w, r, svc)
+	}))
+	mux.Handle("PUT /conversations/{id}/pin", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleConversationSetting(w, r, svc, service.ConversationPinned, true)
+	}))
+	mux.Handle("DELETE /conversations/{id}/pin", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleConversationSetting(w, r, svc, service.ConversationPinned, false)
+	}))
+	mux.Handle("PUT /conversations/{id}/archive", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleConversationSetting(w, r, svc, service.ConversationArchived, true)
+	}))
+	mux.Handle("DELETE /conversations/{id}/archive", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleConversationSetting(w, r, svc, service.ConversationArchived, false)
+	}))
+	mux.Handle("PUT /conversations/{id}/mute", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleConversationSetting(w, r, svc, service.ConversationMuted, true)
+	}))
+	mux.Handle("DELETE /conversations/{id}/mute", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleConversationSetting(w, r, svc, service.ConversationMuted, false)
+	}))
+	mux.Handle("GET /search/messages", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleMessageSearch(w, r, svc)
+	}))
+	mux.Handle("GET /messages", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleListMessages(w, r, svc)
+	}))
+	mux.Handle("PATCH /messages/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleEditMessage(pool, w, r, svc, cfg.MessageConfig)
+	}))
+	mux.Handle("DELETE /messages/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleDeleteMessage(pool, w, r, svc, blobs, cfg.MessageConfig)
+	}))
+	mux.Handle("GET /messages/{id}/history", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleMessageHistory(w, r, svc)
+	}))
+	mux.Handle("PUT /messages/{id}/reactions/{emoji}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleReaction(pool, w, r, svc, cfg.MessageConfig, true)
+	}))
+	mux.Handle("DELETE /messages/{id}/reactions/{emoji}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleReaction(pool, w, r, svc, cfg.MessageConfig, false)
+	}))
+	mux.Handle("GET /threads/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleThread(w, r, svc)
+	}))
+	mux.Handle("POST /uploads", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleUpload(w, r, svc, blobs, cfg.UploadConfig)
+	}))
+	mux.Handle("GET /attachments/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAttachment(w, r, svc, signer)
+	}))
+	// Downloads are authorized by the signed URL instead of a bearer token
+	mux.Handle("GET /files/{id}", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleFile(w, r, svc, blobs, signer)
+	}))
+	mux.Handle("GET /online-users", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleOnlineUsers(pool, w, r, svc)
+	}))
+
+	mux.Handle("POST /login", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleLogin(w, r, svc, cfg.LockoutConfig, cfg.MFAConfig)
+	}))
+	mux.Handle("POST /login/mfa", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleLoginMFA(w, r, svc, cfg.LockoutConfig)
+	}))
+	mux.Handle("POST /refresh", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleRefreshToken(w, r, svc)
+	}))
+	mux.Handle("POST /unlock", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleUnlock(w, r, svc, cfg.LockoutConfig)
+	}))
+	mux.Handle("GET /auth/{provider}/start", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleOIDCStart(w, r, svc, oidcProviders)
+	}))
+	mux.Handle("GET /auth/{provider}/callback", public(func(w http.ResponseWriter, r *http.Request) {
+		HandleOIDCCallback(w, r, svc, oidcProviders, cfg.MFAConfig)
+	}))
+
+	mux.Handle("POST /mfa/enroll", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleMFAEnroll(w, r, svc, cfg.MFAConfig)
+	}))
+	mux.Handle("POST /mfa/verify", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleMFAVerify(w, r, svc)
+	}))
+
+	mux.Handle("GET /sessions", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleSessions(w, r, svc)
+	}))
+	mux.Handle("DELETE /sessions/{id}", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleSession(pool, w, r, svc)
+	}))
+
+	mux.Handle("GET /admin/users", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminListUsers(w, r, svc)
+	}, requirePermission(permUsersList)))
+	mux.Handle("POST /admin/users/{id}/disable", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminSetDisabled(pool, w, r, svc, true)
+	}, requirePermission(permUsersDisable)))
+	mux.Handle("POST /admin/users/{id}/enable", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminSetDisabled(pool, w, r, svc, false)
+	}, requirePermission(permUsersDisable)))
+	mux.Handle("POST /admin/users/{id}/disconnect", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminDisconnect(pool, w, r)
+	}, requirePermission(permUsersDisconnect)))
+	mux.Handle("POST /admin/users/{id}/unlock", authed(func(w http.ResponseWriter, r *http.Request) {
+		HandleAdminUnlock(w, r, svc)
+	}, requirePermission(permUsersUnlock)))
+
+	mux.Handle("GET /.well-known/jwks.json", public(HandleJWKS))
+
+	// Probes are not rate limited so they keep answering under load
+	mux.HandleFunc("GET /livez", h.HandleLivez)
+	mux.HandleFunc("GET /readyz", h.HandleReadyz)
+	mux.HandleFunc("GET /health", h.HandleReadyz)
+
+	return chain(mux, withRequestID, withAccessLog, withRecovery, withCORS(cfg.HTTPConfig))
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+// Frame types clients send over /ws
+const (
+	frameMessage = "message"
+	frameEdit    = "edit"
+	frameDelete  = "delete"
+	frameReact   = "react"
+	frameUnreact = "unreact"
+	frameRead    = "read"
+	frameSync    = "sync"
+)
+
+// maxEmojiLength bounds a reaction, which may be a multi code point emoji
+const maxEmojiLength = 8
+
+// clientFrame is a JSON frame sent by a client. The legacy "receiverID:message"
+// text format is still accepted as a message frame.
+type clientFrame struct {
+	Type           string `json:"type"`
+	To             int    `json:"to,omitempty"`
+	MessageID      int64  `json:"message_id,omitempty"`
+	ConversationID int64  `json:"conversation_id,omitempty"`
+	Body           string `json:"body,omitempty"`
+	Emoji          string `json:"emoji,omitempty"`
+	ReplyTo        int64  `json:"reply_to,omitempty"`
+	// Attachments are IDs returned by POST /uploads
+	Attachments []string `json:"attachments,omitempty"`
+	// Seqs maps conversation IDs to the last sequence number the client got
+	Seqs map[int64]int64 `json:"seqs,omitempty"`
+}
+
+// messageEvent is the payload of a message frame. Muted is set when the
+// receiver muted the sender or the conversation, so clients deliver it
+// without notifying.
+type messageEvent struct {
+	*service.Message
+	Muted bool `json:"muted,omitempty"`
+}
+
+// parseClientFrame decodes a JSON frame or a legacy "receiverID:message" one
+func parseClientFrame(raw []byte) (clientFrame, error) {
+	var frame clientFrame
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &frame); err != nil {
+			return frame, fmt.Errorf("invalid frame")
+		}
+		return frame, nil
+	}
+
+	parts := splitMessage(string(raw))
+	if len(parts) != 2 {
+		return frame, fmt.Errorf("invalid message format")
+	}
+	receiverID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return frame, fmt.Errorf("invalid receiver ID")
+	}
+	return clientFrame{Type: frameMessage, To: receiverID, Body: parts[1]}, nil
+}
+
+// validateMessageBody checks a message body against the configured limits
+func validateMessageBody(cfg *config.MessageConfig, body string) error {
+	if body == "" {
+		return fmt.Errorf("message body is required")
+	}
+	if utf8.RuneCountInString(body) > cfg.MaxLength {
+		return fmt.Errorf("message body must be at most %d characters", cfg.MaxLength)
+	}
+	return nil
+}
+
+// validateEmoji checks that a reaction is a short run of non-space characters
+func validateEmoji(emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return fmt.Errorf("invalid emoji")
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("invalid emoji")
+		}
+	}
+	return nil
+}
+
+// messageErrorText is the reason sent back in an error frame. Unexpected
+// errors are logged and not shown to the client.
+func messageErrorText(err error) string {
+	switch {
+	case errors.Is(err, service.ErrMessageNotFound),
+		errors.Is(err, service.ErrNotMessageAuthor),
+		errors.Is(err, service.ErrMessageDeleted),
+		errors.Is(err, service.ErrEditWindowExpired),
+		errors.Is(err, service.ErrTooManyReactions),
+		errors.Is(err, service.ErrAttachmentNotFound),
+		errors.Is(err, service.ErrConversationNotFound):
+		return err.Error()
+	}
+	log.Printf("Error handling frame: %v", err)
+	return "internal error"
+}
+
+// handleFrame dispatches one frame received from a client
+func handleFrame(pool *Pool, svc *service.Service, blobs thirdparty.BlobStore, cfg *config.MessageConfig, senderID int, raw []byte) {
+	frame, err := parseClientFrame(raw)
+	if err != nil {
+		pool.notify(senderID, eventError, errorEvent{Error: err.Error()})
+		return
+	}
+
+	switch frame.Type {
+	case frameMessage:
+		if len(frame.Attachments) > maxMessageAttachments {
+			pool.notify(senderID, eventError, errorEvent{Error: fmt.Sprintf("a message can carry at most %d attachments", maxMessageAttachments)})
+			return
+		}
+		// A message with attachments may have no text
+		if frame.Body != "" || len(frame.Attachments) == 0 {
+			if err := validateMessageBody(cfg, frame.Body); err != nil {
+				pool.notify(senderID, eventError, errorEvent{Error: err.Error()})
+				return
+			}
+		}
+		routeMessage(pool, svc, senderID, frame)
+	case frameEdit:
+		if err := validateMessageBody(cfg, frame.Body); err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: err.Error()})
+			return
+		}
+		if _, err := editMessage(pool, svc, cfg, senderID, frame.MessageID, frame.Body); err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+		}
+	case frameDelete:
+		if _, err := deleteMessage(pool, svc, blobs, cfg, senderID, frame.MessageID); err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+		}
+	case frameReact, frameUnreact:
+		if err := validateEmoji(frame.Emoji); err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: err.Error()})
+			return
+		}
+		if err := reactToMessage(pool, svc, cfg, senderID, frame.MessageID, frame.Emoji, frame.Type == frameReact); err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+		}
+	case frameRead:
+		if err := markConversationRead(pool, svc, senderID, frame.ConversationID, frame.MessageID); err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+		}
+	case frameSync:
+		seqs, err := validateResume(frame.Seqs)
+		if err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: err.Error()})
+			return
+		}
+		if client := pool.beginSync(strconv.Itoa(senderID)); client != nil {
+			syncConversations(pool, svc, client, senderID, seqs)
+		}
+	default:
+		pool.notify(senderID, eventError, errorEvent{Error: fmt.Sprintf("unknown frame type: %q", frame.Type)})
+	}
+}
+
+// routeMessage routes a message frame to its target: a user in to, or a
+// direct conversation or room in conversation_id. A reply without a target
+// goes to the conversation of the answered message.
+func routeMessage(pool *Pool, svc *service.Service, senderID int, frame clientFrame) {
+	if frame.To != 0 && frame.ConversationID != 0 {
+		pool.notify(senderID, eventError, errorEvent{Error: "a message goes either to a user or to a conversation"})
+		return
+	}
+	var parent *service.Message
+	if frame.ReplyTo != 0 {
+		var err error
+		parent, err = participantMessage(svc, senderID, frame.ReplyTo)
+		if err == nil && parent.DeletedAt != nil {
+			err = service.ErrMessageDeleted
+		}
+		if err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+			return
+		}
+	}
+
+	conversationID := frame.ConversationID
+	if parent != nil && frame.To == 0 && conversationID == 0 {
+		conversationID = parent.ConversationID
+	}
+	receiverID := frame.To
+	if conversationID != 0 {
+		conversation, err := svc.GetConversation(senderID, conversationID)
+		if err != nil {
+			pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+			return
+		}
+		if conversation.Kind == service.ConversationRoom {
+			if parent != nil && parent.ConversationID != conversation.ID {
+				pool.notify(senderID, eventError, errorEvent{Error: "a reply must go to the conversation of the answered message"})
+				return
+			}
+			routeRoomMessage(pool, svc, senderID, conversation.ID, frame.Body, frame.Attachments, parent)
+			return
+		}
+		receiverID = conversation.PeerID
+	}
+	if parent != nil && parent.ReceiverID == 0 {
+		pool.notify(senderID, eventError, errorEvent{Error: "a reply must go to the conversation of the answered message"})
+		return
+	}
+	routeDirectMessage(pool, svc, senderID, receiverID, frame.Body, frame.Attachments, parent)
+}
+
+// routeDirectMessage checks, stores and delivers a direct message. Messages
+// between users with a block are dropped silently, and receivers that only
+// accept contacts answer other senders with an error frame. The sender gets
+// the stored message back so it learns its ID. A non-nil parent posts the
+// message as a thread reply; the receiver then defaults to the other side of
+// the answered message.
+func routeDirectMessage(pool *Pool, svc *service.Service, senderID, receiverID int, body string, attachmentIDs []string, parent *service.Message) {
+	if parent != nil {
+		otherID := parent.SenderID
+		if otherID == senderID {
+			otherID = parent.ReceiverID
+		}
+		if receiverID == 0 {
+			receiverID = otherID
+		}
+		if receiverID != otherID {
+			pool.notify(senderID, eventError, errorEvent{Error: "a reply must go to the conversation of the answered message"})
+			return
+		}
+	}
+
+	blocked, err := svc.IsBlocked(receiverID, senderID)
+	if err != nil {
+		log.Printf("Error checking blocks: %v", err)
+		return
+	}
+	if blocked {
+		return
+	}
+
+	allowed, err := svc.CanDirectMessage(senderID, receiverID)
+	if err != nil && !errors.Is(err, service.ErrUserNotFound) {
+		log.Printf("Error checking message policy: %v", err)
+		return
+	}
+	if !allowed {
+		reason := "receiver only accepts messages from contacts"
+		if err != nil {
+			reason = "receiver not found"
+		}
+		pool.notify(senderID, eventError, errorEvent{Error: reason})
+		return
+	}
+
+	// Persist the message first so offline recipients do not lose it
+	var msg, root *service.Message
+	if parent == nil {
+		msg, err = svc.CreateMessage(senderID, receiverID, body, attachmentIDs)
+	} else {
+		msg, root, err = svc.CreateReply(senderID, receiverID, body, attachmentIDs, parent)
+	}
+	if err != nil {
+		pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+		return
+	}
+	if len(attachmentIDs) > 0 {
+		loadAttachments(svc, msg)
+	}
+
+	if err := pool.SendEvent(receiverID, eventMessage, messageEvent{Message: msg, Muted: isMessageMuted(svc, receiverID, msg)}); err != nil {
+		log.Printf("Send message error: %v", err)
+	}
+	if receiverID != senderID {
+		pool.notify(senderID, eventMessage, messageEvent{Message: msg})
+	}
+	if root != nil {
+		notifyThread(pool, svc, root, msg)
+	}
+}
+
+// routeRoomMessage stores a room message and delivers it to the members.
+// Members with a block with the sender do not get it. A non-nil parent posts
+// the message as a thread reply.
+func routeRoomMessage(pool *Pool, svc *service.Service, senderID int, conversationID int64, body string, attachmentIDs []string, parent *service.Message) {
+	var msg, root *service.Message
+	var err error
+	if parent == nil {
+		msg, err = svc.CreateRoomMessage(senderID, conversationID, body, attachmentIDs)
+	} else {
+		msg, root, err = svc.CreateReply(senderID, 0, body, attachmentIDs, parent)
+	}
+	if err != nil {
+		pool.notify(senderID, eventError, errorEvent{Error: messageErrorText(err)})
+		return
+	}
+	if len(attachmentIDs) > 0 {
+		loadAttachments(svc, msg)
+	}
+
+	recipients, err := messageRecipients(svc, msg)
+	if err != nil {
+		log.Printf("Error listing room members: %v", err)
+		recipients = []int{senderID}
+	}
+	for _, userID := range recipients {
+		ev := messageEvent{Message: msg}
+		if userID != senderID {
+			ev.Muted = isMessageMuted(svc, userID, msg)
+		}
+		pool.notify(userID, eventMessage, ev)
+	}
+	if root != nil {
+		notifyThread(pool, svc, root, msg)
+	}
+}
+
+// loadAttachments fills in the attachments of a message that was just sent
+func loadAttachments(svc *service.Service, msg *service.Message) {
+	attachments, err := svc.GetMessageAttachments([]int64{msg.ID})
+	if err != nil {
+		log.Printf("Error loading attachments: %v", err)
+	}
+	msg.Attachments = attachments[msg.ID]
+}
+
+// isMessageMuted reports whether a recipient muted the sender of a message or
+// its conversation
+func isMessageMuted(svc *service.Service, userID int, msg *service.Message) bool {
+	muted, err := svc.IsMuted(userID, msg.SenderID)
+	if err != nil {
+		log.Printf("Error checking mutes: %v", err)
+	}
+	if !muted {
+		if muted, err = svc.IsConversationMuted(userID, msg.ConversationID); err != nil {
+			log.Printf("Error checking conversation mutes: %v", err)
+		}
+	}
+	return muted
+}
+
+// messageRecipients returns the users a message and changes to it are pushed
+// to: both sides of a direct message, or the members of its room. Users with
+// a block with the sender are left out.
+func messageRecipients(svc *service.Service, msg *service.Message) ([]int, error) {
+	if msg.ReceiverID != 0 {
+		if msg.ReceiverID == msg.SenderID {
+			return []int{msg.SenderID}, nil
+		}
+		blocked, err := svc.IsBlocked(msg.ReceiverID, msg.SenderID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return []int{msg.SenderID}, nil
+		}
+		return []int{msg.SenderID, msg.ReceiverID}, nil
+	}
+
+	memberIDs, err := svc.ConversationMemberIDs(msg.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	var blockedIDs []int
+	if msg.SenderID != 0 {
+		if blockedIDs, err = svc.BlockedEitherIDs(msg.SenderID); err != nil {
+			return nil, err
+		}
+	}
+	recipients := make([]int, 0, len(memberIDs))
+	for _, userID := range memberIDs {
+		if !slices.Contains(blockedIDs, userID) {
+			recipients = append(recipients, userID)
+		}
+	}
+	return recipients, nil
+}
+
+// threadEvent is the payload of a thread_updated frame. Reply is only sent to
+// thread participants who did not already get it as a message frame; it is a
+// tombstone when the reply was deleted.
+type threadEvent struct {
+	RootID      int64            `json:"root_id"`
+	ReplyCount  int              `json:"reply_count"`
+	LastReplyAt *time.Time       `json:"last_reply_at,omitempty"`
+	Reply       *service.Message `json:"reply,omitempty"`
+	// Seq is the root's ChangeSeq within ConversationID
+	ConversationID int64 `json:"conversation_id,omitempty"`
+	Seq            int64 `json:"seq,omitempty"`
+}
+
+// notifyThread pushes the new reply count of a thread to the recipients of
+// the reply and to every thread participant, skipping users with a block
+// against the replier
+func notifyThread(pool *Pool, svc *service.Service, root, reply *service.Message) {
+	ev := threadEvent{
+		RootID:         root.ID,
+		ReplyCount:     root.ReplyCount,
+		LastReplyAt:    root.LastReplyAt,
+		ConversationID: root.ConversationID,
+		Seq:            root.ChangeSeq,
+	}
+	recipients, err := messageRecipients(svc, reply)
+	if err != nil {
+		log.Printf("Error listing message recipients: %v", err)
+		recipients = []int{reply.SenderID}
+	}
+	for _, userID := range recipients {
+		pool.notify(userID, eventThreadUpdated, ev)
+	}
+
+	participants, err := svc.ListThreadParticipants(root.ID)
+	if err != nil {
+		log.Printf("Error listing thread participants: %v", err)
+		return
+	}
+	withReply := ev
+	withReply.Reply = reply
+	for _, userID := range participants {
+		if userID == reply.SenderID || userID == reply.ReceiverID || slices.Contains(recipients, userID) {
+			continue
+		}
+		blocked, err := svc.IsBlocked(userID, reply.SenderID)
+		if err != nil || blocked {
+			continue
+		}
+		pool.notify(userID, eventThreadUpdated, withReply)
+	}
+}
+
+// broadcastMessageChange pushes an edited or deleted message to the
+// recipients of the message
+func broadcastMessageChange(pool *Pool, svc *service.Service, eventType string, msg *service.Message) {
+	recipients, err := messageRecipients(svc, msg)
+	if err != nil {
+		log.Printf("Error listing message recipients: %v", err)
+		recipients = []int{msg.SenderID}
+	}
+	for _, userID := range recipients {
+		pool.notify(userID, eventType, messageEvent{Message: msg})
+	}
+}
+
+// editMessage edits a message on behalf of its author and pushes the change
+func editMessage(pool *Pool, svc *service.Service, cfg *config.MessageConfig, userID int, messageID int64, body string) (*service.Message, error) {
+	msg, err := svc.EditMessage(messageID, userID, body, cfg.EditWindow)
+	if err != nil {
+		return nil, err
+	}
+	broadcastMessageChange(pool, svc, eventMessageEdited, msg)
+	return msg, nil
+}
+
+// deleteMessage deletes a message with its attachments on behalf of its author
+// and pushes the tombstone, and the new reply count for a reply
+func deleteMessage(pool *Pool, svc *service.Service, blobs thirdparty.BlobStore, cfg *config.MessageConfig, userID int, messageID int64) (*service.Message, error) {
+	msg, root, err := svc.DeleteMessage(messageID, userID, cfg.EditWindow)
+	if err != nil {
+		return nil, err
+	}
+	deleteMessageAttachments(svc, blobs, messageID)
+	broadcastMessageChange(pool, svc, eventMessageDeleted, msg)
+	if root != nil {
+		notifyThread(pool, svc, root, msg)
+	}
+	return msg, nil
+}
+
+// reactionEvent is the payload of a reaction frame. Reactions is the new
+// summary of the message.
+type reactionEvent struct {
+	MessageID int64                     `json:"message_id"`
+	UserID    int                       `json:"user_id"`
+	Emoji     string                    `json:"emoji"`
+	Added     bool                      `json:"added"`
+	Reactions []service.ReactionSummary `json:"reactions"`
+	// Seq numbers the change within ConversationID, 0 when the reaction did
+	// not change anything
+	ConversationID int64 `json:"conversation_id,omitempty"`
+	Seq            int64 `json:"seq,omitempty"`
+}
+
+// participantMessage loads a message the user sent or received, or one of a
+// room they are a member of. Messages from or to a user with a block with
+// them are reported as missing.
+func participantMessage(svc *service.Service, userID int, messageID int64) (*service.Message, error) {
+	msg, err := svc.GetMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	otherID := msg.SenderID
+	if msg.ReceiverID == 0 {
+		if _, err := svc.GetConversation(userID, msg.ConversationID); err != nil {
+			if errors.Is(err, service.ErrConversationNotFound) {
+				return nil, service.ErrMessageNotFound
+			}
+			return nil, err
+		}
+	} else {
+		if msg.SenderID != userID && msg.ReceiverID != userID {
+			return nil, service.ErrMessageNotFound
+		}
+		if otherID == userID {
+			otherID = msg.ReceiverID
+		}
+	}
+	blocked, err := svc.IsBlocked(userID, otherID)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, service.ErrMessageNotFound
+	}
+	return msg, nil
+}
+
+// reactToMessage adds or removes a reaction and pushes the new summary to the
+// recipients of the message
+func reactToMessage(pool *Pool, svc *service.Service, cfg *config.MessageConfig, userID int, messageID int64, emoji string, add bool) error {
+	msg, err := participantMessage(svc, userID, messageID)
+	if err != nil {
+		return err
+	}
+	if msg.DeletedAt != nil {
+		return service.ErrMessageDeleted
+	}
+
+	var seq int64
+	if add {
+		seq, err = svc.AddReaction(messageID, userID, emoji, cfg.MaxReactions)
+	} else {
+		seq, err = svc.RemoveReaction(messageID, userID, emoji)
+	}
+	if err != nil {
+		return err
+	}
+
+	summaries, err := svc.GetReactionSummaries([]int64{messageID}, 0)
+	if err != nil {
+		return err
+	}
+	ev := reactionEvent{
+		MessageID:      messageID,
+		UserID:         userID,
+		Emoji:          emoji,
+		Added:          add,
+		Reactions:      summaries[messageID],
+		ConversationID: msg.ConversationID,
+		Seq:            seq,
+	}
+	if ev.Reactions == nil {
+		ev.Reactions = []service.ReactionSummary{}
+	}
+	recipients, err := messageRecipients(svc, msg)
+	if err != nil {
+		log.Printf("Error listing message recipients: %v", err)
+		recipients = []int{userID}
+	}
+	for _, id := range recipients {
+		pool.notify(id, eventReaction, ev)
+	}
+	return nil
+}
+
+// deleteMessageAttachments removes the attachments of a deleted message and
+// their blobs. Failures are only logged since the message is already gone.
+func deleteMessageAttachments(svc *service.Service, blobs thirdparty.BlobStore, messageID int64) {
+	attachments, err := svc.DeleteMessageAttachments(messageID)
+	if err != nil {
+		log.Printf("Error deleting attachments of message %d: %v", messageID, err)
+		return
+	}
+	deleteAttachmentBlobs(blobs, attachments)
+}
+
+// deleteAttachmentBlobs removes the blobs and thumbnails of attachments whose
+// rows are already deleted. Failures are only logged.
+func deleteAttachmentBlobs(blobs thirdparty.BlobStore, attachments []service.Attachment) {
+	ctx := context.Background()
+	for _, a := range attachments {
+		for _, key := range []string{a.BlobKey, a.ThumbnailKey} {
+			if key == "" {
+				continue
+			}
+			if err := blobs.Delete(ctx, key); err != nil {
+				log.Printf("Error deleting blob %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// readEvent is the payload of a conversation_read frame
+type readEvent struct {
+	ConversationID    int64 `json:"conversation_id"`
+	LastReadMessageID int64 `json:"last_read_message_id"`
+	Unread            int64 `json:"unread"`
+}
+
+// markConversationRead moves the user's read marker and pushes the new marker
+// and unread count back
+func markConversationRead(pool *Pool, svc *service.Service, userID int, conversationID, messageID int64) error {
+	lastRead, unread, err := svc.MarkConversationRead(userID, conversationID, messageID)
+	if err != nil {
+		return err
+	}
+	pool.notify(userID, eventConversationRead, readEvent{
+		ConversationID:    conversationID,
+		LastReadMessageID: lastRead,
+		Unread:            unread,
+	})
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+)
+
+const eventTestMarker = "test_marker"
+
+// connectClient adds a websocket client for userID to pool and returns the
+// user's end of the connection
+func connectClient(t *testing.T, pool *Pool, userID int) *websocket.Conn {
+	t.Helper()
+	ready := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		ctx := conn.CloseRead(context.Background())
+		pool.AddClient(&Client{ID: strconv.Itoa(userID), Conn: conn})
+		close(ready)
+		<-ctx.Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		t.Fatal("client did not connect")
+	}
+	return conn
+}
+
+// receivedEvents returns the frames a user got so far, by pushing a marker
+// frame and reading up to it
+func receivedEvents(t *testing.T, pool *Pool, userID int, conn *websocket.Conn) []json.RawMessage {
+	t.Helper()
+	pool.notify(userID, eventTestMarker, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var frames []json.RawMessage
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("reading frames of user %d: %v", userID, err)
+		}
+		var ev struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type == eventTestMarker {
+			return frames
+		}
+		frames = append(frames, data)
+	}
+}
+
+// roomTest is room 50 with members 7, 8 and 9, where 9 blocked 7. User 10 is
+// not a member.
+func roomTest(t *testing.T) (*service.Service, *fakeDB) {
+	t.Helper()
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	members := []int64{7, 8, 9}
+	isMember := func(userID driver.Value) bool {
+		for _, id := range members {
+			if userID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	db.onQuery("WHERE m.user_id = ? AND c.id = ?", func(args []driver.Value) [][]driver.Value {
+		if args[1] != int64(50) || !isMember(args[0]) {
+			return nil
+		}
+		return [][]driver.Value{{int64(50), service.ConversationRoom, "Team", nil, int64(3), time.Now(), int64(0), false, false, false}}
+	})
+	memberRows := func(args []driver.Value) [][]driver.Value {
+		if args[0] != int64(50) {
+			return nil
+		}
+		var rows [][]driver.Value
+		for _, id := range members {
+			rows = append(rows, []driver.Value{id})
+		}
+		return rows
+	}
+	db.onQuery("FOR SHARE", memberRows)
+	db.onQuery("SELECT user_id FROM conversation_members WHERE conversation_id = ?", memberRows)
+	db.onQuery("SELECT last_seq FROM conversations", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(4)}}
+	})
+	db.onQuery("UNION SELECT user_id FROM user_blocks", func(args []driver.Value) [][]driver.Value {
+		switch args[0] {
+		case int64(7):
+			return [][]driver.Value{{int64(9)}}
+		case int64(9):
+			return [][]driver.Value{{int64(7)}}
+		}
+		return nil
+	})
+	return svc, db
+}
+
+func TestRoomMessage(t *testing.T) {
+	svc, db := roomTest(t)
+	pool := newPool()
+	conns := map[int]*websocket.Conn{}
+	for _, userID := range []int{7, 8, 9, 10} {
+		conns[userID] = connectClient(t, pool, userID)
+	}
+	cfg := &config.MessageConfig{MaxLength: 100}
+
+	handleFrame(pool, svc, nil, cfg, 7, []byte(`{"type":"message","conversation_id":50,"body":"hello room"}`))
+
+	for userID, want := range map[int]bool{7: true, 8: true, 9: false, 10: false} {
+		frames := receivedEvents(t, pool, userID, conns[userID])
+		if !want {
+			if len(frames) != 0 {
+				t.Errorf("user %d got %s", userID, frames)
+			}
+			continue
+		}
+		if len(frames) != 1 {
+			t.Fatalf("user %d got %d frames, want 1", userID, len(frames))
+		}
+		var ev struct {
+			Type string         `json:"type"`
+			Data map[string]any `json:"data"`
+		}
+		if err := json.Unmarshal(frames[0], &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != eventMessage || ev.Data["body"] != "hello room" || ev.Data["conversation_id"] != float64(50) || ev.Data["seq"] != float64(4) {
+			t.Errorf("user %d got %s", userID, frames[0])
+		}
+		if _, ok := ev.Data["receiver_id"]; ok {
+			t.Errorf("room message has a receiver: %s", frames[0])
+		}
+	}
+
+	inserts := db.executed("INSERT INTO messages")
+	if len(inserts) != 1 {
+		t.Fatalf("%d messages stored, want 1", len(inserts))
+	}
+	if args := inserts[0].args; args[0] != int64(7) || args[1] != int64(0) || args[2] != int64(50) {
+		t.Errorf("stored message with sender, receiver, conversation = %v, %v, %v", args[0], args[1], args[2])
+	}
+}
+
+func TestRoomMessageRequiresMembership(t *testing.T) {
+	svc, db := roomTest(t)
+	pool := newPool()
+	conn := connectClient(t, pool, 10)
+	member := connectClient(t, pool, 8)
+	cfg := &config.MessageConfig{MaxLength: 100}
+
+	for frame, wantError := range map[string]string{
+		`{"type":"message","conversation_id":50,"body":"let me in"}`:   "conversation not found",
+		`{"type":"message","conversation_id":51,"body":"anyone?"}`:     "conversation not found",
+		`{"type":"message","to":8,"conversation_id":50,"body":"both"}`: "a message goes either to a user or to a conversation",
+	} {
+		handleFrame(pool, svc, nil, cfg, 10, []byte(frame))
+		frames := receivedEvents(t, pool, 10, conn)
+		if len(frames) != 1 || !strings.Contains(string(frames[0]), wantError) {
+			t.Errorf("frame %s answered with %s, want %q", frame, frames, wantError)
+		}
+	}
+	if frames := receivedEvents(t, pool, 8, member); len(frames) != 0 {
+		t.Errorf("member got %s", frames)
+	}
+
+	// The service checks membership too
+	if _, err := svc.CreateRoomMessage(10, 50, "let me in", nil); !errors.Is(err, service.ErrConversationNotFound) {
+		t.Errorf("CreateRoomMessage by a non-member error = %v, want ErrConversationNotFound", err)
+	}
+	if inserts := db.executed("INSERT INTO messages"); len(inserts) != 0 {
+		t.Errorf("%d messages stored, want none", len(inserts))
+	}
+}
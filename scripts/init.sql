@@ -16,6 +16,238 @@ CREATE TABLE IF NOT EXISTS users (
     password VARCHAR(255) NOT NULL,
     name VARCHAR(255) NOT NULL,
     profile_url VARCHAR(255) NOT NULL,
+    status_text VARCHAR(140) NOT NULL DEFAULT '',
+    role VARCHAR(32) NOT NULL DEFAULT 'user',
+    disabled TINYINT(1) NOT NULL DEFAULT 0,
+    -- Who can find the user in the directory search: everyone, email_only
+    -- (exact email address only) or nobody
+    discoverable VARCHAR(16) NOT NULL DEFAULT 'everyone',
+    -- Who can send the user direct messages: everyone or contacts
+    dm_policy VARCHAR(16) NOT NULL DEFAULT 'everyone',
     PRIMARY KEY (id),
-    UNIQUE KEY idx_email (email)
-);
\ No newline at end of file
+    UNIQUE KEY idx_email (email),
+    FULLTEXT KEY idx_name_fulltext (name)
+);
+
+-- TOTP secrets for two-factor authentication. A secret stays pending
+-- (enabled = 0) until the user proves they can generate codes for it.
+CREATE TABLE IF NOT EXISTS user_mfa (
+    user_id INT NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    enabled TINYINT(1) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- One-time recovery codes, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+    id INT NOT NULL AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY idx_user_code (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Asymmetric JWT signing keys, identified by kid. Keys are rotated by the
+-- server, published in the JWKS before they sign and kept there until the
+-- overlap window has passed.
+CREATE TABLE IF NOT EXISTS jwt_signing_keys (
+    kid VARCHAR(64) NOT NULL,
+    algorithm VARCHAR(16) NOT NULL,
+    private_key TEXT NOT NULL,
+    -- Numbers the keys of an algorithm, so only one instance can store the
+    -- next key of a rotation
+    generation BIGINT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (kid),
+    UNIQUE KEY idx_algorithm_generation (algorithm, generation),
+    KEY idx_created_at (created_at)
+);
+
+-- External identities from OIDC providers linked to local users
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (provider, subject),
+    KEY idx_user_id (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Conversations: direct or room. A direct conversation is created with the
+-- first message between two users and identified by their sorted IDs in
+-- direct_key. Rooms have a name and are created explicitly.
+-- last_message_id is not a foreign key since messages reference conversations.
+CREATE TABLE IF NOT EXISTS conversations (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    kind VARCHAR(16) NOT NULL,
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    created_by INT NULL,
+    direct_key VARCHAR(32) NULL,
+    last_message_id BIGINT NULL,
+    -- Sequence number of the last message, incremented for every message
+    last_seq BIGINT NOT NULL DEFAULT 0,
+    last_activity_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE KEY idx_direct_key (direct_key),
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Members of a conversation with their read marker and their own pin,
+-- archive and mute settings. Unread counts are the messages from others after
+-- last_read_message_id, cached in Redis.
+CREATE TABLE IF NOT EXISTS conversation_members (
+    conversation_id BIGINT NOT NULL,
+    user_id INT NOT NULL,
+    last_read_message_id BIGINT NOT NULL DEFAULT 0,
+    pinned TINYINT(1) NOT NULL DEFAULT 0,
+    archived TINYINT(1) NOT NULL DEFAULT 0,
+    muted TINYINT(1) NOT NULL DEFAULT 0,
+    joined_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_id),
+    KEY idx_user_id (user_id),
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Messages routed through /ws. receiver_id is NULL for room messages.
+-- sender_id becomes NULL when the author deletes their account and the
+-- anonymize policy applies. Deleted messages stay as tombstones with an empty
+-- body and deleted_at set.
+CREATE TABLE IF NOT EXISTS messages (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    sender_id INT NULL,
+    receiver_id INT NULL,
+    conversation_id BIGINT NULL,
+    -- Position in the conversation, used to replay missed messages
+    seq BIGINT NULL,
+    -- Position of the last edit, deletion or reaction change
+    change_seq BIGINT NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    edited_at TIMESTAMP NULL DEFAULT NULL,
+    deleted_at TIMESTAMP NULL DEFAULT NULL,
+    -- Threads: reply_to is the answered message, thread_root the first
+    -- message of the thread, which keeps the reply count and last reply time
+    reply_to BIGINT NULL,
+    thread_root BIGINT NULL,
+    reply_count INT NOT NULL DEFAULT 0,
+    last_reply_at TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (id),
+    KEY idx_sender_id (sender_id),
+    KEY idx_receiver_id (receiver_id),
+    KEY idx_thread_root (thread_root),
+    KEY idx_conversation_id (conversation_id, id),
+    UNIQUE KEY idx_conversation_seq (conversation_id, seq),
+    KEY idx_conversation_change_seq (conversation_id, change_seq),
+    FULLTEXT KEY idx_body_fulltext (body),
+    FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+);
+
+-- Previous bodies of edited messages
+CREATE TABLE IF NOT EXISTS message_edits (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    message_id BIGINT NOT NULL,
+    body TEXT NOT NULL,
+    edited_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    KEY idx_message_id (message_id),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+-- Pending friend requests. Accepting one moves it into contacts.
+CREATE TABLE IF NOT EXISTS contact_requests (
+    sender_id INT NOT NULL,
+    receiver_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (sender_id, receiver_id),
+    KEY idx_receiver_id (receiver_id),
+    FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Accepted contacts, stored once in each direction
+CREATE TABLE IF NOT EXISTS contacts (
+    user_id INT NOT NULL,
+    contact_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, contact_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (contact_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Blocked users. Messages between the two are dropped and they do not see
+-- each other in /online-users or search.
+CREATE TABLE IF NOT EXISTS user_blocks (
+    user_id INT NOT NULL,
+    blocked_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, blocked_id),
+    KEY idx_blocked_id (blocked_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Muted users. Their messages are delivered without notifying.
+CREATE TABLE IF NOT EXISTS user_mutes (
+    user_id INT NOT NULL,
+    muted_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, muted_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (muted_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Emoji reactions on messages. The binary collation keeps different emoji
+-- from comparing equal.
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id BIGINT NOT NULL,
+    user_id INT NOT NULL,
+    emoji VARCHAR(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (message_id, user_id, emoji),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Users taking part in a thread: the root's author and everyone who replied.
+-- They are notified of new replies.
+CREATE TABLE IF NOT EXISTS thread_participants (
+    root_id BIGINT NOT NULL,
+    user_id INT NOT NULL,
+    joined_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (root_id, user_id),
+    KEY idx_user_id (user_id),
+    FOREIGN KEY (root_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Uploaded files. message_id stays NULL until the uploader sends the file
+-- with a message. The data lives in the blob store under blob_key.
+-- uploader_id becomes NULL when the uploader deletes their account and the
+-- anonymize policy keeps their messages.
+CREATE TABLE IF NOT EXISTS attachments (
+    id VARCHAR(32) NOT NULL,
+    uploader_id INT NULL,
+    message_id BIGINT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size BIGINT NOT NULL,
+    width INT NOT NULL DEFAULT 0,
+    height INT NOT NULL DEFAULT 0,
+    blob_key VARCHAR(255) NOT NULL,
+    thumbnail_key VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    KEY idx_message_id (message_id),
+    KEY idx_uploader_id (uploader_id),
+    FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
@@ -0,0 +1,137 @@
+-- Upgrade a database created from an older init.sql to the current schema.
+-- init.sql only creates missing tables, so columns and indexes added to
+-- existing tables are applied here. Every step checks the schema first and
+-- the script can be run any number of times:
+--
+--   mysql -u root -p < scripts/migrate.sql
+
+USE test;
+
+DROP PROCEDURE IF EXISTS add_column;
+DROP PROCEDURE IF EXISTS add_index;
+DROP PROCEDURE IF EXISTS add_foreign_key;
+DROP PROCEDURE IF EXISTS replace_foreign_key;
+
+DELIMITER //
+
+-- add_column runs ddl unless tbl already has the column col
+CREATE PROCEDURE add_column(tbl VARCHAR(64), col VARCHAR(64), ddl TEXT)
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+            WHERE table_schema = DATABASE() AND table_name = tbl AND column_name = col) THEN
+        SET @ddl = ddl;
+        PREPARE stmt FROM @ddl;
+        EXECUTE stmt;
+        DEALLOCATE PREPARE stmt;
+    END IF;
+END //
+
+-- add_index runs ddl unless tbl already has the index idx
+CREATE PROCEDURE add_index(tbl VARCHAR(64), idx VARCHAR(64), ddl TEXT)
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.statistics
+            WHERE table_schema = DATABASE() AND table_name = tbl AND index_name = idx) THEN
+        SET @ddl = ddl;
+        PREPARE stmt FROM @ddl;
+        EXECUTE stmt;
+        DEALLOCATE PREPARE stmt;
+    END IF;
+END //
+
+-- add_foreign_key runs ddl unless the column col of tbl already references
+-- another table
+CREATE PROCEDURE add_foreign_key(tbl VARCHAR(64), col VARCHAR(64), ddl TEXT)
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.key_column_usage
+            WHERE table_schema = DATABASE() AND table_name = tbl AND column_name = col
+                AND referenced_table_name IS NOT NULL) THEN
+        SET @ddl = ddl;
+        PREPARE stmt FROM @ddl;
+        EXECUTE stmt;
+        DEALLOCATE PREPARE stmt;
+    END IF;
+END //
+
+-- replace_foreign_key drops the foreign key on the column col of tbl if its
+-- delete rule is not rule, then adds it with ddl
+CREATE PROCEDURE replace_foreign_key(tbl VARCHAR(64), col VARCHAR(64), rule VARCHAR(16), ddl TEXT)
+BEGIN
+    DECLARE fk VARCHAR(64) DEFAULT NULL;
+    SELECT k.constraint_name INTO fk FROM information_schema.key_column_usage k
+        JOIN information_schema.referential_constraints r
+            ON r.constraint_schema = k.constraint_schema AND r.constraint_name = k.constraint_name
+        WHERE k.table_schema = DATABASE() AND k.table_name = tbl AND k.column_name = col
+            AND r.delete_rule <> rule
+        LIMIT 1;
+    IF fk IS NOT NULL THEN
+        SET @ddl = CONCAT('ALTER TABLE ', tbl, ' DROP FOREIGN KEY ', fk);
+        PREPARE stmt FROM @ddl;
+        EXECUTE stmt;
+        DEALLOCATE PREPARE stmt;
+    END IF;
+    CALL add_foreign_key(tbl, col, ddl);
+END //
+
+DELIMITER ;
+
+-- Roles and disabled accounts
+CALL add_column('users', 'role', "ALTER TABLE users ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'user'");
+CALL add_column('users', 'disabled', 'ALTER TABLE users ADD COLUMN disabled TINYINT(1) NOT NULL DEFAULT 0');
+
+-- Profile status text
+CALL add_column('users', 'status_text', "ALTER TABLE users ADD COLUMN status_text VARCHAR(140) NOT NULL DEFAULT ''");
+
+-- Directory search
+CALL add_column('users', 'discoverable', "ALTER TABLE users ADD COLUMN discoverable VARCHAR(16) NOT NULL DEFAULT 'everyone'");
+CALL add_index('users', 'idx_name_fulltext', 'ALTER TABLE users ADD FULLTEXT KEY idx_name_fulltext (name)');
+
+-- Contacts-only direct messages
+CALL add_column('users', 'dm_policy', "ALTER TABLE users ADD COLUMN dm_policy VARCHAR(16) NOT NULL DEFAULT 'everyone'");
+
+-- Message editing and deletion
+CALL add_column('messages', 'edited_at', 'ALTER TABLE messages ADD COLUMN edited_at TIMESTAMP NULL DEFAULT NULL');
+CALL add_column('messages', 'deleted_at', 'ALTER TABLE messages ADD COLUMN deleted_at TIMESTAMP NULL DEFAULT NULL');
+
+-- Threads
+CALL add_column('messages', 'reply_to', 'ALTER TABLE messages ADD COLUMN reply_to BIGINT NULL');
+CALL add_column('messages', 'thread_root', 'ALTER TABLE messages ADD COLUMN thread_root BIGINT NULL');
+CALL add_column('messages', 'reply_count', 'ALTER TABLE messages ADD COLUMN reply_count INT NOT NULL DEFAULT 0');
+CALL add_column('messages', 'last_reply_at', 'ALTER TABLE messages ADD COLUMN last_reply_at TIMESTAMP NULL DEFAULT NULL');
+CALL add_index('messages', 'idx_thread_root', 'ALTER TABLE messages ADD KEY idx_thread_root (thread_root)');
+
+-- Conversations
+CALL add_column('messages', 'conversation_id', 'ALTER TABLE messages ADD COLUMN conversation_id BIGINT NULL');
+CALL add_index('messages', 'idx_conversation_id', 'ALTER TABLE messages ADD KEY idx_conversation_id (conversation_id, id)');
+CALL add_foreign_key('messages', 'conversation_id', 'ALTER TABLE messages ADD FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE');
+
+-- Rooms, pins, archive and mute. Room messages have no receiver.
+CALL add_column('conversations', 'name', "ALTER TABLE conversations ADD COLUMN name VARCHAR(100) NOT NULL DEFAULT ''");
+CALL add_column('conversations', 'created_by', 'ALTER TABLE conversations ADD COLUMN created_by INT NULL');
+CALL add_foreign_key('conversations', 'created_by', 'ALTER TABLE conversations ADD FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL');
+CALL add_column('conversation_members', 'pinned', 'ALTER TABLE conversation_members ADD COLUMN pinned TINYINT(1) NOT NULL DEFAULT 0');
+CALL add_column('conversation_members', 'archived', 'ALTER TABLE conversation_members ADD COLUMN archived TINYINT(1) NOT NULL DEFAULT 0');
+CALL add_column('conversation_members', 'muted', 'ALTER TABLE conversation_members ADD COLUMN muted TINYINT(1) NOT NULL DEFAULT 0');
+ALTER TABLE messages MODIFY receiver_id INT NULL;
+
+-- Message search
+CALL add_index('messages', 'idx_body_fulltext', 'ALTER TABLE messages ADD FULLTEXT KEY idx_body_fulltext (body)');
+
+-- Sequence numbers for resume
+CALL add_column('conversations', 'last_seq', 'ALTER TABLE conversations ADD COLUMN last_seq BIGINT NOT NULL DEFAULT 0');
+CALL add_column('messages', 'seq', 'ALTER TABLE messages ADD COLUMN seq BIGINT NULL');
+CALL add_column('messages', 'change_seq', 'ALTER TABLE messages ADD COLUMN change_seq BIGINT NULL');
+CALL add_index('messages', 'idx_conversation_seq', 'ALTER TABLE messages ADD UNIQUE KEY idx_conversation_seq (conversation_id, seq)');
+CALL add_index('messages', 'idx_conversation_change_seq', 'ALTER TABLE messages ADD KEY idx_conversation_change_seq (conversation_id, change_seq)');
+
+-- One signing key per rotation
+CALL add_column('jwt_signing_keys', 'generation', 'ALTER TABLE jwt_signing_keys ADD COLUMN generation BIGINT NULL');
+CALL add_index('jwt_signing_keys', 'idx_algorithm_generation', 'ALTER TABLE jwt_signing_keys ADD UNIQUE KEY idx_algorithm_generation (algorithm, generation)');
+
+-- Attachments of anonymized messages outlive their uploader
+ALTER TABLE attachments MODIFY uploader_id INT NULL;
+CALL replace_foreign_key('attachments', 'uploader_id', 'SET NULL', 'ALTER TABLE attachments ADD FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE SET NULL');
+
+DROP PROCEDURE add_column;
+DROP PROCEDURE add_index;
+DROP PROCEDURE add_foreign_key;
+DROP PROCEDURE replace_foreign_key;
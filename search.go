@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+	maxSearchQueryLength  = 100
+	// snippetLength bounds the message text returned around the first match
+	snippetLength = 160
+)
+
+type userSearchResponse struct {
+	Users      []service.User `json:"users"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// messageSearchHit is a found message with an HTML snippet of its body where
+// matching words are wrapped in <mark>
+type messageSearchHit struct {
+	Message *service.Message `json:"message"`
+	Snippet string           `json:"snippet"`
+}
+
+type messageSearchResponse struct {
+	Results []messageSearchHit `json:"results"`
+	// NextCursor is passed as cursor to load older results
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// encodeSearchCursor makes an opaque cursor pointing after a search hit
+func encodeSearchCursor(hit service.UserSearchHit) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", hit.Rank, hit.User.ID)))
+}
+
+func decodeSearchCursor(cursor string) (service.UserSearchCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return service.UserSearchCursor{}, false
+	}
+	rank, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return service.UserSearchCursor{}, false
+	}
+	var c service.UserSearchCursor
+	if c.Rank, err = strconv.Atoi(rank); err != nil {
+		return service.UserSearchCursor{}, false
+	}
+	if c.UserID, err = strconv.Atoi(id); err != nil {
+		return service.UserSearchCursor{}, false
+	}
+	return c, true
+}
+
+// HandleUserSearch searches the user directory by name or email. Users who
+// opted out of discovery are filtered by the service.
+func HandleUserSearch(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	q := r.URL.Query()
+
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" || utf8.RuneCountInString(query) > maxSearchQueryLength {
+		http.Error(w, fmt.Sprintf("q must be between 1 and %d characters", maxSearchQueryLength), http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchPageSize)
+	}
+	var after service.UserSearchCursor
+	if v := q.Get("cursor"); v != "" {
+		var ok bool
+		if after, ok = decodeSearchCursor(v); !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Fetch one extra hit to know whether there is a next page
+	hits, err := svc.SearchUsers(claims.UserID(), query, after, limit+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := userSearchResponse{Users: []service.User{}}
+	if len(hits) > limit {
+		hits = hits[:limit]
+		response.NextCursor = encodeSearchCursor(hits[len(hits)-1])
+	}
+	for _, hit := range hits {
+		response.Users = append(response.Users, hit.User)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// encodeMessageSearchCursor makes an opaque cursor pointing after a found
+// message
+func encodeMessageSearchCursor(msg service.Message) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(msg.ID, 10)))
+}
+
+func decodeMessageSearchCursor(cursor string) (int64, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// parseSearchTime reads a since or until bound: an RFC 3339 time, or a
+// YYYY-MM-DD date in UTC. A date as until includes the whole day.
+func parseSearchTime(v string, until bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if until {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// isWordRune matches the runes search terms are made of
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// highlightSnippet cuts a window of the body around the first word starting
+// with one of the terms and wraps every such word in <mark>. The rest of the
+// text is HTML escaped.
+func highlightSnippet(body string, terms []string) string {
+	text := []rune(body)
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+	lowerTerms := make([][]rune, len(terms))
+	for i, term := range terms {
+		lowerTerms[i] = []rune(strings.ToLower(term))
+	}
+
+	// Find the matching words as [start, end) rune ranges
+	var matches [][2]int
+	for i := 0; i < len(text); i++ {
+		if !isWordRune(text[i]) || (i > 0 && isWordRune(text[i-1])) {
+			continue
+		}
+		end := i
+		for end < len(text) && isWordRune(text[end]) {
+			end++
+		}
+		for _, term := range lowerTerms {
+			if len(term) > 0 && len(term) <= end-i && string(lower[i:i+len(term)]) == string(term) {
+				matches = append(matches, [2]int{i, end})
+				break
+			}
+		}
+		i = end
+	}
+
+	start, stop := 0, len(text)
+	if len(text) > snippetLength {
+		if len(matches) > 0 {
+			start = max(0, matches[0][0]-snippetLength/4)
+		}
+		stop = min(len(text), start+snippetLength)
+		start = max(0, stop-snippetLength)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m[1] <= start || m[0] >= stop {
+			continue
+		}
+		from, to := max(m[0], start), min(m[1], stop)
+		b.WriteString(html.EscapeString(string(text[pos:from])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(text[from:to])))
+		b.WriteString("</mark>")
+		pos = to
+	}
+	b.WriteString(html.EscapeString(string(text[pos:stop])))
+	if stop < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// HandleMessageSearch searches the text of the caller's messages, newest
+// first. It can be narrowed to a conversation with conversation, to a sender
+// with from and to a time range with since and until, and pages backwards
+// with cursor.
+func HandleMessageSearch(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	q := r.URL.Query()
+
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" || utf8.RuneCountInString(query) > maxSearchQueryLength {
+		http.Error(w, fmt.Sprintf("q must be between 1 and %d characters", maxSearchQueryLength), http.StatusBadRequest)
+		return
+	}
+	terms := service.SearchTerms(query)
+	if len(terms) == 0 {
+		http.Error(w, "q must contain a word", http.StatusBadRequest)
+		return
+	}
+
+	var filter service.MessageSearchFilter
+	var err error
+	if v := q.Get("conversation"); v != "" {
+		if filter.ConversationID, err = strconv.ParseInt(v, 10, 64); err != nil || filter.ConversationID <= 0 {
+			http.Error(w, "Invalid conversation", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("from"); v != "" {
+		if filter.SenderID, err = strconv.Atoi(v); err != nil || filter.SenderID <= 0 {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		if filter.Since, err = parseSearchTime(v, false); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if filter.Until, err = parseSearchTime(v, true); err != nil {
+			http.Error(w, "Invalid until", http.StatusBadRequest)
+			return
+		}
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && !filter.Since.Before(filter.Until) {
+		http.Error(w, "since must be before until", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("cursor"); v != "" {
+		var ok bool
+		if filter.BeforeID, ok = decodeMessageSearchCursor(v); !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultSearchPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchPageSize)
+	}
+
+	// Fetch one extra message to know whether there are older results
+	messages, err := svc.SearchMessages(claims.UserID(), query, filter, limit+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := messageSearchResponse{Results: []messageSearchHit{}}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		response.NextCursor = encodeMessageSearchCursor(messages[len(messages)-1])
+	}
+	for i := range messages {
+		msg := &messages[i]
+		response.Results = append(response.Results, messageSearchHit{Message: msg, Snippet: highlightSnippet(msg.Body, terms)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// messageRow is a row of messageColumns for a message of conversation 50
+func messageRow(id int64, body string) []driver.Value {
+	return []driver.Value{id, int64(8), nil, int64(50), id, nil, body, time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), nil, nil, nil, nil, int64(0), nil}
+}
+
+func TestHandleMessageSearch(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	var mu sync.Mutex
+	var lastArgs []driver.Value
+	db.onQuery("MATCH(body) AGAINST", func(args []driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		lastArgs = args
+		// Three matches, newest first, below the cursor if there is one
+		var rows [][]driver.Value
+		for id := int64(30); id > 27; id-- {
+			if before := args[8].(int64); before == 0 || id < before {
+				rows = append(rows, messageRow(id, "deploy at noon"))
+			}
+		}
+		return rows
+	})
+
+	search := func(params string) (*httptest.ResponseRecorder, messageSearchResponse) {
+		t.Helper()
+		req := withClaims(t, httptest.NewRequest(http.MethodGet, "/search/messages?"+params, nil), 7, "s1")
+		rec := httptest.NewRecorder()
+		HandleMessageSearch(rec, req, svc)
+		var response messageSearchResponse
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec, response
+	}
+
+	// Paging with the opaque cursor
+	rec, page := search("q=deploy&limit=2")
+	if rec.Code != http.StatusOK || len(page.Results) != 2 || page.NextCursor == "" {
+		t.Fatalf("first page = %d %+v", rec.Code, page)
+	}
+	if strings.Contains(page.NextCursor, "29") {
+		t.Errorf("cursor %q is not opaque", page.NextCursor)
+	}
+	if page.Results[0].Snippet != "<mark>deploy</mark> at noon" {
+		t.Errorf("snippet = %q", page.Results[0].Snippet)
+	}
+	rec, page = search("q=deploy&limit=2&cursor=" + page.NextCursor)
+	if rec.Code != http.StatusOK || len(page.Results) != 1 || page.Results[0].Message.ID != 28 || page.NextCursor != "" {
+		t.Fatalf("second page = %d %+v", rec.Code, page)
+	}
+
+	// Sender and date filters
+	rec, _ = search("q=deploy&from=8&since=2026-10-01&until=2026-10-02T08:30:00%2B02:00")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("filtered search = %d %s", rec.Code, rec.Body)
+	}
+	mu.Lock()
+	args := lastArgs
+	mu.Unlock()
+	if args[6] != int64(8) {
+		t.Errorf("sender filter = %v, want 8", args[6])
+	}
+	if since, until := args[10], args[11]; since != time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC) || until != time.Date(2026, 10, 2, 6, 30, 0, 0, time.UTC) {
+		t.Errorf("time bounds = %v, %v", since, until)
+	}
+
+	// A date as until includes that day
+	search("q=deploy&until=2026-10-01")
+	mu.Lock()
+	args = lastArgs
+	mu.Unlock()
+	if until := args[len(args)-2]; until != time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("until = %v, want the end of the day", until)
+	}
+
+	for _, params := range []string{
+		"q=deploy&cursor=not-base64!",
+		"q=deploy&cursor=" + base64.RawURLEncoding.EncodeToString([]byte("0")),
+		"q=deploy&since=yesterday",
+		"q=deploy&until=2026-13-01",
+		"q=deploy&since=2026-10-02&until=2026-10-01",
+		"q=deploy&from=abc",
+	} {
+		if rec, _ := search(params); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", params, rec.Code)
+		}
+	}
+}
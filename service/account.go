@@ -0,0 +1,147 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ErrEmailTaken is returned when an email is already used by another account
+var ErrEmailTaken = errors.New("email already in use")
+
+// Message policies applied to a user's messages when the account is deleted
+const (
+	MessagePolicyAnonymize = "anonymize"
+	MessagePolicyDelete    = "delete"
+)
+
+// ProfileUpdate holds the profile fields to change. Nil fields are left as is.
+type ProfileUpdate struct {
+	Name         *string `json:"name"`
+	ProfileURL   *string `json:"profile_url"`
+	StatusText   *string `json:"status_text"`
+	Discoverable *string `json:"discoverable"`
+	DMPolicy     *string `json:"dm_policy"`
+}
+
+// UpdateUserProfile changes the given profile fields and drops the cached profile
+func (s *Service) UpdateUserProfile(userID int, update ProfileUpdate) error {
+	var sets []string
+	var args []interface{}
+	if update.Name != nil {
+		sets = append(sets, "name = ?")
+		args = append(args, *update.Name)
+	}
+	if update.ProfileURL != nil {
+		sets = append(sets, "profile_url = ?")
+		args = append(args, *update.ProfileURL)
+	}
+	if update.StatusText != nil {
+		sets = append(sets, "status_text = ?")
+		args = append(args, *update.StatusText)
+	}
+	if update.Discoverable != nil {
+		sets = append(sets, "discoverable = ?")
+		args = append(args, *update.Discoverable)
+	}
+	if update.DMPolicy != nil {
+		sets = append(sets, "dm_policy = ?")
+		args = append(args, *update.DMPolicy)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	query := "UPDATE users SET " + strings.Join(sets, ", ") + " WHERE id = ?"
+	args = append(args, userID)
+	if _, err := s.mysqlDB.Exec(query, args...); err != nil {
+		return fmt.Errorf("error updating user: %v", err)
+	}
+	return s.InvalidateUserProfile(userID)
+}
+
+// UpdateUserPassword stores a new password hash
+func (s *Service) UpdateUserPassword(userID int, passwordHash string) error {
+	if _, err := s.mysqlDB.Exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID); err != nil {
+		return fmt.Errorf("error updating password: %v", err)
+	}
+	return nil
+}
+
+// UpdateUserEmail changes a user's email, returning ErrEmailTaken if another
+// account already uses it
+func (s *Service) UpdateUserEmail(userID int, email string) error {
+	if _, err := s.mysqlDB.Exec("UPDATE users SET email = ? WHERE id = ?", email, userID); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return ErrEmailTaken
+		}
+		return fmt.Errorf("error updating email: %v", err)
+	}
+	return s.InvalidateUserProfile(userID)
+}
+
+// DeleteUser deletes an account and applies the message policy to the
+// messages it sent. Rows that reference the user are removed by cascade. The
+// attachments removed with the account are returned so their blobs can be
+// deleted: unsent uploads, and with MessagePolicyDelete the files of the
+// deleted messages. Files of anonymized messages are kept without uploader.
+func (s *Service) DeleteUser(userID int, messagePolicy string) ([]Attachment, error) {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error deleting user: %v", err)
+	}
+	defer tx.Rollback()
+
+	var peerIDs []int
+	var attachmentFilter string
+	switch messagePolicy {
+	case MessagePolicyDelete:
+		// Deleted messages may be unread on the other side
+		if peerIDs, err = s.ConversationPeerIDs(userID); err != nil {
+			return nil, err
+		}
+		attachmentFilter = "uploader_id = ?"
+	case MessagePolicyAnonymize:
+		attachmentFilter = "uploader_id = ? AND message_id IS NULL"
+	default:
+		return nil, fmt.Errorf("unknown message policy: %s", messagePolicy)
+	}
+
+	attachments, err := listAttachmentsTx(tx, attachmentFilter, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM attachments WHERE "+attachmentFilter, userID); err != nil {
+		return nil, fmt.Errorf("error deleting attachments: %v", err)
+	}
+	if messagePolicy == MessagePolicyDelete {
+		if _, err := tx.Exec("DELETE FROM messages WHERE sender_id = ?", userID); err != nil {
+			return nil, fmt.Errorf("error deleting messages: %v", err)
+		}
+	} else {
+		if _, err := tx.Exec("UPDATE messages SET sender_id = NULL WHERE sender_id = ?", userID); err != nil {
+			return nil, fmt.Errorf("error anonymizing messages: %v", err)
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting user: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrUserNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error deleting user: %v", err)
+	}
+	s.dropUnreadCounts(append(peerIDs, userID))
+	// The account is gone, a stale profile only lives until the cache expires
+	if err := s.InvalidateUserProfile(userID); err != nil {
+		log.Printf("Error invalidating profile of deleted user %d: %v", userID, err)
+	}
+	return attachments, nil
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"fmt"
+)
+
+// ListUsers returns a page of users ordered by ID, without their password hashes
+func (s *Service) ListUsers(limit, offset int) ([]User, error) {
+	query := "SELECT id, email, name, profile_url, status_text, role, disabled FROM users ORDER BY id LIMIT ? OFFSET ?"
+	rows, err := s.mysqlDB.Query(query, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("error listing users: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, limit)
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Email, &user.Name, &user.ProfileURL, &user.StatusText, &user.Role, &user.Disabled); err != nil {
+			return nil, fmt.Errorf("error scanning user: %v", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing users: %v", err)
+	}
+	return users, nil
+}
+
+// SetUserDisabled disables or re-enables an account
+func (s *Service) SetUserDisabled(userID int, disabled bool) error {
+	res, err := s.mysqlDB.Exec("UPDATE users SET disabled = ? WHERE id = ?", disabled, userID)
+	if err != nil {
+		return fmt.Errorf("error updating user: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// RowsAffected is 0 both for unknown users and unchanged rows
+		if _, err := s.GetUserByID(userID); err != nil {
+			return err
+		}
+	}
+	return s.InvalidateUserProfile(userID)
+}
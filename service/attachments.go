@@ -0,0 +1,210 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrAttachmentNotFound is returned when an attachment does not exist or
+// cannot be used by the caller
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// Attachment is an uploaded file. It belongs to its uploader until it is sent
+// with a message. UploaderID is 0 once the uploader deleted their account.
+type Attachment struct {
+	ID           string    `json:"id"`
+	UploaderID   int       `json:"uploader_id,omitempty"`
+	MessageID    int64     `json:"message_id,omitempty"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	BlobKey      string    `json:"-"`
+	ThumbnailKey string    `json:"-"`
+	HasThumbnail bool      `json:"has_thumbnail"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// | attachments | CREATE TABLE `attachments` (
+//   `id` varchar(32) NOT NULL,
+//   `uploader_id` int DEFAULT NULL,
+//   `message_id` bigint DEFAULT NULL,
+//   `filename` varchar(255) NOT NULL,
+//   `content_type` varchar(100) NOT NULL,
+//   `size` bigint NOT NULL,
+//   `width` int NOT NULL DEFAULT '0',
+//   `height` int NOT NULL DEFAULT '0',
+//   `blob_key` varchar(255) NOT NULL,
+//   `thumbnail_key` varchar(255) NOT NULL DEFAULT '',
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`id`),
+//   KEY `idx_message_id` (`message_id`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+
+const attachmentColumns = "id, uploader_id, message_id, filename, content_type, size, width, height, blob_key, thumbnail_key, created_at"
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	var a Attachment
+	var uploaderID, messageID sql.NullInt64
+	err := row.Scan(&a.ID, &uploaderID, &messageID, &a.Filename, &a.ContentType, &a.Size, &a.Width, &a.Height,
+		&a.BlobKey, &a.ThumbnailKey, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	a.UploaderID = int(uploaderID.Int64)
+	a.MessageID = messageID.Int64
+	a.HasThumbnail = a.ThumbnailKey != ""
+	return &a, nil
+}
+
+// CreateAttachment records an uploaded file whose blobs are already stored
+func (s *Service) CreateAttachment(a *Attachment) error {
+	a.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	query := `INSERT INTO attachments (id, uploader_id, filename, content_type, size, width, height, blob_key, thumbnail_key, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.mysqlDB.Exec(query, a.ID, a.UploaderID, a.Filename, a.ContentType, a.Size, a.Width, a.Height,
+		a.BlobKey, a.ThumbnailKey, a.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error creating attachment: %v", err)
+	}
+	a.HasThumbnail = a.ThumbnailKey != ""
+	return nil
+}
+
+// GetAttachment retrieves an attachment by ID
+func (s *Service) GetAttachment(id string) (*Attachment, error) {
+	row := s.mysqlDB.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", id)
+	a, err := scanAttachment(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, fmt.Errorf("error retrieving attachment: %v", err)
+	}
+	return a, nil
+}
+
+// listAttachmentsTx returns the attachments matching a WHERE clause
+func listAttachmentsTx(tx *sql.Tx, where string, args ...interface{}) ([]Attachment, error) {
+	rows, err := tx.Query("SELECT "+attachmentColumns+" FROM attachments WHERE "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving attachments: %v", err)
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning attachment: %v", err)
+		}
+		attachments = append(attachments, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error retrieving attachments: %v", err)
+	}
+	return attachments, nil
+}
+
+// attachToMessageTx links the uploader's unsent attachments to a message. It
+// fails with ErrAttachmentNotFound if any of them is unknown, someone else's
+// or already sent.
+func attachToMessageTx(tx *sql.Tx, messageID int64, uploaderID int, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := []interface{}{messageID, uploaderID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	query := "UPDATE attachments SET message_id = ? WHERE uploader_id = ? AND message_id IS NULL AND id IN (" + placeholders + ")"
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("error attaching files: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != int64(len(ids)) {
+		return ErrAttachmentNotFound
+	}
+	return nil
+}
+
+// GetMessageAttachments returns the attachments of several messages
+func (s *Service) GetMessageAttachments(messageIDs []int64) (map[int64][]Attachment, error) {
+	attachments := make(map[int64][]Attachment, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return attachments, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIDs)), ",")
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	query := "SELECT " + attachmentColumns + " FROM attachments WHERE message_id IN (" + placeholders + ") ORDER BY created_at, id"
+	rows, err := s.mysqlDB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving attachments: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning attachment: %v", err)
+		}
+		attachments[a.MessageID] = append(attachments[a.MessageID], *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error retrieving attachments: %v", err)
+	}
+	return attachments, nil
+}
+
+// DeleteMessageAttachments removes the attachments of a message and returns
+// them so their blobs can be deleted
+func (s *Service) DeleteMessageAttachments(messageID int64) ([]Attachment, error) {
+	attachments, err := s.GetMessageAttachments([]int64{messageID})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.mysqlDB.Exec("DELETE FROM attachments WHERE message_id = ?", messageID); err != nil {
+		return nil, fmt.Errorf("error deleting attachments: %v", err)
+	}
+	return attachments[messageID], nil
+}
+
+// DeleteUnsentAttachments removes up to limit attachments that were uploaded
+// before a time and never sent, oldest first, and returns them so their blobs
+// can be deleted. The rows are locked so a message cannot pick one up while it
+// is deleted.
+func (s *Service) DeleteUnsentAttachments(before time.Time, limit int) ([]Attachment, error) {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error deleting unsent attachments: %v", err)
+	}
+	defer tx.Rollback()
+
+	attachments, err := listAttachmentsTx(tx, "message_id IS NULL AND created_at < ? ORDER BY created_at, id LIMIT ? FOR UPDATE", before, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(attachments)), ",")
+	args := make([]interface{}, len(attachments))
+	for i, a := range attachments {
+		args[i] = a.ID
+	}
+	if _, err := tx.Exec("DELETE FROM attachments WHERE id IN ("+placeholders+")", args...); err != nil {
+		return nil, fmt.Errorf("error deleting unsent attachments: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error deleting unsent attachments: %v", err)
+	}
+	return attachments, nil
+}
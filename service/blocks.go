@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	blocksKeyPrefix = "user:blocks:"
+	mutesKeyPrefix  = "user:mutes:"
+	relationTTL     = 10 * time.Minute
+	// relationSentinel keeps an empty cached set from disappearing. User IDs
+	// start at 1 so it never collides with a real member.
+	relationSentinel = "0"
+)
+
+// | user_blocks | CREATE TABLE `user_blocks` (
+//   `user_id` int NOT NULL,
+//   `blocked_id` int NOT NULL,
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`user_id`,`blocked_id`),
+//   KEY `idx_blocked_id` (`blocked_id`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+//
+// | user_mutes | CREATE TABLE `user_mutes` (
+//   `user_id` int NOT NULL,
+//   `muted_id` int NOT NULL,
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`user_id`,`muted_id`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+
+// Each cached ID set lives under "<key>:<version>". A change bumps the version
+// in "<key>:version" after it is committed, so a set a reader loaded from
+// MySQL before the change lands under the old version and is never read
+// again. The version keys have no TTL: if one vanished while a set of the
+// version it fell back to was still cached, that stale set would be read.
+
+// blocksKey caches the users with a block between them and userID, in either
+// direction
+func blocksKey(userID int) string {
+	return blocksKeyPrefix + strconv.Itoa(userID)
+}
+
+// mutesKey caches the users userID muted
+func mutesKey(userID int) string {
+	return mutesKeyPrefix + strconv.Itoa(userID)
+}
+
+// queryIDs runs a query returning a single column of user IDs
+func (s *Service) queryIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := s.mysqlDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// versionKey holds the current version of a cached ID set
+func versionKey(key string) string {
+	return key + ":version"
+}
+
+// cachedIDs returns the members of a cached ID set, loading it from MySQL when
+// it is not cached. A failing cache falls back to MySQL.
+func (s *Service) cachedIDs(key string, load func() ([]int, error)) ([]int, error) {
+	ctx := context.Background()
+	// The version is read before MySQL, so a change committed after the load
+	// bumps it past the set stored below
+	version, err := s.redisDB.Get(ctx, versionKey(key)).Result()
+	if err == redis.Nil {
+		version, err = "0", nil
+	}
+	if err != nil {
+		return load()
+	}
+	key += ":" + version
+
+	members, err := s.redisDB.SMembers(ctx, key).Result()
+	if err == nil && len(members) > 0 {
+		ids := make([]int, 0, len(members))
+		for _, m := range members {
+			if id, err := strconv.Atoi(m); err == nil && m != relationSentinel {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+
+	ids, err := load()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0, len(ids)+1)
+	values = append(values, relationSentinel)
+	for _, id := range ids {
+		values = append(values, id)
+	}
+	pipe := s.redisDB.TxPipeline()
+	pipe.SAdd(ctx, key, values...)
+	pipe.Expire(ctx, key, relationTTL)
+	// The cache is best effort, the IDs were already loaded from MySQL
+	pipe.Exec(ctx)
+	return ids, nil
+}
+
+// invalidateIDs bumps the versions of cached ID sets after a committed change
+func (s *Service) invalidateIDs(keys ...string) error {
+	ctx := context.Background()
+	pipe := s.redisDB.TxPipeline()
+	for _, key := range keys {
+		pipe.Incr(ctx, versionKey(key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error invalidating cached users: %v", err)
+	}
+	return nil
+}
+
+// containsID reports whether ids contains id
+func containsID(ids []int, id int) bool {
+	for _, member := range ids {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockUser blocks a user. Any contact or pending request between the two is
+// removed.
+func (s *Service) BlockUser(userID, blockedID int) error {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return fmt.Errorf("error blocking user: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT IGNORE INTO user_blocks (user_id, blocked_id) VALUES (?, ?)", userID, blockedID); err != nil {
+		return fmt.Errorf("error blocking user: %v", err)
+	}
+	query := "DELETE FROM contacts WHERE (user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?)"
+	if _, err := tx.Exec(query, userID, blockedID, blockedID, userID); err != nil {
+		return fmt.Errorf("error removing contact: %v", err)
+	}
+	query = "DELETE FROM contact_requests WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)"
+	if _, err := tx.Exec(query, userID, blockedID, blockedID, userID); err != nil {
+		return fmt.Errorf("error removing contact request: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error blocking user: %v", err)
+	}
+	return s.invalidateIDs(blocksKey(userID), blocksKey(blockedID))
+}
+
+// UnblockUser lifts a block
+func (s *Service) UnblockUser(userID, blockedID int) error {
+	if _, err := s.mysqlDB.Exec("DELETE FROM user_blocks WHERE user_id = ? AND blocked_id = ?", userID, blockedID); err != nil {
+		return fmt.Errorf("error unblocking user: %v", err)
+	}
+	return s.invalidateIDs(blocksKey(userID), blocksKey(blockedID))
+}
+
+// ListBlockedIDs returns the users a user blocked, in ascending order
+func (s *Service) ListBlockedIDs(userID int) ([]int, error) {
+	ids, err := s.queryIDs("SELECT blocked_id FROM user_blocks WHERE user_id = ? ORDER BY blocked_id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing blocked users: %v", err)
+	}
+	return ids, nil
+}
+
+// BlockedEitherIDs returns the users who blocked or were blocked by a user,
+// through the Redis cache. The order is not defined.
+func (s *Service) BlockedEitherIDs(userID int) ([]int, error) {
+	return s.cachedIDs(blocksKey(userID), func() ([]int, error) {
+		query := "SELECT blocked_id FROM user_blocks WHERE user_id = ? UNION SELECT user_id FROM user_blocks WHERE blocked_id = ?"
+		ids, err := s.queryIDs(query, userID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("error listing blocked users: %v", err)
+		}
+		return ids, nil
+	})
+}
+
+// IsBlocked reports whether either user blocked the other. It is checked for
+// every routed message, so it is answered from the Redis cache.
+func (s *Service) IsBlocked(userID, otherID int) (bool, error) {
+	ids, err := s.BlockedEitherIDs(userID)
+	if err != nil {
+		return false, err
+	}
+	return containsID(ids, otherID), nil
+}
+
+// MuteUser mutes a user: their messages are still delivered, but flagged so
+// clients do not notify
+func (s *Service) MuteUser(userID, mutedID int) error {
+	if _, err := s.mysqlDB.Exec("INSERT IGNORE INTO user_mutes (user_id, muted_id) VALUES (?, ?)", userID, mutedID); err != nil {
+		return fmt.Errorf("error muting user: %v", err)
+	}
+	return s.invalidateIDs(mutesKey(userID))
+}
+
+// UnmuteUser lifts a mute
+func (s *Service) UnmuteUser(userID, mutedID int) error {
+	if _, err := s.mysqlDB.Exec("DELETE FROM user_mutes WHERE user_id = ? AND muted_id = ?", userID, mutedID); err != nil {
+		return fmt.Errorf("error unmuting user: %v", err)
+	}
+	return s.invalidateIDs(mutesKey(userID))
+}
+
+// ListMutedIDs returns the users a user muted, through the Redis cache. The
+// order is not defined.
+func (s *Service) ListMutedIDs(userID int) ([]int, error) {
+	return s.cachedIDs(mutesKey(userID), func() ([]int, error) {
+		ids, err := s.queryIDs("SELECT muted_id FROM user_mutes WHERE user_id = ? ORDER BY muted_id", userID)
+		if err != nil {
+			return nil, fmt.Errorf("error listing muted users: %v", err)
+		}
+		return ids, nil
+	})
+}
+
+// IsMuted reports whether userID muted otherID
+func (s *Service) IsMuted(userID, otherID int) (bool, error) {
+	ids, err := s.ListMutedIDs(userID)
+	if err != nil {
+		return false, err
+	}
+	return containsID(ids, otherID), nil
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	// ErrAlreadyContacts is returned when a request is sent to an existing contact
+	ErrAlreadyContacts = errors.New("already contacts")
+	// ErrContactRequestExists is returned when the same request is sent twice
+	ErrContactRequestExists = errors.New("contact request already sent")
+	// ErrContactRequestNotFound is returned when no pending request matches
+	ErrContactRequestNotFound = errors.New("contact request not found")
+	// ErrContactNotFound is returned when removing someone who is not a contact
+	ErrContactNotFound = errors.New("contact not found")
+)
+
+// Direct message policies. With DMPolicyContacts only contacts can send the
+// user direct messages.
+const (
+	DMPolicyEveryone = "everyone"
+	DMPolicyContacts = "contacts"
+)
+
+// ContactRequest is a pending friend request
+type ContactRequest struct {
+	SenderID   int       `json:"sender_id"`
+	ReceiverID int       `json:"receiver_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// | contact_requests | CREATE TABLE `contact_requests` (
+//   `sender_id` int NOT NULL,
+//   `receiver_id` int NOT NULL,
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`sender_id`,`receiver_id`),
+//   KEY `idx_receiver_id` (`receiver_id`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+//
+// | contacts | CREATE TABLE `contacts` (
+//   `user_id` int NOT NULL,
+//   `contact_id` int NOT NULL,
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`user_id`,`contact_id`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+
+// addContactsTx stores a contact pair in both directions
+func addContactsTx(tx *sql.Tx, userID, contactID int) error {
+	_, err := tx.Exec("INSERT IGNORE INTO contacts (user_id, contact_id) VALUES (?, ?), (?, ?)", userID, contactID, contactID, userID)
+	if err != nil {
+		return fmt.Errorf("error adding contact: %v", err)
+	}
+	return nil
+}
+
+// SendContactRequest sends a friend request. If the receiver already asked the
+// sender, their request is accepted instead and accepted is true.
+func (s *Service) SendContactRequest(senderID, receiverID int) (accepted bool, err error) {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("error sending contact request: %v", err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT 1 FROM contacts WHERE user_id = ? AND contact_id = ?", senderID, receiverID).Scan(&exists)
+	if err == nil {
+		return false, ErrAlreadyContacts
+	}
+	if err != sql.ErrNoRows {
+		return false, fmt.Errorf("error checking contacts: %v", err)
+	}
+
+	res, err := tx.Exec("DELETE FROM contact_requests WHERE sender_id = ? AND receiver_id = ?", receiverID, senderID)
+	if err != nil {
+		return false, fmt.Errorf("error sending contact request: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		if err := addContactsTx(tx, senderID, receiverID); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, fmt.Errorf("error sending contact request: %v", err)
+		}
+		return true, nil
+	}
+
+	if _, err := tx.Exec("INSERT INTO contact_requests (sender_id, receiver_id) VALUES (?, ?)", senderID, receiverID); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return false, ErrContactRequestExists
+		}
+		return false, fmt.Errorf("error sending contact request: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error sending contact request: %v", err)
+	}
+	return false, nil
+}
+
+// AcceptContactRequest accepts the request senderID sent to userID
+func (s *Service) AcceptContactRequest(userID, senderID int) error {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return fmt.Errorf("error accepting contact request: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM contact_requests WHERE sender_id = ? AND receiver_id = ?", senderID, userID)
+	if err != nil {
+		return fmt.Errorf("error accepting contact request: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrContactRequestNotFound
+	}
+	if err := addContactsTx(tx, userID, senderID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error accepting contact request: %v", err)
+	}
+	return nil
+}
+
+// DeleteContactRequest removes a pending request, used both when the receiver
+// declines it and when the sender cancels it
+func (s *Service) DeleteContactRequest(senderID, receiverID int) error {
+	res, err := s.mysqlDB.Exec("DELETE FROM contact_requests WHERE sender_id = ? AND receiver_id = ?", senderID, receiverID)
+	if err != nil {
+		return fmt.Errorf("error deleting contact request: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrContactRequestNotFound
+	}
+	return nil
+}
+
+// ListContactRequests returns the pending requests sent to and by a user
+func (s *Service) ListContactRequests(userID int) (incoming, outgoing []ContactRequest, err error) {
+	query := "SELECT sender_id, receiver_id, created_at FROM contact_requests WHERE sender_id = ? OR receiver_id = ? ORDER BY created_at DESC"
+	rows, err := s.mysqlDB.Query(query, userID, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing contact requests: %v", err)
+	}
+	defer rows.Close()
+
+	incoming, outgoing = []ContactRequest{}, []ContactRequest{}
+	for rows.Next() {
+		var req ContactRequest
+		if err := rows.Scan(&req.SenderID, &req.ReceiverID, &req.CreatedAt); err != nil {
+			return nil, nil, fmt.Errorf("error scanning contact request: %v", err)
+		}
+		if req.ReceiverID == userID {
+			incoming = append(incoming, req)
+		} else {
+			outgoing = append(outgoing, req)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error listing contact requests: %v", err)
+	}
+	return incoming, outgoing, nil
+}
+
+// RemoveContact removes a contact in both directions
+func (s *Service) RemoveContact(userID, contactID int) error {
+	query := "DELETE FROM contacts WHERE (user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?)"
+	res, err := s.mysqlDB.Exec(query, userID, contactID, contactID, userID)
+	if err != nil {
+		return fmt.Errorf("error removing contact: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrContactNotFound
+	}
+	return nil
+}
+
+// ListContactIDs returns the IDs of a user's contacts in ascending order
+func (s *Service) ListContactIDs(userID int) ([]int, error) {
+	rows, err := s.mysqlDB.Query("SELECT contact_id FROM contacts WHERE user_id = ? ORDER BY contact_id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing contacts: %v", err)
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning contact: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing contacts: %v", err)
+	}
+	return ids, nil
+}
+
+// IsContact reports whether two users are contacts
+func (s *Service) IsContact(userID, otherID int) (bool, error) {
+	var exists int
+	err := s.mysqlDB.QueryRow("SELECT 1 FROM contacts WHERE user_id = ? AND contact_id = ?", userID, otherID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking contacts: %v", err)
+	}
+	return true, nil
+}
+
+// CanDirectMessage reports whether the receiver's direct message policy lets
+// the sender message them. The policy is read from the cached profile.
+func (s *Service) CanDirectMessage(senderID, receiverID int) (bool, error) {
+	receiver, err := s.GetUserProfile(receiverID)
+	if err != nil {
+		return false, err
+	}
+	if receiver.Disabled {
+		return false, nil
+	}
+	if receiver.DMPolicy != DMPolicyContacts {
+		return true, nil
+	}
+	return s.IsContact(receiverID, senderID)
+}
@@ -0,0 +1,604 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrConversationNotFound is returned when a user is not a member of a
+// conversation, or it does not exist
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// Conversation kinds
+const (
+	// ConversationDirect is a conversation between two users
+	ConversationDirect = "direct"
+	// ConversationRoom is a named conversation between any number of users
+	ConversationRoom = "room"
+)
+
+// Per member conversation settings
+const (
+	ConversationPinned   = "pinned"
+	ConversationArchived = "archived"
+	ConversationMuted    = "muted"
+)
+
+const (
+	unreadKeyPrefix = "user:unread:"
+	unreadTTL       = 24 * time.Hour
+	// unreadSentinel keeps a cached hash without unread conversations from
+	// disappearing. Conversation IDs are numeric so it never collides.
+	unreadSentinel = "_"
+	// maxMemberPreview bounds the members listed with each conversation
+	maxMemberPreview = 10
+)
+
+// | conversations | CREATE TABLE `conversations` (
+//   `id` bigint NOT NULL AUTO_INCREMENT,
+//   `kind` varchar(16) NOT NULL,
+//   `name` varchar(100) NOT NULL DEFAULT '',
+//   `created_by` int DEFAULT NULL,
+//   `direct_key` varchar(32) DEFAULT NULL,
+//   `last_message_id` bigint DEFAULT NULL,
+//   `last_seq` bigint NOT NULL DEFAULT '0',
+//   `last_activity_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`id`),
+//   UNIQUE KEY `idx_direct_key` (`direct_key`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+//
+// | conversation_members | CREATE TABLE `conversation_members` (
+//   `conversation_id` bigint NOT NULL,
+//   `user_id` int NOT NULL,
+//   `last_read_message_id` bigint NOT NULL DEFAULT '0',
+//   `pinned` tinyint(1) NOT NULL DEFAULT '0',
+//   `archived` tinyint(1) NOT NULL DEFAULT '0',
+//   `muted` tinyint(1) NOT NULL DEFAULT '0',
+//   `joined_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`conversation_id`,`user_id`),
+//   KEY `idx_user_id` (`user_id`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+
+// Conversation is a conversation as seen by one of its members
+type Conversation struct {
+	ID   int64  `json:"id"`
+	Kind string `json:"kind"`
+	// Name is only set for rooms
+	Name string `json:"name,omitempty"`
+	// PeerID is the other user of a direct conversation. It is the member
+	// themselves for notes to self.
+	PeerID            int       `json:"peer_id,omitempty"`
+	LastMessage       *Message  `json:"last_message,omitempty"`
+	LastSeq           int64     `json:"last_seq"`
+	LastActivityAt    time.Time `json:"last_activity_at"`
+	LastReadMessageID int64     `json:"last_read_message_id"`
+	Unread            int64     `json:"unread"`
+	Pinned            bool      `json:"pinned"`
+	Archived          bool      `json:"archived"`
+	Muted             bool      `json:"muted"`
+	// MemberIDs are the first members to join, up to a small preview
+	MemberIDs   []int `json:"-"`
+	MemberCount int   `json:"member_count"`
+}
+
+// incrUnreadScript bumps an unread counter only when the user's counters are
+// cached. A missing hash is rebuilt from MySQL on the next read instead.
+var incrUnreadScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0`)
+
+// setUnreadScript sets an unread counter only when the user's counters are
+// cached
+var setUnreadScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0`)
+
+// unreadKey caches the unread counts of userID's conversations, keyed by
+// conversation ID
+func unreadKey(userID int) string {
+	return unreadKeyPrefix + strconv.Itoa(userID)
+}
+
+// directKey identifies the direct conversation between two users
+func directKey(a, b int) string {
+	if a > b {
+		a, b = b, a
+	}
+	return strconv.Itoa(a) + ":" + strconv.Itoa(b)
+}
+
+// directPeer returns the user of a direct key that is not userID
+func directPeer(key string, userID int) int {
+	a, b, _ := strings.Cut(key, ":")
+	low, _ := strconv.Atoi(a)
+	high, _ := strconv.Atoi(b)
+	if low == userID {
+		return high
+	}
+	return low
+}
+
+// directConversationTx returns the direct conversation between two users,
+// creating it on their first message
+func directConversationTx(tx *sql.Tx, senderID, receiverID int) (int64, error) {
+	query := "INSERT INTO conversations (kind, direct_key) VALUES (?, ?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)"
+	res, err := tx.Exec(query, ConversationDirect, directKey(senderID, receiverID))
+	if err != nil {
+		return 0, fmt.Errorf("error creating conversation: %v", err)
+	}
+	conversationID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error creating conversation: %v", err)
+	}
+	query = "INSERT IGNORE INTO conversation_members (conversation_id, user_id) VALUES (?, ?), (?, ?)"
+	if _, err := tx.Exec(query, conversationID, senderID, conversationID, receiverID); err != nil {
+		return 0, fmt.Errorf("error adding conversation members: %v", err)
+	}
+	return conversationID, nil
+}
+
+// nextSeqTx reserves the next sequence number of a conversation. The row lock
+// taken by the update orders concurrent messages until the transaction ends.
+func nextSeqTx(tx *sql.Tx, conversationID int64) (int64, error) {
+	if _, err := tx.Exec("UPDATE conversations SET last_seq = last_seq + 1 WHERE id = ?", conversationID); err != nil {
+		return 0, fmt.Errorf("error assigning sequence number: %v", err)
+	}
+	var seq int64
+	if err := tx.QueryRow("SELECT last_seq FROM conversations WHERE id = ?", conversationID).Scan(&seq); err != nil {
+		return 0, fmt.Errorf("error assigning sequence number: %v", err)
+	}
+	return seq, nil
+}
+
+// recordMessageTx makes msg the last message of its conversation. Sending
+// also marks the conversation as read for the sender, and the conversation
+// comes back out of the archive of members who did not mute it.
+func recordMessageTx(tx *sql.Tx, msg *Message) error {
+	query := "UPDATE conversations SET last_message_id = ?, last_activity_at = ? WHERE id = ?"
+	if _, err := tx.Exec(query, msg.ID, msg.CreatedAt, msg.ConversationID); err != nil {
+		return fmt.Errorf("error updating conversation: %v", err)
+	}
+	query = "UPDATE conversation_members SET last_read_message_id = GREATEST(last_read_message_id, ?) WHERE conversation_id = ? AND user_id = ?"
+	if _, err := tx.Exec(query, msg.ID, msg.ConversationID, msg.SenderID); err != nil {
+		return fmt.Errorf("error updating read marker: %v", err)
+	}
+	query = "UPDATE conversation_members SET archived = 0 WHERE conversation_id = ? AND archived = 1 AND muted = 0"
+	if _, err := tx.Exec(query, msg.ConversationID); err != nil {
+		return fmt.Errorf("error unarchiving conversation: %v", err)
+	}
+	return nil
+}
+
+// countUnread counts the messages of a conversation after the user's read
+// marker that others sent and did not delete
+func (s *Service) countUnread(userID int, conversationID int64) (int64, error) {
+	query := `SELECT COUNT(msg.id) FROM conversation_members m
+		JOIN messages msg ON msg.conversation_id = m.conversation_id AND msg.id > m.last_read_message_id
+		WHERE m.conversation_id = ? AND m.user_id = ?
+			AND (msg.sender_id IS NULL OR msg.sender_id <> m.user_id) AND msg.deleted_at IS NULL`
+	var unread int64
+	if err := s.mysqlDB.QueryRow(query, conversationID, userID).Scan(&unread); err != nil {
+		return 0, fmt.Errorf("error counting unread messages: %v", err)
+	}
+	return unread, nil
+}
+
+// updateUnread runs one of the unread scripts. A failed update drops the
+// user's cached counters so they are rebuilt instead of drifting.
+func (s *Service) updateUnread(script *redis.Script, userID int, conversationID int64, value int64) {
+	ctx := context.Background()
+	key := unreadKey(userID)
+	if err := script.Run(ctx, s.redisDB, []string{key}, conversationID, value).Err(); err != nil {
+		s.redisDB.Del(ctx, key)
+	}
+}
+
+// messageCreated updates the unread counters of the conversation members
+// after a message was stored
+func (s *Service) messageCreated(msg *Message, memberIDs []int) {
+	for _, userID := range memberIDs {
+		if userID == msg.SenderID {
+			s.updateUnread(setUnreadScript, userID, msg.ConversationID, 0)
+		} else {
+			s.updateUnread(incrUnreadScript, userID, msg.ConversationID, 1)
+		}
+	}
+}
+
+// refreshUnread recounts one unread counter from MySQL, after messages were
+// read or deleted
+func (s *Service) refreshUnread(userID int, conversationID int64) (int64, error) {
+	unread, err := s.countUnread(userID, conversationID)
+	if err != nil {
+		s.redisDB.Del(context.Background(), unreadKey(userID))
+		return 0, err
+	}
+	s.updateUnread(setUnreadScript, userID, conversationID, unread)
+	return unread, nil
+}
+
+// GetUnreadCounts returns the unread counts of a user's conversations that
+// have unread messages. They are kept in Redis and rebuilt from the read
+// markers when not cached. A failing cache falls back to MySQL.
+func (s *Service) GetUnreadCounts(userID int) (map[int64]int64, error) {
+	ctx := context.Background()
+	key := unreadKey(userID)
+	counts := map[int64]int64{}
+
+	cached, err := s.redisDB.HGetAll(ctx, key).Result()
+	if err == nil && len(cached) > 0 {
+		for field, val := range cached {
+			id, idErr := strconv.ParseInt(field, 10, 64)
+			n, countErr := strconv.ParseInt(val, 10, 64)
+			if idErr == nil && countErr == nil && n > 0 {
+				counts[id] = n
+			}
+		}
+		return counts, nil
+	}
+
+	query := `SELECT m.conversation_id, COUNT(msg.id) FROM conversation_members m
+		JOIN messages msg ON msg.conversation_id = m.conversation_id AND msg.id > m.last_read_message_id
+		WHERE m.user_id = ? AND (msg.sender_id IS NULL OR msg.sender_id <> m.user_id) AND msg.deleted_at IS NULL
+		GROUP BY m.conversation_id`
+	rows, err := s.mysqlDB.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error counting unread messages: %v", err)
+	}
+	defer rows.Close()
+	values := []interface{}{unreadSentinel, 0}
+	for rows.Next() {
+		var id, n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, fmt.Errorf("error scanning unread count: %v", err)
+		}
+		counts[id] = n
+		values = append(values, id, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error counting unread messages: %v", err)
+	}
+
+	pipe := s.redisDB.TxPipeline()
+	pipe.HSet(ctx, key, values...)
+	pipe.Expire(ctx, key, unreadTTL)
+	// The cache is best effort, the counts were already loaded from MySQL
+	pipe.Exec(ctx)
+	return counts, nil
+}
+
+// MarkConversationRead moves the user's read marker forward to messageID,
+// which must belong to the conversation. Pass 0 to mark everything read. The
+// new marker and unread count are returned.
+func (s *Service) MarkConversationRead(userID int, conversationID, messageID int64) (lastRead, unread int64, err error) {
+	var lastMessageID sql.NullInt64
+	query := `SELECT c.last_message_id FROM conversations c
+		JOIN conversation_members m ON m.conversation_id = c.id AND m.user_id = ?
+		WHERE c.id = ?`
+	if err := s.mysqlDB.QueryRow(query, userID, conversationID).Scan(&lastMessageID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, ErrConversationNotFound
+		}
+		return 0, 0, fmt.Errorf("error retrieving conversation: %v", err)
+	}
+
+	if messageID == 0 {
+		messageID = lastMessageID.Int64
+	} else {
+		var n int
+		query = "SELECT COUNT(*) FROM messages WHERE id = ? AND conversation_id = ?"
+		if err := s.mysqlDB.QueryRow(query, messageID, conversationID).Scan(&n); err != nil {
+			return 0, 0, fmt.Errorf("error retrieving message: %v", err)
+		}
+		if n == 0 {
+			return 0, 0, ErrMessageNotFound
+		}
+	}
+
+	query = "UPDATE conversation_members SET last_read_message_id = GREATEST(last_read_message_id, ?) WHERE conversation_id = ? AND user_id = ?"
+	if _, err := s.mysqlDB.Exec(query, messageID, conversationID, userID); err != nil {
+		return 0, 0, fmt.Errorf("error updating read marker: %v", err)
+	}
+	query = "SELECT last_read_message_id FROM conversation_members WHERE conversation_id = ? AND user_id = ?"
+	if err := s.mysqlDB.QueryRow(query, conversationID, userID).Scan(&lastRead); err != nil {
+		return 0, 0, fmt.Errorf("error retrieving read marker: %v", err)
+	}
+	if unread, err = s.refreshUnread(userID, conversationID); err != nil {
+		return 0, 0, err
+	}
+	return lastRead, unread, nil
+}
+
+// ConversationCursor points after the last conversation of the previous page
+type ConversationCursor struct {
+	Pinned         bool
+	LastActivityAt time.Time
+	ID             int64
+}
+
+// conversationFilter leaves out direct conversations with a user that has a
+// block with the member
+const conversationFilter = `NOT (c.kind = 'direct' AND EXISTS (
+		SELECT 1 FROM conversation_members o
+		JOIN user_blocks b ON (b.user_id = m.user_id AND b.blocked_id = o.user_id)
+			OR (b.user_id = o.user_id AND b.blocked_id = m.user_id)
+		WHERE o.conversation_id = c.id AND o.user_id <> m.user_id))`
+
+// ListConversations returns a page of a user's archived or unarchived
+// conversations with their last message, unread count and first members.
+// Pinned conversations come first, then the most recently active. Direct
+// conversations with a blocked user are left out. Pass a nil cursor for the
+// first page.
+func (s *Service) ListConversations(userID int, archived bool, after *ConversationCursor, limit int) ([]Conversation, error) {
+	query := `SELECT c.id, c.kind, c.name, c.direct_key, c.last_message_id, c.last_seq, c.last_activity_at,
+			m.last_read_message_id, m.pinned, m.archived, m.muted
+		FROM conversation_members m
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE m.user_id = ? AND m.archived = ? AND ` + conversationFilter
+	args := []interface{}{userID, archived}
+	if after != nil {
+		query += ` AND (m.pinned < ? OR (m.pinned = ? AND (c.last_activity_at < ?
+			OR (c.last_activity_at = ? AND c.id < ?))))`
+		args = append(args, after.Pinned, after.Pinned, after.LastActivityAt, after.LastActivityAt, after.ID)
+	}
+	query += " ORDER BY m.pinned DESC, c.last_activity_at DESC, c.id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.mysqlDB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing conversations: %v", err)
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	var ids, lastIDs []int64
+	for rows.Next() {
+		var c Conversation
+		var key sql.NullString
+		var lastID sql.NullInt64
+		err := rows.Scan(&c.ID, &c.Kind, &c.Name, &key, &lastID, &c.LastSeq, &c.LastActivityAt,
+			&c.LastReadMessageID, &c.Pinned, &c.Archived, &c.Muted)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning conversation: %v", err)
+		}
+		if key.Valid {
+			c.PeerID = directPeer(key.String, userID)
+		}
+		if lastID.Valid {
+			c.LastMessage = &Message{ID: lastID.Int64}
+			lastIDs = append(lastIDs, lastID.Int64)
+		}
+		ids = append(ids, c.ID)
+		conversations = append(conversations, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing conversations: %v", err)
+	}
+
+	messages, err := s.getMessagesByIDs(lastIDs)
+	if err != nil {
+		return nil, err
+	}
+	members, counts, err := s.conversationMembersPreview(ids, maxMemberPreview)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := s.GetUnreadCounts(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		c := &conversations[i]
+		if c.LastMessage != nil {
+			c.LastMessage = messages[c.LastMessage.ID]
+		}
+		c.MemberIDs = members[c.ID]
+		c.MemberCount = counts[c.ID]
+		c.Unread = unread[c.ID]
+	}
+	return conversations, nil
+}
+
+// conversationMembersPreview returns up to limit members of each
+// conversation, first joined first, and the member counts
+func (s *Service) conversationMembersPreview(conversationIDs []int64, limit int) (map[int64][]int, map[int64]int, error) {
+	members := make(map[int64][]int, len(conversationIDs))
+	counts := make(map[int64]int, len(conversationIDs))
+	if len(conversationIDs) == 0 {
+		return members, counts, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(conversationIDs)), ",")
+	args := make([]interface{}, 0, len(conversationIDs)+1)
+	for _, id := range conversationIDs {
+		args = append(args, id)
+	}
+	args = append(args, limit)
+
+	query := `SELECT conversation_id, user_id, member_count FROM (
+		SELECT conversation_id, user_id,
+			ROW_NUMBER() OVER (PARTITION BY conversation_id ORDER BY joined_at, user_id) AS n,
+			COUNT(*) OVER (PARTITION BY conversation_id) AS member_count
+		FROM conversation_members
+		WHERE conversation_id IN (` + placeholders + `)
+	) AS members
+	WHERE n <= ?
+	ORDER BY conversation_id, n`
+	rows, err := s.mysqlDB.Query(query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing conversation members: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var conversationID int64
+		var userID, count int
+		if err := rows.Scan(&conversationID, &userID, &count); err != nil {
+			return nil, nil, fmt.Errorf("error scanning conversation member: %v", err)
+		}
+		members[conversationID] = append(members[conversationID], userID)
+		counts[conversationID] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error listing conversation members: %v", err)
+	}
+	return members, counts, nil
+}
+
+// GetConversation returns the kind, name and peer of a conversation with the
+// user's settings, without its last message or counters. It fails with
+// ErrConversationNotFound unless userID is a member, or for a direct
+// conversation with a user that has a block with them.
+func (s *Service) GetConversation(userID int, conversationID int64) (*Conversation, error) {
+	query := `SELECT c.id, c.kind, c.name, c.direct_key, c.last_seq, c.last_activity_at,
+			m.last_read_message_id, m.pinned, m.archived, m.muted
+		FROM conversation_members m
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE m.user_id = ? AND c.id = ? AND ` + conversationFilter
+	var c Conversation
+	var key sql.NullString
+	err := s.mysqlDB.QueryRow(query, userID, conversationID).Scan(&c.ID, &c.Kind, &c.Name, &key, &c.LastSeq, &c.LastActivityAt,
+		&c.LastReadMessageID, &c.Pinned, &c.Archived, &c.Muted)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrConversationNotFound
+		}
+		return nil, fmt.Errorf("error retrieving conversation: %v", err)
+	}
+	if key.Valid {
+		c.PeerID = directPeer(key.String, userID)
+	}
+	return &c, nil
+}
+
+// ConversationMemberIDs returns the members of a conversation in ascending
+// order
+func (s *Service) ConversationMemberIDs(conversationID int64) ([]int, error) {
+	ids, err := s.queryIDs("SELECT user_id FROM conversation_members WHERE conversation_id = ? ORDER BY user_id", conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing conversation members: %v", err)
+	}
+	return ids, nil
+}
+
+// ListConversationMemberIDs returns the members of a conversation in
+// ascending order. It fails with ErrConversationNotFound unless userID is a
+// member.
+func (s *Service) ListConversationMemberIDs(conversationID int64, userID int) ([]int, error) {
+	ids, err := s.ConversationMemberIDs(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !containsID(ids, userID) {
+		return nil, ErrConversationNotFound
+	}
+	return ids, nil
+}
+
+// SetConversationSetting turns one of a member's conversation settings on or
+// off
+func (s *Service) SetConversationSetting(userID int, conversationID int64, setting string, on bool) error {
+	switch setting {
+	case ConversationPinned, ConversationArchived, ConversationMuted:
+	default:
+		return fmt.Errorf("unknown conversation setting: %s", setting)
+	}
+	// setting is one of the column names checked above
+	query := "UPDATE conversation_members SET " + setting + " = ? WHERE conversation_id = ? AND user_id = ?"
+	res, err := s.mysqlDB.Exec(query, on, conversationID, userID)
+	if err != nil {
+		return fmt.Errorf("error updating conversation: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	// Setting a value that is already set affects no rows
+	var exists int
+	query = "SELECT COUNT(*) FROM conversation_members WHERE conversation_id = ? AND user_id = ?"
+	if err := s.mysqlDB.QueryRow(query, conversationID, userID).Scan(&exists); err != nil {
+		return fmt.Errorf("error retrieving conversation: %v", err)
+	}
+	if exists == 0 {
+		return ErrConversationNotFound
+	}
+	return nil
+}
+
+// IsConversationMuted reports whether a member muted a conversation
+func (s *Service) IsConversationMuted(userID int, conversationID int64) (bool, error) {
+	var muted bool
+	query := "SELECT muted FROM conversation_members WHERE conversation_id = ? AND user_id = ?"
+	err := s.mysqlDB.QueryRow(query, conversationID, userID).Scan(&muted)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("error retrieving conversation: %v", err)
+	}
+	return muted, nil
+}
+
+// ConversationPeerIDs returns the users taking part in the conversations a
+// user is a member of, other than the user themselves
+func (s *Service) ConversationPeerIDs(userID int) ([]int, error) {
+	query := `SELECT DISTINCT o.user_id FROM conversation_members m
+		JOIN conversation_members o ON o.conversation_id = m.conversation_id AND o.user_id <> m.user_id
+		WHERE m.user_id = ?`
+	ids, err := s.queryIDs(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing conversation members: %v", err)
+	}
+	return ids, nil
+}
+
+// dropUnreadCounts drops the cached unread counters of several users
+func (s *Service) dropUnreadCounts(userIDs []int) {
+	if len(userIDs) == 0 {
+		return
+	}
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = unreadKey(id)
+	}
+	s.redisDB.Del(context.Background(), keys...)
+}
+
+// ListMessagesAfterSeq returns the messages of a conversation that were sent
+// or changed after a sequence number, ordered by their LatestSeq, with deleted
+// ones as tombstones. Nothing is returned unless userID is a member, or for a
+// direct conversation with a user that has a block with them.
+func (s *Service) ListMessagesAfterSeq(userID int, conversationID, afterSeq int64, limit int) ([]Message, error) {
+	query := "SELECT " + messageColumns + ` FROM messages
+		WHERE conversation_id = ? AND (seq > ? OR change_seq > ?)
+			AND conversation_id IN (
+				SELECT m.conversation_id FROM conversation_members m
+				JOIN conversations c ON c.id = m.conversation_id
+				WHERE m.user_id = ? AND m.conversation_id = ? AND ` + conversationFilter + `)
+		ORDER BY GREATEST(seq, COALESCE(change_seq, 0))
+		LIMIT ?`
+	rows, err := s.mysqlDB.Query(query, conversationID, afterSeq, afterSeq, userID, conversationID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message: %v", err)
+		}
+		messages = append(messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing messages: %v", err)
+	}
+	return messages, nil
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// GetUserIDByIdentity returns the user linked to an external identity, or 0 if none is
+func (s *Service) GetUserIDByIdentity(provider, subject string) (int, error) {
+	query := "SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?"
+	var userID int
+	if err := s.mysqlDB.QueryRow(query, provider, subject).Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error retrieving identity: %v", err)
+	}
+	return userID, nil
+}
+
+// LinkIdentity links an external identity to a user
+func (s *Service) LinkIdentity(provider, subject string, userID int, email string) error {
+	query := "INSERT INTO user_identities (provider, subject, user_id, email) VALUES (?, ?, ?, ?)"
+	if _, err := s.mysqlDB.Exec(query, provider, subject, userID, email); err != nil {
+		return fmt.Errorf("error linking identity: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ErrSigningKeyExists is returned when another instance already stored the key
+// of the same generation
+var ErrSigningKeyExists = errors.New("signing key generation already exists")
+
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey string // PKCS#8 PEM
+	// Generation numbers the keys of an algorithm. It is unique, so only one
+	// instance can store the next key of a rotation.
+	Generation int64
+	CreatedAt  time.Time
+}
+
+// ListSigningKeys returns the signing keys for an algorithm created after since, newest first
+func (s *Service) ListSigningKeys(algorithm string, since time.Time) ([]SigningKey, error) {
+	query := "SELECT kid, algorithm, private_key, COALESCE(generation, 0), created_at FROM jwt_signing_keys WHERE algorithm = ? AND created_at > ? ORDER BY created_at DESC, kid"
+	rows, err := s.mysqlDB.Query(query, algorithm, since)
+	if err != nil {
+		return nil, fmt.Errorf("error listing signing keys: %v", err)
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		var k SigningKey
+		if err := rows.Scan(&k.ID, &k.Algorithm, &k.PrivateKey, &k.Generation, &k.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning signing key: %v", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing signing keys: %v", err)
+	}
+	return keys, nil
+}
+
+// CreateSigningKey stores a newly generated signing key. It returns
+// ErrSigningKeyExists if a key of the same generation was stored first.
+func (s *Service) CreateSigningKey(key SigningKey) error {
+	query := "INSERT INTO jwt_signing_keys (kid, algorithm, private_key, generation, created_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err := s.mysqlDB.Exec(query, key.ID, key.Algorithm, key.PrivateKey, key.Generation, key.CreatedAt); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return ErrSigningKeyExists
+		}
+		return fmt.Errorf("error creating signing key: %v", err)
+	}
+	return nil
+}
+
+// DeleteSigningKeysBefore removes keys that are past their overlap window
+func (s *Service) DeleteSigningKeysBefore(before time.Time) error {
+	if _, err := s.mysqlDB.Exec("DELETE FROM jwt_signing_keys WHERE created_at <= ?", before); err != nil {
+		return fmt.Errorf("error deleting signing keys: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMessageNotFound is returned when no message matches a lookup
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrNotMessageAuthor is returned when someone else tries to change a message
+	ErrNotMessageAuthor = errors.New("only the author can change a message")
+	// ErrMessageDeleted is returned when changing a deleted message
+	ErrMessageDeleted = errors.New("message was deleted")
+	// ErrEditWindowExpired is returned when a message is too old to change
+	ErrEditWindowExpired = errors.New("message can no longer be changed")
+)
+
+// Message is a message routed through /ws, to a user or a room. ReceiverID is
+// 0 for room messages. SenderID is 0 once the author deleted their account
+// and the message was anonymized. Deleted messages are kept as tombstones
+// with an empty body and DeletedAt set.
+type Message struct {
+	ID             int64 `json:"id"`
+	SenderID       int   `json:"sender_id"`
+	ReceiverID     int   `json:"receiver_id,omitempty"`
+	ConversationID int64 `json:"conversation_id,omitempty"`
+	Seq            int64 `json:"seq,omitempty"`
+	// ChangeSeq is the sequence number of the last edit, deletion or
+	// reaction change. It is 0 for messages that never changed.
+	ChangeSeq int64      `json:"change_seq,omitempty"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// ReplyTo is the message this one answers and ThreadRoot the first
+	// message of its thread. Both are 0 outside threads.
+	ReplyTo    int64 `json:"reply_to,omitempty"`
+	ThreadRoot int64 `json:"thread_root,omitempty"`
+	// ReplyCount and LastReplyAt are maintained on thread roots
+	ReplyCount  int        `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+	// Reactions is only filled in by the history API
+	Reactions   []ReactionSummary `json:"reactions,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+}
+
+// MessageEdit is a previous version of an edited message
+type MessageEdit struct {
+	Body     string    `json:"body"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// | messages | CREATE TABLE `messages` (
+//   `id` bigint NOT NULL AUTO_INCREMENT,
+//   `sender_id` int DEFAULT NULL,
+//   `receiver_id` int DEFAULT NULL,
+//   `conversation_id` bigint DEFAULT NULL,
+//   `seq` bigint DEFAULT NULL,
+//   `change_seq` bigint DEFAULT NULL,
+//   `body` text NOT NULL,
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   `edited_at` timestamp NULL DEFAULT NULL,
+//   `deleted_at` timestamp NULL DEFAULT NULL,
+//   `reply_to` bigint DEFAULT NULL,
+//   `thread_root` bigint DEFAULT NULL,
+//   `reply_count` int NOT NULL DEFAULT '0',
+//   `last_reply_at` timestamp NULL DEFAULT NULL,
+//   PRIMARY KEY (`id`),
+//   KEY `idx_thread_root` (`thread_root`),
+//   KEY `idx_conversation_id` (`conversation_id`,`id`),
+//   UNIQUE KEY `idx_conversation_seq` (`conversation_id`,`seq`),
+//   KEY `idx_conversation_change_seq` (`conversation_id`,`change_seq`),
+//   FULLTEXT KEY `idx_body_fulltext` (`body`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+
+const messageColumns = "id, sender_id, receiver_id, conversation_id, seq, change_seq, body, created_at, edited_at, deleted_at, reply_to, thread_root, reply_count, last_reply_at"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row rowScanner) (*Message, error) {
+	var msg Message
+	var senderID, receiverID, conversationID, seq, changeSeq, replyTo, threadRoot sql.NullInt64
+	var editedAt, deletedAt, lastReplyAt sql.NullTime
+	err := row.Scan(&msg.ID, &senderID, &receiverID, &conversationID, &seq, &changeSeq, &msg.Body, &msg.CreatedAt, &editedAt, &deletedAt,
+		&replyTo, &threadRoot, &msg.ReplyCount, &lastReplyAt)
+	if err != nil {
+		return nil, err
+	}
+	msg.SenderID = int(senderID.Int64)
+	msg.ReceiverID = int(receiverID.Int64)
+	msg.ConversationID = conversationID.Int64
+	msg.Seq = seq.Int64
+	msg.ChangeSeq = changeSeq.Int64
+	msg.ReplyTo = replyTo.Int64
+	msg.ThreadRoot = threadRoot.Int64
+	if lastReplyAt.Valid {
+		msg.LastReplyAt = &lastReplyAt.Time
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		msg.DeletedAt = &deletedAt.Time
+	}
+	return &msg, nil
+}
+
+// LatestSeq is the sequence number of the last change to a message, or of the
+// message itself if it never changed
+func (m *Message) LatestSeq() int64 {
+	return max(m.Seq, m.ChangeSeq)
+}
+
+// nextChangeSeqTx reserves the sequence number of a change to a message, or
+// returns 0 for messages outside conversations. The conversation is locked
+// before the message, in the same order as when replying to it.
+func nextChangeSeqTx(tx *sql.Tx, messageID int64) (int64, error) {
+	var conversationID sql.NullInt64
+	if err := tx.QueryRow("SELECT conversation_id FROM messages WHERE id = ?", messageID).Scan(&conversationID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrMessageNotFound
+		}
+		return 0, fmt.Errorf("error retrieving message: %v", err)
+	}
+	if !conversationID.Valid {
+		return 0, nil
+	}
+	return nextSeqTx(tx, conversationID.Int64)
+}
+
+// insertMessageTx stores msg in its conversation with the next sequence
+// number and the sender's unsent attachments, and makes it the conversation's
+// last message
+func insertMessageTx(tx *sql.Tx, msg *Message, attachmentIDs []string) error {
+	var err error
+	if msg.Seq, err = nextSeqTx(tx, msg.ConversationID); err != nil {
+		return err
+	}
+	query := `INSERT INTO messages (sender_id, receiver_id, conversation_id, seq, body, created_at, reply_to, thread_root)
+		VALUES (?, NULLIF(?, 0), ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0))`
+	res, err := tx.Exec(query, msg.SenderID, msg.ReceiverID, msg.ConversationID, msg.Seq, msg.Body, msg.CreatedAt, msg.ReplyTo, msg.ThreadRoot)
+	if err != nil {
+		return fmt.Errorf("error creating message: %v", err)
+	}
+	if msg.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("error creating message: %v", err)
+	}
+	if err := attachToMessageTx(tx, msg.ID, msg.SenderID, attachmentIDs); err != nil {
+		return err
+	}
+	return recordMessageTx(tx, msg)
+}
+
+// CreateMessage stores a direct message with the sender's unsent attachments
+// and returns it with its ID. The direct conversation of the two users is
+// created with their first message.
+func (s *Service) CreateMessage(senderID, receiverID int, body string, attachmentIDs []string) (*Message, error) {
+	msg := &Message{
+		SenderID:   senderID,
+		ReceiverID: receiverID,
+		Body:       body,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error creating message: %v", err)
+	}
+	defer tx.Rollback()
+
+	if msg.ConversationID, err = directConversationTx(tx, senderID, receiverID); err != nil {
+		return nil, err
+	}
+	if err := insertMessageTx(tx, msg, attachmentIDs); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error creating message: %v", err)
+	}
+	s.messageCreated(msg, []int{senderID, receiverID})
+	return msg, nil
+}
+
+// GetMessage retrieves a message by ID
+func (s *Service) GetMessage(messageID int64) (*Message, error) {
+	row := s.mysqlDB.QueryRow("SELECT "+messageColumns+" FROM messages WHERE id = ?", messageID)
+	msg, err := scanMessage(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMessageNotFound
+		}
+		return nil, fmt.Errorf("error retrieving message: %v", err)
+	}
+	return msg, nil
+}
+
+// getMessagesByIDs loads several messages keyed by ID. Unknown IDs are left
+// out of the result.
+func (s *Service) getMessagesByIDs(ids []int64) (map[int64]*Message, error) {
+	messages := make(map[int64]*Message, len(ids))
+	if len(ids) == 0 {
+		return messages, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := s.mysqlDB.Query("SELECT "+messageColumns+" FROM messages WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving messages: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message: %v", err)
+		}
+		messages[msg.ID] = msg
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error retrieving messages: %v", err)
+	}
+	return messages, nil
+}
+
+// lockAuthoredMessage loads a message for update and checks that authorID may
+// still change it
+func lockAuthoredMessage(tx *sql.Tx, messageID int64, authorID int, window time.Duration, now time.Time) (*Message, error) {
+	row := tx.QueryRow("SELECT "+messageColumns+" FROM messages WHERE id = ? FOR UPDATE", messageID)
+	msg, err := scanMessage(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMessageNotFound
+		}
+		return nil, fmt.Errorf("error retrieving message: %v", err)
+	}
+	if msg.SenderID != authorID {
+		return nil, ErrNotMessageAuthor
+	}
+	if msg.DeletedAt != nil {
+		return nil, ErrMessageDeleted
+	}
+	if now.Sub(msg.CreatedAt) > window {
+		return nil, ErrEditWindowExpired
+	}
+	return msg, nil
+}
+
+// EditMessage replaces the body of a message. The previous body is kept in
+// the edit history. Only the author can edit, within window of sending. The
+// edit takes the next sequence number of the conversation as ChangeSeq.
+func (s *Service) EditMessage(messageID int64, authorID int, body string, window time.Duration) (*Message, error) {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error editing message: %v", err)
+	}
+	defer tx.Rollback()
+
+	changeSeq, err := nextChangeSeqTx(tx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	msg, err := lockAuthoredMessage(tx, messageID, authorID, window, now)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO message_edits (message_id, body, edited_at) VALUES (?, ?, ?)", messageID, msg.Body, now); err != nil {
+		return nil, fmt.Errorf("error saving message history: %v", err)
+	}
+	query := "UPDATE messages SET body = ?, edited_at = ?, change_seq = NULLIF(?, 0) WHERE id = ?"
+	if _, err := tx.Exec(query, body, now, changeSeq, messageID); err != nil {
+		return nil, fmt.Errorf("error editing message: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error editing message: %v", err)
+	}
+
+	msg.Body = body
+	msg.EditedAt = &now
+	msg.ChangeSeq = changeSeq
+	return msg, nil
+}
+
+// DeleteMessage turns a message into a tombstone: the body, its edit history
+// and its reactions are removed and deleted_at is set. Only the author can delete,
+// within window of sending. Like an edit, the deletion takes a ChangeSeq. For
+// a reply, the thread root is recounted and returned as well.
+func (s *Service) DeleteMessage(messageID int64, authorID int, window time.Duration) (msg, root *Message, err error) {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deleting message: %v", err)
+	}
+	defer tx.Rollback()
+
+	changeSeq, err := nextChangeSeqTx(tx, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	msg, err = lockAuthoredMessage(tx, messageID, authorID, window, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM message_edits WHERE message_id = ?", messageID); err != nil {
+		return nil, nil, fmt.Errorf("error deleting message history: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM message_reactions WHERE message_id = ?", messageID); err != nil {
+		return nil, nil, fmt.Errorf("error deleting message reactions: %v", err)
+	}
+	query := "UPDATE messages SET body = '', deleted_at = ?, change_seq = NULLIF(?, 0) WHERE id = ?"
+	if _, err := tx.Exec(query, now, changeSeq, messageID); err != nil {
+		return nil, nil, fmt.Errorf("error deleting message: %v", err)
+	}
+	if msg.ThreadRoot != 0 {
+		if root, err = refreshThreadRootTx(tx, msg.ThreadRoot); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("error deleting message: %v", err)
+	}
+
+	msg.Body = ""
+	msg.DeletedAt = &now
+	msg.ChangeSeq = changeSeq
+	// An unread message no longer counts once deleted. The message is gone
+	// either way, so a failing cache update is only logged.
+	if msg.ConversationID == 0 || msg.ReceiverID == msg.SenderID {
+		return msg, root, nil
+	}
+	if msg.ReceiverID == 0 {
+		// Room members recount their unread messages on the next read
+		memberIDs, err := s.ConversationMemberIDs(msg.ConversationID)
+		if err != nil {
+			log.Printf("Error dropping unread counts of conversation %d: %v", msg.ConversationID, err)
+			return msg, root, nil
+		}
+		s.dropUnreadCounts(memberIDs)
+		return msg, root, nil
+	}
+	if _, err := s.refreshUnread(msg.ReceiverID, msg.ConversationID); err != nil {
+		log.Printf("Error refreshing unread count of user %d: %v", msg.ReceiverID, err)
+	}
+	return msg, root, nil
+}
+
+// ListMessageEdits returns the previous versions of a message, oldest first
+func (s *Service) ListMessageEdits(messageID int64) ([]MessageEdit, error) {
+	rows, err := s.mysqlDB.Query("SELECT body, edited_at FROM message_edits WHERE message_id = ? ORDER BY id", messageID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing message history: %v", err)
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.Body, &edit.EditedAt); err != nil {
+			return nil, fmt.Errorf("error scanning message history: %v", err)
+		}
+		edits = append(edits, edit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing message history: %v", err)
+	}
+	return edits, nil
+}
+
+// ListConversationMessages returns the messages of a conversation, newest
+// first, with deleted ones as tombstones. beforeID pages backwards; pass 0 for
+// the newest messages. Nothing is returned unless userID is a member, or for a
+// direct conversation with a user that has a block with them.
+func (s *Service) ListConversationMessages(userID int, conversationID, beforeID int64, limit int) ([]Message, error) {
+	query := "SELECT " + messageColumns + ` FROM messages
+		WHERE conversation_id = ? AND (? = 0 OR id < ?)
+			AND conversation_id IN (
+				SELECT m.conversation_id FROM conversation_members m
+				JOIN conversations c ON c.id = m.conversation_id
+				WHERE m.user_id = ? AND m.conversation_id = ? AND ` + conversationFilter + `)
+		ORDER BY id DESC
+		LIMIT ?`
+	rows, err := s.mysqlDB.Query(query, conversationID, beforeID, beforeID, userID, conversationID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message: %v", err)
+		}
+		messages = append(messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing messages: %v", err)
+	}
+	return messages, nil
+}
+
+// ListDirectMessages returns the messages between two users, newest first.
+// beforeID pages backwards; pass 0 for the newest messages.
+func (s *Service) ListDirectMessages(userID, otherID int, beforeID int64, limit int) ([]Message, error) {
+	query := "SELECT " + messageColumns + ` FROM messages
+		WHERE ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))
+			AND (? = 0 OR id < ?)
+		ORDER BY id DESC
+		LIMIT ?`
+	rows, err := s.mysqlDB.Query(query, userID, otherID, otherID, userID, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message: %v", err)
+		}
+		messages = append(messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing messages: %v", err)
+	}
+	return messages, nil
+}
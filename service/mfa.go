@@ -0,0 +1,76 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+type MFA struct {
+	UserID  int
+	Secret  string
+	Enabled bool
+}
+
+// SetPendingMFASecret stores a new TOTP secret for the user. It replaces any
+// earlier pending secret but refuses to overwrite an enabled one.
+func (s *Service) SetPendingMFASecret(userID int, secret string) error {
+	query := `INSERT INTO user_mfa (user_id, secret, enabled) VALUES (?, ?, 0)
+		ON DUPLICATE KEY UPDATE secret = IF(enabled, secret, VALUES(secret))`
+	if _, err := s.mysqlDB.Exec(query, userID, secret); err != nil {
+		return fmt.Errorf("error storing mfa secret: %v", err)
+	}
+	return nil
+}
+
+// GetMFA returns the user's TOTP settings, or nil if they never enrolled
+func (s *Service) GetMFA(userID int) (*MFA, error) {
+	query := "SELECT user_id, secret, enabled FROM user_mfa WHERE user_id = ?"
+	var mfa MFA
+	if err := s.mysqlDB.QueryRow(query, userID).Scan(&mfa.UserID, &mfa.Secret, &mfa.Enabled); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error retrieving mfa: %v", err)
+	}
+	return &mfa, nil
+}
+
+// EnableMFA turns on two-factor authentication and replaces the user's recovery codes
+func (s *Service) EnableMFA(userID int, recoveryCodeHashes []string) error {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return fmt.Errorf("error enabling mfa: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE user_mfa SET enabled = 1 WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error enabling mfa: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error clearing recovery codes: %v", err)
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec("INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return fmt.Errorf("error storing recovery code: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error enabling mfa: %v", err)
+	}
+	return nil
+}
+
+// UseRecoveryCode marks a recovery code as used. It reports false if the code
+// does not exist or was already used.
+func (s *Service) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	query := "UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL"
+	res, err := s.mysqlDB.Exec(query, userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("error using recovery code: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error using recovery code: %v", err)
+	}
+	return n == 1, nil
+}
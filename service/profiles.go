@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	profileKeyPrefix = "user:profile:"
+	profileCacheTTL  = 10 * time.Minute
+)
+
+func profileKey(userID int) string {
+	return profileKeyPrefix + strconv.Itoa(userID)
+}
+
+// GetUserForLogin retrieves a user by email including the password hash, in a
+// single query
+func (s *Service) GetUserForLogin(email string) (*User, error) {
+	query := "SELECT id, email, password, name, profile_url, status_text, role, disabled FROM users WHERE email = ?"
+	var user User
+	err := s.mysqlDB.QueryRow(query, email).Scan(&user.ID, &user.Email, &user.Password, &user.Name, &user.ProfileURL, &user.StatusText, &user.Role, &user.Disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("error retrieving user: %v", err)
+	}
+	return &user, nil
+}
+
+// GetUsersByIDs retrieves several users in one query, without their password
+// hashes. Unknown IDs are left out of the result.
+func (s *Service) GetUsersByIDs(userIDs []int) ([]User, error) {
+	if len(userIDs) == 0 {
+		return []User{}, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(userIDs)), ",")
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+
+	query := "SELECT id, email, name, profile_url, status_text, role, disabled, discoverable, dm_policy FROM users WHERE id IN (" + placeholders + ")"
+	rows, err := s.mysqlDB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving users: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, len(userIDs))
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Email, &user.Name, &user.ProfileURL, &user.StatusText, &user.Role, &user.Disabled, &user.Discoverable, &user.DMPolicy); err != nil {
+			return nil, fmt.Errorf("error scanning user: %v", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error retrieving users: %v", err)
+	}
+	return users, nil
+}
+
+// GetUserProfile returns a user's public profile through the Redis cache
+func (s *Service) GetUserProfile(userID int) (*User, error) {
+	profiles, err := s.GetUserProfiles([]int{userID})
+	user, ok := profiles[userID]
+	if !ok && err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+// GetUserProfiles returns public profiles keyed by user ID. Cached profiles are
+// read from Redis, the rest are loaded with one query and cached. A failing
+// cache falls back to MySQL. If MySQL fails the cached profiles are still
+// returned together with the error.
+func (s *Service) GetUserProfiles(userIDs []int) (map[int]User, error) {
+	profiles := make(map[int]User, len(userIDs))
+	if len(userIDs) == 0 {
+		return profiles, nil
+	}
+	ctx := context.Background()
+
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = profileKey(id)
+	}
+	cached, err := s.redisDB.MGet(ctx, keys...).Result()
+	if err != nil {
+		cached = make([]interface{}, len(userIDs))
+	}
+
+	var missing []int
+	for i, val := range cached {
+		var user User
+		if str, ok := val.(string); ok && json.Unmarshal([]byte(str), &user) == nil {
+			profiles[userIDs[i]] = user
+			continue
+		}
+		missing = append(missing, userIDs[i])
+	}
+	if len(missing) == 0 {
+		return profiles, nil
+	}
+
+	users, err := s.GetUsersByIDs(missing)
+	if err != nil {
+		return profiles, err
+	}
+	pipe := s.redisDB.Pipeline()
+	for _, user := range users {
+		id, _ := strconv.Atoi(user.ID)
+		profiles[id] = user
+		if data, err := json.Marshal(user); err == nil {
+			pipe.Set(ctx, profileKey(id), data, profileCacheTTL)
+		}
+	}
+	// The cache is best effort, the profiles were already loaded from MySQL
+	pipe.Exec(ctx)
+	return profiles, nil
+}
+
+// InvalidateUserProfile drops a cached profile after the user row changed
+func (s *Service) InvalidateUserProfile(userID int) error {
+	if err := s.redisDB.Del(context.Background(), profileKey(userID)).Err(); err != nil {
+		return fmt.Errorf("error invalidating profile cache: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTooManyReactions is returned when a message already has the maximum
+// number of distinct reactions
+var ErrTooManyReactions = errors.New("too many different reactions on this message")
+
+// ReactionSummary aggregates the reactions with one emoji on a message.
+// Reacted tells whether the viewing user is one of them.
+type ReactionSummary struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted,omitempty"`
+}
+
+// | message_reactions | CREATE TABLE `message_reactions` (
+//   `message_id` bigint NOT NULL,
+//   `user_id` int NOT NULL,
+//   `emoji` varchar(32) NOT NULL,
+//   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`message_id`,`user_id`,`emoji`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin |
+
+// AddReaction adds a user's reaction to a message. A message can carry at
+// most maxDistinct different emoji; reacting with one already present always
+// works. The new reaction takes the next sequence number of the conversation
+// as the message's ChangeSeq, which is returned. It is 0 when the user had
+// already reacted with the emoji.
+func (s *Service) AddReaction(messageID int64, userID int, emoji string, maxDistinct int) (int64, error) {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error adding reaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	changeSeq, err := nextChangeSeqTx(tx, messageID)
+	if err != nil {
+		return 0, err
+	}
+	// Lock the message so concurrent reactions cannot exceed the cap
+	var locked int64
+	if err := tx.QueryRow("SELECT id FROM messages WHERE id = ? FOR UPDATE", messageID).Scan(&locked); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrMessageNotFound
+		}
+		return 0, fmt.Errorf("error adding reaction: %v", err)
+	}
+
+	var distinct, present int
+	query := "SELECT COUNT(DISTINCT emoji), COALESCE(SUM(emoji = ?), 0) FROM message_reactions WHERE message_id = ?"
+	if err := tx.QueryRow(query, emoji, messageID).Scan(&distinct, &present); err != nil {
+		return 0, fmt.Errorf("error counting reactions: %v", err)
+	}
+	if present == 0 && distinct >= maxDistinct {
+		return 0, ErrTooManyReactions
+	}
+
+	res, err := tx.Exec("INSERT IGNORE INTO message_reactions (message_id, user_id, emoji) VALUES (?, ?, ?)", messageID, userID, emoji)
+	if err != nil {
+		return 0, fmt.Errorf("error adding reaction: %v", err)
+	}
+	// Nothing changed, the rollback gives the sequence number back
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return 0, nil
+	}
+	if err := setChangeSeqTx(tx, messageID, changeSeq); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error adding reaction: %v", err)
+	}
+	return changeSeq, nil
+}
+
+// RemoveReaction removes a user's reaction from a message. Like adding one,
+// it returns the message's new ChangeSeq, or 0 when there was no such reaction.
+func (s *Service) RemoveReaction(messageID int64, userID int, emoji string) (int64, error) {
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error removing reaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	changeSeq, err := nextChangeSeqTx(tx, messageID)
+	if err != nil {
+		return 0, err
+	}
+	query := "DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?"
+	res, err := tx.Exec(query, messageID, userID, emoji)
+	if err != nil {
+		return 0, fmt.Errorf("error removing reaction: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return 0, nil
+	}
+	if err := setChangeSeqTx(tx, messageID, changeSeq); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error removing reaction: %v", err)
+	}
+	return changeSeq, nil
+}
+
+// setChangeSeqTx records the sequence number of a change to a message
+func setChangeSeqTx(tx *sql.Tx, messageID, changeSeq int64) error {
+	if _, err := tx.Exec("UPDATE messages SET change_seq = NULLIF(?, 0) WHERE id = ?", changeSeq, messageID); err != nil {
+		return fmt.Errorf("error updating message: %v", err)
+	}
+	return nil
+}
+
+// GetReactionSummaries returns the reactions of several messages grouped by
+// emoji, in the order each emoji was first used. viewerID marks the viewer's
+// own reactions; pass 0 for none.
+func (s *Service) GetReactionSummaries(messageIDs []int64, viewerID int) (map[int64][]ReactionSummary, error) {
+	summaries := make(map[int64][]ReactionSummary, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return summaries, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIDs)), ",")
+	args := make([]interface{}, 0, len(messageIDs)+1)
+	args = append(args, viewerID)
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	query := `SELECT message_id, emoji, COUNT(*), MAX(user_id = ?)
+		FROM message_reactions
+		WHERE message_id IN (` + placeholders + `)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at), emoji`
+	rows, err := s.mysqlDB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving reactions: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var summary ReactionSummary
+		if err := rows.Scan(&messageID, &summary.Emoji, &summary.Count, &summary.Reacted); err != nil {
+			return nil, fmt.Errorf("error scanning reactions: %v", err)
+		}
+		summaries[messageID] = append(summaries[messageID], summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error retrieving reactions: %v", err)
+	}
+	return summaries, nil
+}
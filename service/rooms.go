@@ -0,0 +1,119 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// CreateRoom creates a named conversation with the creator and the given
+// members. Callers check that the members may be added.
+func (s *Service) CreateRoom(creatorID int, name string, memberIDs []int) (*Conversation, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error creating room: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO conversations (kind, name, created_by, last_activity_at, created_at) VALUES (?, ?, ?, ?, ?)"
+	res, err := tx.Exec(query, ConversationRoom, name, creatorID, now, now)
+	if err != nil {
+		return nil, fmt.Errorf("error creating room: %v", err)
+	}
+	room := &Conversation{
+		Kind:           ConversationRoom,
+		Name:           name,
+		LastActivityAt: now,
+	}
+	if room.ID, err = res.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("error creating room: %v", err)
+	}
+
+	for _, userID := range append([]int{creatorID}, memberIDs...) {
+		query = "INSERT IGNORE INTO conversation_members (conversation_id, user_id, joined_at) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(query, room.ID, userID, now); err != nil {
+			return nil, fmt.Errorf("error adding room member: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error creating room: %v", err)
+	}
+
+	room.MemberIDs, room.MemberCount, err = s.roomMembersPreview(room.ID)
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// roomMembersPreview returns the first members of a single conversation and
+// its member count
+func (s *Service) roomMembersPreview(conversationID int64) ([]int, int, error) {
+	members, counts, err := s.conversationMembersPreview([]int64{conversationID}, maxMemberPreview)
+	if err != nil {
+		return nil, 0, err
+	}
+	return members[conversationID], counts[conversationID], nil
+}
+
+// roomMembersTx returns the members of a room, locking the membership until
+// the transaction ends. It fails with ErrConversationNotFound unless the
+// conversation is a room and userID is a member.
+func roomMembersTx(tx *sql.Tx, conversationID int64, userID int) ([]int, error) {
+	query := `SELECT m.user_id FROM conversations c
+		JOIN conversation_members m ON m.conversation_id = c.id
+		WHERE c.id = ? AND c.kind = ?
+		ORDER BY m.user_id
+		FOR SHARE`
+	rows, err := tx.Query(query, conversationID, ConversationRoom)
+	if err != nil {
+		return nil, fmt.Errorf("error listing room members: %v", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning room member: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing room members: %v", err)
+	}
+	if !containsID(ids, userID) {
+		return nil, ErrConversationNotFound
+	}
+	return ids, nil
+}
+
+// CreateRoomMessage stores a message to a room with the sender's unsent
+// attachments and returns it with its ID. The sender must be a member.
+func (s *Service) CreateRoomMessage(senderID int, conversationID int64, body string, attachmentIDs []string) (*Message, error) {
+	msg := &Message{
+		SenderID:       senderID,
+		ConversationID: conversationID,
+		Body:           body,
+		CreatedAt:      time.Now().UTC().Truncate(time.Second),
+	}
+
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error creating message: %v", err)
+	}
+	defer tx.Rollback()
+
+	memberIDs, err := roomMembersTx(tx, conversationID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertMessageTx(tx, msg, attachmentIDs); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error creating message: %v", err)
+	}
+	s.messageCreated(msg, memberIDs)
+	return msg, nil
+}
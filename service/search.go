@@ -0,0 +1,200 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Discoverability settings. email_only users can only be found by their exact
+// email address, nobody users not at all.
+const (
+	DiscoverableEveryone  = "everyone"
+	DiscoverableEmailOnly = "email_only"
+	DiscoverableNobody    = "nobody"
+)
+
+// Search match ranks, best first
+const (
+	SearchRankEmail = iota
+	SearchRankPrefix
+	SearchRankWord
+	SearchRankFuzzy
+)
+
+// minFuzzyQueryLength keeps short queries from matching half the directory
+const minFuzzyQueryLength = 3
+
+// UserSearchHit is a user found by the directory search together with how
+// well they matched
+type UserSearchHit struct {
+	User User
+	Rank int
+}
+
+// UserSearchCursor points after the last hit of the previous page
+type UserSearchCursor struct {
+	Rank   int
+	UserID int
+}
+
+// escapeLike escapes the LIKE wildcards in a user supplied string
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchTerms splits a query into the words it searches for. Punctuation and
+// FULLTEXT operators are dropped.
+func SearchTerms(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// fulltextPrefixQuery turns a query into a boolean mode FULLTEXT query that
+// requires every word as a prefix. Operators are stripped from the input.
+func fulltextPrefixQuery(query string) string {
+	words := SearchTerms(query)
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = "+" + word + "*"
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchUsers finds users by name or email, ranked by exact email match, name
+// prefix, word prefix and finally sound-alike first name. Emails only match
+// exactly, partial matches would let callers enumerate addresses. Privacy
+// settings are applied here: only the exact email can find email_only users
+// and nobody users never appear. Disabled users, the caller and users with a
+// block between them and the caller are left out.
+// Hits are ordered by rank and ID so pages can continue from a cursor.
+func (s *Service) SearchUsers(callerID int, query string, after UserSearchCursor, limit int) ([]UserSearchHit, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return []UserSearchHit{}, nil
+	}
+	prefix := escapeLike(query) + "%"
+	fulltext := fulltextPrefixQuery(query)
+	firstWord := strings.Fields(query)[0]
+	fuzzy := len(firstWord) >= minFuzzyQueryLength
+
+	sqlQuery := `SELECT id, name, profile_url, status_text, rnk FROM (
+		SELECT id, name, profile_url, status_text,
+			CASE
+				WHEN email = ? AND discoverable IN (?, ?) THEN ?
+				WHEN discoverable <> ? THEN NULL
+				WHEN name LIKE ? THEN ?
+				WHEN ? <> '' AND MATCH(name) AGAINST (? IN BOOLEAN MODE) THEN ?
+				WHEN ? AND SOUNDEX(SUBSTRING_INDEX(name, ' ', 1)) = SOUNDEX(?) THEN ?
+			END AS rnk
+		FROM users
+		WHERE disabled = 0 AND id <> ?
+			AND id NOT IN (SELECT blocked_id FROM user_blocks WHERE user_id = ?)
+			AND id NOT IN (SELECT user_id FROM user_blocks WHERE blocked_id = ?)
+	) AS hits
+	WHERE rnk IS NOT NULL AND (rnk > ? OR (rnk = ? AND id > ?))
+	ORDER BY rnk, id
+	LIMIT ?`
+	rows, err := s.mysqlDB.Query(sqlQuery,
+		query, DiscoverableEveryone, DiscoverableEmailOnly, SearchRankEmail,
+		DiscoverableEveryone,
+		prefix, SearchRankPrefix,
+		fulltext, fulltext, SearchRankWord,
+		fuzzy, firstWord, SearchRankFuzzy,
+		callerID, callerID, callerID,
+		after.Rank, after.Rank, after.UserID,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error searching users: %v", err)
+	}
+	defer rows.Close()
+
+	hits := []UserSearchHit{}
+	for rows.Next() {
+		var hit UserSearchHit
+		if err := rows.Scan(&hit.User.ID, &hit.User.Name, &hit.User.ProfileURL, &hit.User.StatusText, &hit.Rank); err != nil {
+			return nil, fmt.Errorf("error scanning user: %v", err)
+		}
+		hits = append(hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error searching users: %v", err)
+	}
+	return hits, nil
+}
+
+// MessageSearchFilter narrows a message search. Zero values do not filter.
+type MessageSearchFilter struct {
+	ConversationID int64
+	SenderID       int
+	// Since and Until bound the time a message was sent. Since is inclusive,
+	// Until exclusive.
+	Since time.Time
+	Until time.Time
+	// BeforeID pages backwards from a message ID
+	BeforeID int64
+}
+
+// SearchMessages finds messages containing every word of query as a prefix,
+// newest first, in the conversations userID is a member of. Deleted messages,
+// messages from users with a block with userID and direct conversations with
+// them are never returned.
+func (s *Service) SearchMessages(userID int, query string, filter MessageSearchFilter, limit int) ([]Message, error) {
+	fulltext := fulltextPrefixQuery(query)
+	if fulltext == "" {
+		return []Message{}, nil
+	}
+
+	sqlQuery := "SELECT " + messageColumns + ` FROM messages
+		WHERE MATCH(body) AGAINST (? IN BOOLEAN MODE)
+			AND deleted_at IS NULL
+			AND conversation_id IN (
+				SELECT m.conversation_id FROM conversation_members m
+				JOIN conversations c ON c.id = m.conversation_id
+				WHERE m.user_id = ? AND ` + conversationFilter + `)
+			AND (sender_id IS NULL OR (
+				sender_id NOT IN (SELECT blocked_id FROM user_blocks WHERE user_id = ?)
+				AND sender_id NOT IN (SELECT user_id FROM user_blocks WHERE blocked_id = ?)))
+			AND (? = 0 OR conversation_id = ?)
+			AND (? = 0 OR sender_id = ?)
+			AND (? = 0 OR id < ?)`
+	args := []interface{}{
+		fulltext,
+		userID,
+		userID, userID,
+		filter.ConversationID, filter.ConversationID,
+		filter.SenderID, filter.SenderID,
+		filter.BeforeID, filter.BeforeID,
+	}
+	if !filter.Since.IsZero() {
+		sqlQuery += " AND created_at >= ?"
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		sqlQuery += " AND created_at < ?"
+		args = append(args, filter.Until)
+	}
+	sqlQuery += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+	rows, err := s.mysqlDB.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning message: %v", err)
+		}
+		messages = append(messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error searching messages: %v", err)
+	}
+	return messages, nil
+}
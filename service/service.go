@@ -3,12 +3,16 @@ package service
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrUserNotFound is returned when no user matches a lookup
+var ErrUserNotFound = errors.New("user not found")
+
 type Service struct {
 	mysqlDB *sql.DB
 	redisDB *redis.Client
@@ -28,10 +32,17 @@ func NewService(
 
 type User struct {
 	ID         string `json:"id"`
-	Email      string `json:"email"`
-	Password   string `json:"password"`
+	Email      string `json:"email,omitempty"`
+	Password   string `json:"password,omitempty"`
 	Name       string `json:"name"`
 	ProfileURL string `json:"profile_url"`
+	StatusText string `json:"status_text"`
+	Role       string `json:"role"`
+	Disabled   bool   `json:"disabled"`
+	// Discoverable controls who can find the user in the directory search
+	Discoverable string `json:"discoverable,omitempty"`
+	// DMPolicy controls who can send the user direct messages
+	DMPolicy string `json:"dm_policy,omitempty"`
 }
 
 // | Table | Create Table                                                                                                                                                                                                                                                                                                                       |
@@ -42,8 +53,14 @@ type User struct {
 //   `password` varchar(255) NOT NULL,
 //   `name` varchar(255) NOT NULL,
 //   `profile_url` varchar(255) NOT NULL,
+//   `status_text` varchar(140) NOT NULL DEFAULT '',
+//   `role` varchar(32) NOT NULL DEFAULT 'user',
+//   `disabled` tinyint(1) NOT NULL DEFAULT '0',
+//   `discoverable` varchar(16) NOT NULL DEFAULT 'everyone',
+//   `dm_policy` varchar(16) NOT NULL DEFAULT 'everyone',
 //   PRIMARY KEY (`id`),
-//   UNIQUE KEY `idx_email` (`email`)
+//   UNIQUE KEY `idx_email` (`email`),
+//   FULLTEXT KEY `idx_name_fulltext` (`name`)
 // ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
 
 // CreateUser inserts a new user into the database
@@ -58,13 +75,13 @@ func (s *Service) CreateUser(user User) error {
 
 // GetUserByID retrieves a user by ID from the database
 func (s *Service) GetUserByID(userID int) (*User, error) {
-	query := "SELECT id, email, password, name, profile_url FROM users WHERE id = ?"
+	query := "SELECT id, email, password, name, profile_url, status_text, role, disabled, discoverable, dm_policy FROM users WHERE id = ?"
 	row := s.mysqlDB.QueryRow(query, userID)
 
 	var user User
-	if err := row.Scan(&user.ID, &user.Email, &user.Password, &user.Name, &user.ProfileURL); err != nil {
+	if err := row.Scan(&user.ID, &user.Email, &user.Password, &user.Name, &user.ProfileURL, &user.StatusText, &user.Role, &user.Disabled, &user.Discoverable, &user.DMPolicy); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("error retrieving user: %v", err)
 	}
@@ -80,7 +97,7 @@ func (s *Service) GetUserByEmail(email string) (int, error) {
 	err := row.Scan(&UserID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("user not found")
+			return 0, ErrUserNotFound
 		}
 		return 0, fmt.Errorf("error retrieving user: %v", err)
 	}
@@ -101,4 +118,57 @@ func (s *Service) SetRedisData(key, value string, expiration time.Duration) erro
 		return fmt.Errorf("error setting data in redis: %v", err)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// IncrRedisCounter increments a counter and refreshes its expiry, returning the new value
+func (s *Service) IncrRedisCounter(key string, expiration time.Duration) (int64, error) {
+	ctx := context.Background()
+	pipe := s.redisDB.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, expiration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("error incrementing counter in redis: %v", err)
+	}
+	return incr.Val(), nil
+}
+
+// GetRedisTTL returns the remaining time to live of a key, or zero if it does not exist
+func (s *Service) GetRedisTTL(key string) (time.Duration, error) {
+	ttl, err := s.redisDB.TTL(context.Background(), key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("error getting ttl from redis: %v", err)
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (s *Service) DeleteRedisData(keys ...string) error {
+	err := s.redisDB.Del(context.Background(), keys...).Err()
+	if err != nil {
+		return fmt.Errorf("error deleting data from redis: %v", err)
+	}
+	return nil
+}
+
+// SetRedisDataNX sets a key only if it does not exist yet, reporting whether it was set
+func (s *Service) SetRedisDataNX(key, value string, expiration time.Duration) (bool, error) {
+	ok, err := s.redisDB.SetNX(context.Background(), key, value, expiration).Result()
+	if err != nil {
+		return false, fmt.Errorf("error setting data in redis: %v", err)
+	}
+	return ok, nil
+}
+
+// GetRedisDataAndDelete reads a key and removes it in one step, so the value can only be used once
+func (s *Service) GetRedisDataAndDelete(key string) (string, error) {
+	val, err := s.redisDB.GetDel(context.Background(), key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", nil
+		}
+		return "", fmt.Errorf("error getting data from redis: %v", err)
+	}
+	return val, nil
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	sessionKeyPrefix      = "session:"
+	userSessionsKeyPrefix = "user:sessions:"
+)
+
+// Session is a single login of a user on a device
+type Session struct {
+	ID               string    `json:"id"`
+	UserID           int       `json:"user_id"`
+	DeviceName       string    `json:"device_name"`
+	UserAgent        string    `json:"user_agent"`
+	IP               string    `json:"ip"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastUsedAt       time.Time `json:"last_used_at"`
+	RefreshTokenHash string    `json:"refresh_token_hash,omitempty"`
+}
+
+func userSessionsKey(userID int) string {
+	return userSessionsKeyPrefix + strconv.Itoa(userID)
+}
+
+// CreateSession stores a session and indexes it under its user. The session
+// expires together with its refresh token.
+func (s *Service) CreateSession(session Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("error encoding session: %v", err)
+	}
+	ctx := context.Background()
+	pipe := s.redisDB.TxPipeline()
+	pipe.Set(ctx, sessionKeyPrefix+session.ID, data, ttl)
+	pipe.SAdd(ctx, userSessionsKey(session.UserID), session.ID)
+	pipe.Expire(ctx, userSessionsKey(session.UserID), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error creating session: %v", err)
+	}
+	return nil
+}
+
+// GetSession returns a session by ID, or nil if it expired or was revoked
+func (s *Service) GetSession(sessionID string) (*Session, error) {
+	data, err := s.redisDB.Get(context.Background(), sessionKeyPrefix+sessionID).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting session: %v", err)
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("error decoding session: %v", err)
+	}
+	return &session, nil
+}
+
+// TouchSession records that a session was used, keeping its remaining lifetime
+func (s *Service) TouchSession(session Session) error {
+	session.LastUsedAt = time.Now()
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("error encoding session: %v", err)
+	}
+	err = s.redisDB.SetArgs(context.Background(), sessionKeyPrefix+session.ID, data, redis.SetArgs{KeepTTL: true, Mode: "XX"}).Err()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("error updating session: %v", err)
+	}
+	return nil
+}
+
+// ListSessions returns the user's live sessions, most recently used first
+func (s *Service) ListSessions(userID int) ([]Session, error) {
+	ctx := context.Background()
+	ids, err := s.redisDB.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %v", err)
+	}
+
+	sessions := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := s.GetSession(id)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			// Expired sessions linger in the index until the next listing
+			s.redisDB.SRem(ctx, userSessionsKey(userID), id)
+			continue
+		}
+		session.RefreshTokenHash = ""
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// DeleteSession revokes a session so its refresh token stops working
+func (s *Service) DeleteSession(userID int, sessionID string) error {
+	ctx := context.Background()
+	pipe := s.redisDB.TxPipeline()
+	pipe.Del(ctx, sessionKeyPrefix+sessionID)
+	pipe.SRem(ctx, userSessionsKey(userID), sessionID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error deleting session: %v", err)
+	}
+	return nil
+}
+
+// DeleteUserSessions revokes every session of a user
+func (s *Service) DeleteUserSessions(userID int) error {
+	return s.DeleteUserSessionsExcept(userID, "")
+}
+
+// DeleteUserSessionsExcept revokes every session of a user except the one with
+// ID keep, typically the session that made the request
+func (s *Service) DeleteUserSessionsExcept(userID int, keep string) error {
+	ctx := context.Background()
+	ids, err := s.redisDB.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return fmt.Errorf("error listing sessions: %v", err)
+	}
+	pipe := s.redisDB.TxPipeline()
+	for _, id := range ids {
+		if id == keep {
+			continue
+		}
+		pipe.Del(ctx, sessionKeyPrefix+id)
+		pipe.SRem(ctx, userSessionsKey(userID), id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error deleting sessions: %v", err)
+	}
+	return nil
+}
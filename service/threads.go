@@ -0,0 +1,138 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// | thread_participants | CREATE TABLE `thread_participants` (
+//   `root_id` bigint NOT NULL,
+//   `user_id` int NOT NULL,
+//   `joined_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//   PRIMARY KEY (`root_id`,`user_id`),
+//   KEY `idx_user_id` (`user_id`)
+// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci |
+
+// CreateReply stores a message answering parent, with the sender's unsent
+// attachments. Replies to a direct message go to receiverID, replies in a room
+// to the parent's room with receiverID 0. The reply joins the parent's
+// thread, or starts one rooted at parent. The root's reply count and last
+// reply time are updated and the sender and root author become thread
+// participants. The updated root is returned with the reply.
+func (s *Service) CreateReply(senderID, receiverID int, body string, attachmentIDs []string, parent *Message) (reply, root *Message, err error) {
+	rootID := parent.ThreadRoot
+	if rootID == 0 {
+		rootID = parent.ID
+	}
+	reply = &Message{
+		SenderID:   senderID,
+		ReceiverID: receiverID,
+		Body:       body,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+		ReplyTo:    parent.ID,
+		ThreadRoot: rootID,
+	}
+
+	tx, err := s.mysqlDB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating reply: %v", err)
+	}
+	defer tx.Rollback()
+
+	var memberIDs []int
+	if receiverID == 0 {
+		reply.ConversationID = parent.ConversationID
+		if memberIDs, err = roomMembersTx(tx, reply.ConversationID, senderID); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if reply.ConversationID, err = directConversationTx(tx, senderID, receiverID); err != nil {
+			return nil, nil, err
+		}
+		memberIDs = []int{senderID, receiverID}
+	}
+	if err := insertMessageTx(tx, reply, attachmentIDs); err != nil {
+		return nil, nil, err
+	}
+
+	if root, err = refreshThreadRootTx(tx, rootID); err != nil {
+		return nil, nil, err
+	}
+
+	// The root author may have deleted their account
+	participants := []int{senderID}
+	if root.SenderID != 0 && root.SenderID != senderID {
+		participants = append(participants, root.SenderID)
+	}
+	for _, userID := range participants {
+		if _, err := tx.Exec("INSERT IGNORE INTO thread_participants (root_id, user_id) VALUES (?, ?)", rootID, userID); err != nil {
+			return nil, nil, fmt.Errorf("error adding thread participant: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("error creating reply: %v", err)
+	}
+	s.messageCreated(reply, memberIDs)
+	return reply, root, nil
+}
+
+// refreshThreadRootTx recounts the replies of a thread after one was added or
+// deleted and returns the updated root. The change takes the next sequence
+// number of the conversation, which is already locked by the caller.
+func refreshThreadRootTx(tx *sql.Tx, rootID int64) (*Message, error) {
+	var count int
+	var lastReplyAt sql.NullTime
+	query := "SELECT COUNT(*), MAX(created_at) FROM messages WHERE thread_root = ? AND deleted_at IS NULL"
+	if err := tx.QueryRow(query, rootID).Scan(&count, &lastReplyAt); err != nil {
+		return nil, fmt.Errorf("error counting replies: %v", err)
+	}
+	changeSeq, err := nextChangeSeqTx(tx, rootID)
+	if err != nil {
+		return nil, err
+	}
+	query = "UPDATE messages SET reply_count = ?, last_reply_at = ?, change_seq = NULLIF(?, 0) WHERE id = ?"
+	if _, err := tx.Exec(query, count, lastReplyAt, changeSeq, rootID); err != nil {
+		return nil, fmt.Errorf("error updating thread: %v", err)
+	}
+	row := tx.QueryRow("SELECT "+messageColumns+" FROM messages WHERE id = ?", rootID)
+	root, err := scanMessage(row)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving thread root: %v", err)
+	}
+	return root, nil
+}
+
+// ListThreadReplies returns the replies of a thread, oldest first. afterID
+// pages forwards; pass 0 to start at the first reply.
+func (s *Service) ListThreadReplies(rootID, afterID int64, limit int) ([]Message, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE thread_root = ? AND id > ? ORDER BY id LIMIT ?"
+	rows, err := s.mysqlDB.Query(query, rootID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing replies: %v", err)
+	}
+	defer rows.Close()
+
+	replies := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning reply: %v", err)
+		}
+		replies = append(replies, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing replies: %v", err)
+	}
+	return replies, nil
+}
+
+// ListThreadParticipants returns the users taking part in a thread
+func (s *Service) ListThreadParticipants(rootID int64) ([]int, error) {
+	ids, err := s.queryIDs("SELECT user_id FROM thread_participants WHERE root_id = ? ORDER BY joined_at, user_id", rootID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing thread participants: %v", err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+const maxDeviceNameLength = 100
+
+// deviceName is the client supplied name of the device logging in, falling back
+// to the user agent when none was given
+func deviceName(r *http.Request) string {
+	name := r.FormValue("device_name")
+	if name == "" {
+		name = r.Header.Get("X-Device-Name")
+	}
+	if name == "" {
+		name = r.UserAgent()
+	}
+	// Cut characters, not bytes, so a multibyte character is never split
+	if utf8.RuneCountInString(name) > maxDeviceNameLength {
+		name = string([]rune(name)[:maxDeviceNameLength])
+	}
+	return name
+}
+
+type sessionResponse struct {
+	service.Session
+	Current bool `json:"current"`
+}
+
+// HandleSessions lists the caller's active logins
+func HandleSessions(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+
+	sessions, err := svc.ListSessions(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := make([]sessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		response = append(response, sessionResponse{Session: s, Current: s.ID == claims.SessionID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleSession revokes one of the caller's sessions and drops its sockets
+func HandleSession(pool *Pool, w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+
+	sessionID := r.PathValue("id")
+	session, err := svc.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Sessions of other users are reported as missing rather than forbidden
+	if session == nil || session.UserID != claims.UserID() {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := svc.DeleteSession(session.UserID, session.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pool.DisconnectSession(session.UserID, session.ID)
+	log.Printf("Session revoked: user=%d session=%s", session.UserID, session.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
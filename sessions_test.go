@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+func TestDeviceName(t *testing.T) {
+	long := strings.Repeat("é", maxDeviceNameLength+1)
+	for _, tt := range []struct {
+		form, header, userAgent, want string
+	}{
+		{"Phone", "Tablet", "curl/8", "Phone"},
+		{"", "Tablet", "curl/8", "Tablet"},
+		{"", "", "curl/8", "curl/8"},
+		// Long names are cut to whole characters
+		{long, "", "", strings.Repeat("é", maxDeviceNameLength)},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("device_name="+tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Device-Name", tt.header)
+		r.Header.Set("User-Agent", tt.userAgent)
+		got := deviceName(r)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("deviceName(%q, %q, %q) = %q, want %q", tt.form, tt.header, tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestSessionsListAndRevoke(t *testing.T) {
+	svc, _ := newTestService(t, newFakeDB())
+	pool := newPool()
+	now := time.Now()
+	for _, s := range []service.Session{
+		{ID: "s1", UserID: 7, DeviceName: "Laptop", LastUsedAt: now.Add(-time.Hour), RefreshTokenHash: "hash1"},
+		{ID: "s2", UserID: 7, DeviceName: "Phone", LastUsedAt: now, RefreshTokenHash: "hash2"},
+		{ID: "s3", UserID: 8, DeviceName: "Tablet", LastUsedAt: now},
+	} {
+		if err := svc.CreateSession(s, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	HandleSessions(rec, withClaims(t, httptest.NewRequest(http.MethodGet, "/sessions", nil), 7, "s1"), svc)
+	if strings.Contains(rec.Body.String(), "hash") {
+		t.Errorf("session list leaks refresh token hashes: %s", rec.Body)
+	}
+	var sessions []sessionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "s2" || sessions[0].Current || sessions[1].ID != "s1" || !sessions[1].Current {
+		t.Fatalf("sessions = %+v, want s2 then the current s1", sessions)
+	}
+
+	revoke := func(sessionID string) int {
+		req := withClaims(t, httptest.NewRequest(http.MethodDelete, "/sessions/"+sessionID, nil), 7, "s1")
+		req.SetPathValue("id", sessionID)
+		rec := httptest.NewRecorder()
+		HandleSession(pool, rec, req, svc)
+		return rec.Code
+	}
+	// Sessions of other users look like missing ones
+	if code := revoke("s3"); code != http.StatusNotFound {
+		t.Errorf("revoking another user's session: status %d, want 404", code)
+	}
+	if session, _ := svc.GetSession("s3"); session == nil {
+		t.Error("another user's session was revoked")
+	}
+	if code := revoke("s2"); code != http.StatusNoContent {
+		t.Fatalf("revoke: status %d, want 204", code)
+	}
+	if session, _ := svc.GetSession("s2"); session != nil {
+		t.Error("revoked session still exists")
+	}
+}
+
+func TestRefreshTokenChecksSession(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	disabled := false
+	db.onQuery("FROM users WHERE id = ?", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(7), "ada@example.com", "", "Ada", "", "", "user", disabled, "everyone", "everyone"}}
+	})
+
+	login := httptest.NewRecorder()
+	issueTokens(login, httptest.NewRequest(http.MethodPost, "/login", nil), 7, svc)
+	var tokens map[string]string
+	if err := json.NewDecoder(login.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := validateRefreshJWT(tokens["refresh_token"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func(token string) int {
+		form := url.Values{"refresh_token": {token}}
+		req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		HandleRefreshToken(rec, req, svc)
+		return rec.Code
+	}
+	if code := refresh(tokens["refresh_token"]); code != http.StatusOK {
+		t.Fatalf("refresh: status %d, want 200", code)
+	}
+	// Only the refresh token stored with the session is accepted
+	forged, err := generateRefreshToken(7, claims.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := refresh(forged); code != http.StatusUnauthorized {
+		t.Errorf("refresh with another token of the session: status %d, want 401", code)
+	}
+	if code := refresh(tokens["access_token"]); code != http.StatusUnauthorized {
+		t.Errorf("refresh with an access token: status %d, want 401", code)
+	}
+
+	disabled = true
+	if code := refresh(tokens["refresh_token"]); code != http.StatusForbidden {
+		t.Errorf("refresh of a disabled account: status %d, want 403", code)
+	}
+	disabled = false
+
+	if err := svc.DeleteSession(7, claims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if code := refresh(tokens["refresh_token"]); code != http.StatusUnauthorized {
+		t.Errorf("refresh of a revoked session: status %d, want 401", code)
+	}
+}
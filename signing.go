@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksMaxAge is how long clients may cache the JWKS
+const jwksMaxAge = 5 * time.Minute
+
+// keyMissReloadEvery limits the reloads of the key ring caused by tokens
+// signed with an unknown kid
+const keyMissReloadEvery = 30 * time.Second
+
+// signingKey is a private key loaded from storage together with its kid
+type signingKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+// keyRing holds the asymmetric keys used to sign and verify tokens. A new key
+// is published ahead of time and only signs once every instance and JWKS cache
+// has picked it up. Every key still inside the overlap window verifies.
+type keyRing struct {
+	cfg *config.JWTConfig
+	svc *service.Service
+
+	mu         sync.RWMutex
+	keys       []*signingKey // newest first
+	signer     *signingKey
+	missReload time.Time
+}
+
+// signingKeys is nil when tokens are signed with the HS256 jwtSecret
+var signingKeys *keyRing
+
+func newKeyRing(cfg *config.JWTConfig, svc *service.Service) (*keyRing, error) {
+	if _, err := signingMethodFor(cfg.Algorithm); err != nil {
+		return nil, err
+	}
+	kr := &keyRing{cfg: cfg, svc: svc}
+	if cfg.RotationInterval <= 2*kr.activationDelay() {
+		return nil, fmt.Errorf("JWT_KEY_ROTATION must be longer than twice JWT_KEY_REFRESH plus %v", jwksMaxAge)
+	}
+	if err := kr.refresh(); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func signingMethodFor(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm: %s", algorithm)
+	}
+}
+
+// activationDelay is how long a new key is published before it signs. By then
+// every instance has reloaded the ring and cached JWKS responses have expired.
+func (kr *keyRing) activationDelay() time.Duration {
+	return kr.cfg.RefreshEvery + jwksMaxAge
+}
+
+// run reloads keys periodically so rotations made by other instances are picked up
+func (kr *keyRing) run() {
+	ticker := time.NewTicker(kr.cfg.RefreshEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := kr.refresh(); err != nil {
+			log.Printf("Error refreshing signing keys: %v", err)
+		}
+	}
+}
+
+// refresh loads the published keys, publishes the next key when the newest
+// one is due to be replaced and prunes keys past the overlap window
+func (kr *keyRing) refresh() error {
+	return kr.load(time.Now(), true)
+}
+
+// load reads the published keys and picks the one that signs. With rotate, it
+// also stores the next key activationDelay before the newest one is
+// RotationInterval old. The generation is unique, so when several instances
+// rotate at once only one key is stored and the others load it.
+func (kr *keyRing) load(now time.Time, rotate bool) error {
+	cutoff := now.Add(-(kr.cfg.RotationInterval + kr.cfg.OverlapWindow))
+
+	stored, err := kr.svc.ListSigningKeys(kr.cfg.Algorithm, cutoff)
+	if err != nil {
+		return err
+	}
+	if rotate && (len(stored) == 0 || !stored[0].CreatedAt.Add(kr.cfg.RotationInterval-kr.activationDelay()).After(now)) {
+		var generation int64 = 1
+		if len(stored) > 0 {
+			generation = stored[0].Generation + 1
+		}
+		key, err := generateSigningKey(kr.cfg.Algorithm, generation, now)
+		if err != nil {
+			return err
+		}
+		switch err := kr.svc.CreateSigningKey(key); {
+		case errors.Is(err, service.ErrSigningKeyExists):
+			if stored, err = kr.svc.ListSigningKeys(kr.cfg.Algorithm, cutoff); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			log.Printf("Published next jwt signing key: kid=%s alg=%s", key.ID, key.Algorithm)
+			stored = append([]service.SigningKey{key}, stored...)
+		}
+	}
+	if rotate {
+		if err := kr.svc.DeleteSigningKeysBefore(cutoff); err != nil {
+			log.Printf("Error pruning signing keys: %v", err)
+		}
+	}
+	if len(stored) == 0 {
+		return fmt.Errorf("no jwt signing keys for %s", kr.cfg.Algorithm)
+	}
+
+	keys := make([]*signingKey, 0, len(stored))
+	for _, k := range stored {
+		parsed, err := parseSigningKey(k)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, parsed)
+	}
+	// The newest active key signs. Right after the very first key is created
+	// none is active yet, and nobody can know an older one either.
+	signer := keys[len(keys)-1]
+	for _, k := range keys {
+		if !k.CreatedAt.Add(kr.activationDelay()).After(now) {
+			signer = k
+			break
+		}
+	}
+
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.signer = signer
+	kr.mu.Unlock()
+	return nil
+}
+
+// current returns the key new tokens are signed with
+func (kr *keyRing) current() *signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.signer
+}
+
+// lookup finds a published key by kid. An unknown kid reloads the ring first,
+// at most once per keyMissReloadEvery, in case another instance just
+// published the key.
+func (kr *keyRing) lookup(kid string) *signingKey {
+	if k := kr.find(kid); k != nil || kid == "" {
+		return k
+	}
+
+	now := time.Now()
+	kr.mu.Lock()
+	if now.Sub(kr.missReload) < keyMissReloadEvery {
+		kr.mu.Unlock()
+		return nil
+	}
+	kr.missReload = now
+	kr.mu.Unlock()
+
+	if err := kr.load(now, false); err != nil {
+		log.Printf("Error reloading signing keys: %v", err)
+		return nil
+	}
+	return kr.find(kid)
+}
+
+func (kr *keyRing) find(kid string) *signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.ID == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+func generateSigningKey(algorithm string, generation int64, now time.Time) (service.SigningKey, error) {
+	var priv crypto.Signer
+	var err error
+	switch algorithm {
+	case "RS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported jwt algorithm: %s", algorithm)
+	}
+	if err != nil {
+		return service.SigningKey{}, fmt.Errorf("error generating signing key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return service.SigningKey{}, fmt.Errorf("error encoding signing key: %v", err)
+	}
+	kid := make([]byte, 12)
+	if _, err := rand.Read(kid); err != nil {
+		return service.SigningKey{}, fmt.Errorf("error generating kid: %v", err)
+	}
+
+	return service.SigningKey{
+		ID:         base64.RawURLEncoding.EncodeToString(kid),
+		Algorithm:  algorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		Generation: generation,
+		CreatedAt:  now,
+	}, nil
+}
+
+func parseSigningKey(k service.SigningKey) (*signingKey, error) {
+	method, err := signingMethodFor(k.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid pem for signing key %s", k.ID)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key %s: %v", k.ID, err)
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not a signer", k.ID)
+	}
+	return &signingKey{ID: k.ID, Method: method, Private: signer, CreatedAt: k.CreatedAt}, nil
+}
+
+// jwk is a single entry of a JSON Web Key Set (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// jwks returns the public half of every published key
+func (kr *keyRing) jwks() []jwk {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	set := make([]jwk, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		key := jwk{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+		switch pub := k.Private.Public().(type) {
+		case *rsa.PublicKey:
+			key.Kty = "RSA"
+			key.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			key.Kty = "OKP"
+			key.Crv = "Ed25519"
+			key.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set = append(set, key)
+	}
+	return set
+}
+
+// HandleJWKS publishes the verification keys so other services can check chat
+// tokens without sharing a secret. The set is empty when HS256 is configured.
+func HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	keys := []jwk{}
+	if signingKeys != nil {
+		keys = signingKeys.jwks()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+)
+
+// keyStore keeps the jwt_signing_keys rows of a test. Like the table, it
+// rejects a second key of the same generation.
+type keyStore struct {
+	mu    sync.Mutex
+	keys  []service.SigningKey
+	lists int
+	// race stores a competing key of the same generation right before the
+	// next insert, as another instance rotating at the same time would
+	race bool
+}
+
+func newKeyStore(db *fakeDB) *keyStore {
+	ks := &keyStore{}
+	db.onQuery("FROM jwt_signing_keys", func(args []driver.Value) [][]driver.Value {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		ks.lists++
+		var rows [][]driver.Value
+		for _, k := range ks.keys {
+			if k.Algorithm == args[0] && k.CreatedAt.After(args[1].(time.Time)) {
+				rows = append(rows, []driver.Value{k.ID, k.Algorithm, k.PrivateKey, k.Generation, k.CreatedAt})
+			}
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i][4].(time.Time).After(rows[j][4].(time.Time)) })
+		return rows
+	})
+	db.onExec("INSERT INTO jwt_signing_keys", func(args []driver.Value) error {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		key := service.SigningKey{ID: args[0].(string), Algorithm: args[1].(string), PrivateKey: args[2].(string), Generation: args[3].(int64), CreatedAt: args[4].(time.Time)}
+		if ks.race {
+			ks.race = false
+			competitor, err := generateSigningKey(key.Algorithm, key.Generation, key.CreatedAt)
+			if err != nil {
+				return err
+			}
+			ks.keys = append(ks.keys, competitor)
+		}
+		for _, k := range ks.keys {
+			if k.Algorithm == key.Algorithm && k.Generation == key.Generation {
+				return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+			}
+		}
+		ks.keys = append(ks.keys, key)
+		return nil
+	})
+	db.onExec("DELETE FROM jwt_signing_keys", func(args []driver.Value) error {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		kept := ks.keys[:0]
+		for _, k := range ks.keys {
+			if k.CreatedAt.After(args[0].(time.Time)) {
+				kept = append(kept, k)
+			}
+		}
+		ks.keys = kept
+		return nil
+	})
+	return ks
+}
+
+func (ks *keyStore) generations() []int64 {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	var generations []int64
+	for _, k := range ks.keys {
+		generations = append(generations, k.Generation)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations
+}
+
+func testJWTConfig() *config.JWTConfig {
+	return &config.JWTConfig{
+		Algorithm:        "EdDSA",
+		RotationInterval: 24 * time.Hour,
+		OverlapWindow:    48 * time.Hour,
+		RefreshEvery:     10 * time.Minute,
+	}
+}
+
+func jwksKids(kr *keyRing) []string {
+	var kids []string
+	for _, k := range kr.jwks() {
+		kids = append(kids, k.Kid)
+	}
+	return kids
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	store := newKeyStore(db)
+	cfg := testJWTConfig()
+	a := &keyRing{cfg: cfg, svc: svc}
+	b := &keyRing{cfg: cfg, svc: svc}
+
+	// The very first key signs right away
+	t0 := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := a.load(t0, true); err != nil {
+		t.Fatal(err)
+	}
+	first := a.current()
+	if first == nil || len(a.keys) != 1 {
+		t.Fatalf("first load published %d keys", len(a.keys))
+	}
+
+	// The next key is published activationDelay (15 minutes) before the
+	// rotation is due, but the old key keeps signing until then
+	if err := a.load(t0.Add(23*time.Hour+44*time.Minute), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.keys) != 1 {
+		t.Fatalf("rotated %d keys before the rotation was due", len(a.keys)-1)
+	}
+	publishedAt := t0.Add(23*time.Hour + 46*time.Minute)
+	if err := a.load(publishedAt, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.keys) != 2 || a.current() != a.keys[1] || a.current().ID != first.ID {
+		t.Fatalf("after publishing: %d keys, signing with %s, want 2 keys signing with %s", len(a.keys), a.current().ID, first.ID)
+	}
+	next := a.keys[0]
+
+	// Another instance that refreshes later in the window sees the same keys
+	// and signs with the same one
+	if err := b.load(publishedAt.Add(9*time.Minute), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.keys) != 2 || b.current().ID != first.ID {
+		t.Fatalf("other instance: %d keys, signing with %s", len(b.keys), b.current().ID)
+	}
+
+	// Once every instance and JWKS cache had time to pick the key up, it signs
+	activeAt := publishedAt.Add(cfg.RefreshEvery + jwksMaxAge)
+	for _, kr := range []*keyRing{a, b} {
+		if err := kr.load(activeAt.Add(-time.Second), true); err != nil {
+			t.Fatal(err)
+		}
+		if kr.current().ID != first.ID {
+			t.Fatalf("new key signs %v before it is active", activeAt.Sub(kr.current().CreatedAt))
+		}
+		if err := kr.load(activeAt, true); err != nil {
+			t.Fatal(err)
+		}
+		if kr.current().ID != next.ID {
+			t.Fatalf("signing with %s at activation, want %s", kr.current().ID, next.ID)
+		}
+		// The retired key is still published for tokens it signed
+		if kids := jwksKids(kr); len(kids) != 2 || kids[1] != first.ID {
+			t.Fatalf("jwks = %v, want both keys", kids)
+		}
+	}
+	if got := store.generations(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("stored generations %v, want [1 2]", got)
+	}
+
+	// The retired key is pruned after the rotation interval and overlap window
+	if err := a.load(t0.Add(cfg.RotationInterval+cfg.OverlapWindow+time.Second), true); err != nil {
+		t.Fatal(err)
+	}
+	if a.lookup(first.ID) != nil {
+		t.Fatalf("retired key still published after the overlap window")
+	}
+}
+
+func TestKeyRingConcurrentRotation(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	store := newKeyStore(db)
+	cfg := testJWTConfig()
+	kr := &keyRing{cfg: cfg, svc: svc}
+
+	t0 := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := kr.load(t0, true); err != nil {
+		t.Fatal(err)
+	}
+	// Another instance stores generation 2 first, so this one uses it
+	store.race = true
+	if err := kr.load(t0.Add(cfg.RotationInterval), true); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.generations(); len(got) != 2 || got[1] != 2 {
+		t.Fatalf("stored generations %v, want one key per generation", got)
+	}
+	if len(kr.keys) != 2 {
+		t.Fatalf("loaded %d keys, want 2", len(kr.keys))
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, k := range store.keys {
+		if k.Generation == 2 && kr.keys[0].ID != k.ID {
+			t.Fatalf("published %s, want the competing key %s", kr.keys[0].ID, k.ID)
+		}
+	}
+}
+
+func TestKeyRingLookupReloads(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	store := newKeyStore(db)
+	cfg := testJWTConfig()
+	a := &keyRing{cfg: cfg, svc: svc}
+	b := &keyRing{cfg: cfg, svc: svc}
+
+	now := time.Now()
+	if err := a.load(now.Add(-cfg.RotationInterval), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.load(now, false); err != nil {
+		t.Fatal(err)
+	}
+	// a publishes the next key, which b has not loaded yet
+	if err := a.load(now, true); err != nil {
+		t.Fatal(err)
+	}
+	kid := a.keys[0].ID
+	if b.find(kid) != nil {
+		t.Fatal("b already knows the new key")
+	}
+
+	store.mu.Lock()
+	lists := store.lists
+	store.mu.Unlock()
+	if b.lookup(kid) == nil {
+		t.Fatal("lookup of a newly published key failed")
+	}
+	// Unknown kids reload at most once per keyMissReloadEvery
+	for i := 0; i < 3; i++ {
+		if b.lookup("unknown") != nil {
+			t.Fatal("lookup of an unknown kid succeeded")
+		}
+	}
+	b.lookup("")
+	store.mu.Lock()
+	if store.lists != lists+1 {
+		t.Errorf("%d reloads, want 1", store.lists-lists)
+	}
+	store.mu.Unlock()
+
+	b.mu.Lock()
+	b.missReload = b.missReload.Add(-keyMissReloadEvery)
+	b.mu.Unlock()
+	b.lookup("unknown")
+	store.mu.Lock()
+	if store.lists != lists+2 {
+		t.Errorf("%d reloads after the interval, want 2", store.lists-lists)
+	}
+	store.mu.Unlock()
+}
+
+func TestSignedTokensAndJWKS(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	newKeyStore(db)
+	kr, err := newKeyRing(testJWTConfig(), svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKeys = kr
+	t.Cleanup(func() { signingKeys = nil })
+
+	token, err := generateToken(7, "s1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := validateAccessToken(token)
+	if err != nil || claims.UserID() != 7 {
+		t.Fatalf("validateAccessToken = %v, %v", claims, err)
+	}
+
+	rec := httptest.NewRecorder()
+	HandleJWKS(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=300" {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Kid != kr.current().ID || set.Keys[0].Kty != "OKP" || set.Keys[0].Crv != "Ed25519" || set.Keys[0].X == "" {
+		t.Fatalf("jwks = %+v", set.Keys)
+	}
+
+	// Rotation settings that leave no time to publish keys are refused
+	short := testJWTConfig()
+	short.RotationInterval = 30 * time.Minute
+	if _, err := newKeyRing(short, svc); err == nil {
+		t.Error("newKeyRing accepted a rotation interval shorter than the activation delay")
+	}
+}
@@ -0,0 +1,313 @@
+package thirdparty
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3Region    = "eu-test-1"
+	testS3Bucket    = "uploads"
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 is an S3 stand-in that checks the SigV4 signature of every request
+// and keeps objects by their escaped path
+type fakeS3 struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	paths   []string
+	fail    bool
+}
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{t: t, objects: map[string]fakeObject{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+var authorizationPattern = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+// checkSignature verifies a request the way S3 does for unsigned payloads
+func (f *fakeS3) checkSignature(r *http.Request) string {
+	m := authorizationPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return "malformed authorization header"
+	}
+	accessKey, date, region, signedHeaders, signature := m[1], m[2], m[3], m[4], m[5]
+	amzDate := r.Header.Get("X-Amz-Date")
+	switch {
+	case accessKey != testS3AccessKey:
+		return "unknown access key"
+	case region != testS3Region:
+		return "wrong region"
+	case signedHeaders != "host;x-amz-content-sha256;x-amz-date":
+		return "unexpected signed headers " + signedHeaders
+	case r.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD":
+		return "missing payload hash"
+	case !strings.HasPrefix(amzDate, date):
+		return "credential date does not match x-amz-date"
+	}
+	if ts, err := time.Parse("20060102T150405Z", amzDate); err != nil || time.Since(ts).Abs() > 15*time.Minute {
+		return "request time too skewed"
+	}
+
+	canonical := r.Method + "\n" +
+		r.URL.EscapedPath() + "\n" +
+		r.URL.RawQuery + "\n" +
+		"host:" + r.Host + "\n" +
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+		"x-amz-date:" + amzDate + "\n" +
+		"\n" +
+		signedHeaders + "\n" +
+		"UNSIGNED-PAYLOAD"
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + date + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + testS3SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	if hex.EncodeToString(hmacSHA256(key, stringToSign)) != signature {
+		return "signature mismatch"
+	}
+	return ""
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	if msg := f.checkSignature(r); msg != "" {
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := r.URL.EscapedPath()
+	f.paths = append(f.paths, path)
+	if f.fail {
+		http.Error(w, "InternalError", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[path] = fakeObject{body: body, contentType: r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		obj, ok := f.objects[path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Write(obj.body)
+	case http.MethodDelete:
+		if _, ok := f.objects[path]; !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// testBlobStore runs the behaviour every BlobStore shares
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	body := []byte("hello attachment")
+	if err := store.Put(ctx, "ab/cdef", bytes.NewReader(body), int64(len(body)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	rc, err := store.Get(ctx, "ab/cdef")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("Get = %q, %v, want %q", got, err, body)
+	}
+
+	// Put replaces an existing blob
+	replacement := []byte("v2")
+	if err := store.Put(ctx, "ab/cdef", bytes.NewReader(replacement), int64(len(replacement)), "text/plain"); err != nil {
+		t.Fatalf("Put again: %v", err)
+	}
+	rc, err = store.Get(ctx, "ab/cdef")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ = io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, replacement) {
+		t.Fatalf("Get after replace = %q, want %q", got, replacement)
+	}
+
+	if err := store.Delete(ctx, "ab/cdef"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "ab/cdef"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Get after Delete error = %v, want ErrBlobNotFound", err)
+	}
+	if _, err := store.Get(ctx, "never/stored"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Get of unknown key error = %v, want ErrBlobNotFound", err)
+	}
+	// Deleting twice is not an error, cleanup may race with itself
+	if err := store.Delete(ctx, "ab/cdef"); err != nil {
+		t.Fatalf("Delete of missing blob: %v", err)
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("leftover files: %v", entries)
+	}
+}
+
+func TestLocalBlobStoreRejectsEscapingKeys(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"../outside", "ab/../../outside", "..", ""} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("Get(%q) error = %v, want invalid key", key, err)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a blob was written outside the directory")
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	s3 := newFakeS3(t)
+	store, err := NewS3BlobStore(s3.server.URL, testS3Region, testS3Bucket, testS3AccessKey, testS3SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+
+	ctx := context.Background()
+	if err := store.Put(ctx, "ab/cdef", strings.NewReader("<svg/>"), 6, "image/svg+xml"); err != nil {
+		t.Fatal(err)
+	}
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	if obj := s3.objects["/uploads/ab/cdef"]; obj.contentType != "image/svg+xml" {
+		t.Fatalf("stored content type %q", obj.contentType)
+	}
+}
+
+func TestS3BlobStoreEscapesKeys(t *testing.T) {
+	s3 := newFakeS3(t)
+	// Endpoints may carry a path prefix in front of the bucket
+	store, err := NewS3BlobStore(s3.server.URL+"/storage/", testS3Region, testS3Bucket, testS3AccessKey, testS3SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	key := "ab/report final+v2 (ü)~.pdf"
+	if err := store.Put(ctx, key, strings.NewReader("pdf"), 3, "application/pdf"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	rc.Close()
+
+	want := "/storage/uploads/ab/report%20final%2Bv2%20%28%C3%BC%29~.pdf"
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	for _, path := range s3.paths {
+		if path != want {
+			t.Fatalf("request path = %q, want %q", path, want)
+		}
+	}
+}
+
+func TestS3BlobStoreErrors(t *testing.T) {
+	s3 := newFakeS3(t)
+	ctx := context.Background()
+
+	wrongSecret, err := NewS3BlobStore(s3.server.URL, testS3Region, testS3Bucket, testS3AccessKey, "not-the-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrongSecret.Put(ctx, "k", strings.NewReader("x"), 1, "text/plain"); err == nil || !strings.Contains(err.Error(), "signature mismatch") {
+		t.Fatalf("Put with wrong secret error = %v, want signature mismatch", err)
+	}
+
+	store, err := NewS3BlobStore(s3.server.URL, testS3Region, testS3Bucket, testS3AccessKey, testS3SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3.mu.Lock()
+	s3.fail = true
+	s3.mu.Unlock()
+	if _, err := store.Get(ctx, "k"); err == nil || errors.Is(err, ErrBlobNotFound) || !strings.Contains(err.Error(), "status 500") {
+		t.Fatalf("Get error = %v, want status 500", err)
+	}
+	if err := store.Delete(ctx, "k"); err == nil {
+		t.Fatalf("Delete succeeded on a failing server")
+	}
+
+	for _, endpoint := range []string{"", "not a url", "/relative"} {
+		if _, err := NewS3BlobStore(endpoint, testS3Region, testS3Bucket, testS3AccessKey, testS3SecretKey); err == nil {
+			t.Errorf("NewS3BlobStore(%q) succeeded", endpoint)
+		}
+	}
+	if _, err := NewS3BlobStore(s3.server.URL, testS3Region, "", testS3AccessKey, testS3SecretKey); err == nil {
+		t.Errorf("NewS3BlobStore without bucket succeeded")
+	}
+}
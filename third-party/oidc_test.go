@@ -0,0 +1,360 @@
+package thirdparty
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "chat-go"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "https://chat.example.com/auth/test/callback"
+	testCode         = "auth-code"
+)
+
+// fakeIdP is an identity provider serving discovery, JWKS and token endpoints.
+// The token endpoint checks the PKCE verifier against the challenge of the
+// last authorization request and answers with idToken.
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	key       *rsa.PrivateKey
+	kid       string
+	challenge string
+	idToken   string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	idp := &fakeIdP{t: t, key: newRSAKey(t), kid: "key-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": idp.kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		user, pass, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		switch {
+		case user != testClientID || pass != testClientSecret:
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		case r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != testCode:
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		case r.PostFormValue("redirect_uri") != testRedirectURL:
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		case base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge:
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken})
+		}
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return key
+}
+
+// claims returns valid ID token claims for the nonce
+func (idp *fakeIdP) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada",
+	}
+}
+
+// sign signs claims with key under kid
+func (idp *fakeIdP) sign(claims jwt.MapClaims, key *rsa.PrivateKey, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		idp.t.Fatalf("signing id token: %v", err)
+	}
+	return signed
+}
+
+func (idp *fakeIdP) setIDToken(idToken string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.idToken = idToken
+}
+
+// rotate replaces the signing key
+func (idp *fakeIdP) rotate(kid string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key = newRSAKey(idp.t)
+	idp.kid = kid
+}
+
+func (idp *fakeIdP) provider() *OIDCProvider {
+	return NewOIDCProvider("test", idp.server.URL+"/", testClientID, testClientSecret, testRedirectURL, []string{"openid", "email"})
+}
+
+// authorize starts a flow and records its PKCE challenge at the IdP. It
+// returns the code verifier.
+func (idp *fakeIdP) authorize(t *testing.T, p *OIDCProvider, nonce string) string {
+	verifier, challenge, err := NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(context.Background(), "state-1", nonce, challenge)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.challenge = u.Query().Get("code_challenge")
+	idp.mu.Unlock()
+	return verifier
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+
+	_, challenge, err := NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+		t.Fatalf("auth URL %q does not use the discovered endpoint", authURL)
+	}
+	u, _ := url.Parse(authURL)
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        challenge,
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if got := u.Query().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestNewPKCEVerifier(t *testing.T) {
+	verifier, challenge, err := NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("challenge is not the S256 hash of the verifier")
+	}
+	if len(verifier) < 43 {
+		t.Fatalf("verifier %q is shorter than RFC 7636 allows", verifier)
+	}
+	other, _, _ := NewPKCEVerifier()
+	if other == verifier {
+		t.Fatalf("verifiers repeat")
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newFakeIdP(t)
+	otherKey := newRSAKey(t)
+
+	tests := []struct {
+		name     string
+		idToken  func(nonce string) string
+		verifier func(verifier string) string
+		wantErr  string
+	}{
+		{
+			name:    "valid",
+			idToken: func(nonce string) string { return idp.sign(idp.claims(nonce), idp.key, idp.kid) },
+		},
+		{
+			name:     "wrong pkce verifier",
+			idToken:  func(nonce string) string { return idp.sign(idp.claims(nonce), idp.key, idp.kid) },
+			verifier: func(string) string { return "not-the-verifier" },
+			wantErr:  "status 400",
+		},
+		{
+			name:    "bad signature",
+			idToken: func(nonce string) string { return idp.sign(idp.claims(nonce), otherKey, idp.kid) },
+			wantErr: "signature is invalid",
+		},
+		{
+			name:    "unknown kid",
+			idToken: func(nonce string) string { return idp.sign(idp.claims(nonce), idp.key, "key-unknown") },
+			wantErr: "unknown signing key",
+		},
+		{
+			name: "wrong audience",
+			idToken: func(nonce string) string {
+				claims := idp.claims(nonce)
+				claims["aud"] = "another-client"
+				return idp.sign(claims, idp.key, idp.kid)
+			},
+			wantErr: "audience",
+		},
+		{
+			name: "wrong issuer",
+			idToken: func(nonce string) string {
+				claims := idp.claims(nonce)
+				claims["iss"] = "https://evil.example.com"
+				return idp.sign(claims, idp.key, idp.kid)
+			},
+			wantErr: "issuer",
+		},
+		{
+			name:    "nonce mismatch",
+			idToken: func(string) string { return idp.sign(idp.claims("other-nonce"), idp.key, idp.kid) },
+			wantErr: "nonce mismatch",
+		},
+		{
+			name: "expired",
+			idToken: func(nonce string) string {
+				claims := idp.claims(nonce)
+				claims["exp"] = time.Now().Add(-time.Minute).Unix()
+				return idp.sign(claims, idp.key, idp.kid)
+			},
+			wantErr: "expired",
+		},
+		{
+			name: "missing subject",
+			idToken: func(nonce string) string {
+				claims := idp.claims(nonce)
+				delete(claims, "sub")
+				return idp.sign(claims, idp.key, idp.kid)
+			},
+			wantErr: "missing subject",
+		},
+		{
+			name: "symmetric algorithm",
+			idToken: func(nonce string) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.claims(nonce))
+				token.Header["kid"] = idp.kid
+				signed, _ := token.SignedString([]byte(testClientSecret))
+				return signed
+			},
+			wantErr: "signing method",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := idp.provider()
+			verifier := idp.authorize(t, p, "nonce-1")
+			if tt.verifier != nil {
+				verifier = tt.verifier(verifier)
+			}
+			idp.setIDToken(tt.idToken("nonce-1"))
+
+			identity, err := p.Exchange(context.Background(), testCode, verifier, "nonce-1")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			want := OIDCIdentity{Subject: "subject-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada"}
+			if *identity != want {
+				t.Fatalf("identity = %+v, want %+v", *identity, want)
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeKeyRotation(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+
+	verifier := idp.authorize(t, p, "nonce-1")
+	idp.setIDToken(idp.sign(idp.claims("nonce-1"), idp.key, idp.kid))
+	if _, err := p.Exchange(context.Background(), testCode, verifier, "nonce-1"); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	// A token signed with a new key makes the provider refetch the JWKS
+	idp.rotate("key-2")
+	verifier = idp.authorize(t, p, "nonce-2")
+	idp.setIDToken(idp.sign(idp.claims("nonce-2"), idp.key, idp.kid))
+	if _, err := p.Exchange(context.Background(), testCode, verifier, "nonce-2"); err != nil {
+		t.Fatalf("Exchange after rotation: %v", err)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	// A discovery document that names another issuer is rejected
+	mismatch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	}))
+	defer mismatch.Close()
+
+	p := NewOIDCProvider("test", mismatch.URL, testClientID, testClientSecret, testRedirectURL, nil)
+	if _, err := p.AuthCodeURL(context.Background(), "state", "nonce", "challenge"); err == nil || !strings.Contains(err.Error(), "reported issuer") {
+		t.Fatalf("AuthCodeURL error = %v, want issuer mismatch", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gitnoober/chat-go/service"
+)
+
+type threadResponse struct {
+	Root         *service.Message  `json:"root"`
+	Replies      []service.Message `json:"replies"`
+	Participants []service.User    `json:"participants"`
+	// NextAfter is passed as after to load newer replies
+	NextAfter int64 `json:"next_after,omitempty"`
+}
+
+// HandleThread returns a thread's root message, its replies oldest first and
+// its participants. The ID of any reply resolves to its thread. Replies and
+// participants with a block with the caller are left out.
+func HandleThread(w http.ResponseWriter, r *http.Request, svc *service.Service) {
+	claims := claimsFromContext(r.Context())
+	messageID, ok := pathMessageID(r)
+	if !ok {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	var after int64
+	if v := q.Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultMessagePageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxMessagePageSize)
+	}
+
+	root, err := participantMessage(svc, claims.UserID(), messageID)
+	if err == nil && root.ThreadRoot != 0 {
+		root, err = participantMessage(svc, claims.UserID(), root.ThreadRoot)
+	}
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+
+	// Fetch one extra reply to know whether there are newer ones
+	replies, err := svc.ListThreadReplies(root.ID, after, limit+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blockedIDs, err := svc.BlockedEitherIDs(claims.UserID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := threadResponse{Root: root, Replies: []service.Message{}, Participants: []service.User{}}
+	if len(replies) > limit {
+		replies = replies[:limit]
+		response.NextAfter = replies[len(replies)-1].ID
+	}
+	for _, reply := range replies {
+		if !slices.Contains(blockedIDs, reply.SenderID) {
+			response.Replies = append(response.Replies, reply)
+		}
+	}
+
+	msgs := []*service.Message{root}
+	for i := range response.Replies {
+		msgs = append(msgs, &response.Replies[i])
+	}
+	if err := decorateMessages(svc, claims.UserID(), msgs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	participantIDs, err := svc.ListThreadParticipants(root.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	profiles, err := svc.GetUserProfiles(participantIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, id := range participantIDs {
+		if user, ok := profiles[id]; ok && !slices.Contains(blockedIDs, id) {
+			response.Participants = append(response.Participants, publicProfile(user))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
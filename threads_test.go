@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/gitnoober/chat-go/config"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+// threadTest is a direct conversation 50 between users 7 and 8 where reply 41
+// by user 7 answers root 40 by user 8. Sequence numbers are handed out from
+// 11 on.
+func threadTest(t *testing.T) (*fakeDB, func() int64) {
+	t.Helper()
+	db := newFakeDB()
+	sent := time.Now().UTC().Truncate(time.Second).Add(-time.Minute)
+	var mu sync.Mutex
+	seq := int64(10)
+
+	db.onQuery("SELECT conversation_id FROM messages WHERE id = ?", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(50)}}
+	})
+	db.onQuery("SELECT last_seq FROM conversations", func([]driver.Value) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		seq++
+		return [][]driver.Value{{seq}}
+	})
+	db.onQuery("FOR UPDATE", func(args []driver.Value) [][]driver.Value {
+		if args[0] != int64(41) {
+			return nil
+		}
+		return [][]driver.Value{{int64(41), int64(7), int64(8), int64(50), int64(9), nil, "reply", sent, nil, nil, int64(40), int64(40), int64(0), nil}}
+	})
+	// One older reply is left
+	db.onQuery("COUNT(*), MAX(created_at) FROM messages WHERE thread_root = ?", func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(1), sent.Add(-time.Hour)}}
+	})
+	db.onQuery("FROM messages WHERE id = ?", func(args []driver.Value) [][]driver.Value {
+		if args[0] != int64(40) {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return [][]driver.Value{{int64(40), int64(8), int64(7), int64(50), int64(5), seq, "root", sent.Add(-2 * time.Hour), nil, nil, nil, nil, int64(1), sent.Add(-time.Hour)}}
+	})
+	db.onQuery("SELECT COUNT(msg.id)", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(0)}}
+	})
+	return db, func() int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return seq
+	}
+}
+
+func TestDeleteReplyRecountsThread(t *testing.T) {
+	db, lastSeq := threadTest(t)
+	svc, _ := newTestService(t, db)
+	pool := newPool()
+	conns := map[int]*websocket.Conn{}
+	for _, userID := range []int{7, 8} {
+		conns[userID] = connectClient(t, pool, userID)
+	}
+	blobs, err := thirdparty.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := deleteMessage(pool, svc, blobs, &config.MessageConfig{EditWindow: time.Hour}, 7, 41)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.DeletedAt == nil || msg.ChangeSeq != 11 {
+		t.Fatalf("tombstone = %+v, want change_seq 11", msg)
+	}
+
+	updates := db.executed("UPDATE messages SET reply_count = ?")
+	if len(updates) != 1 {
+		t.Fatalf("%d thread root updates, want 1", len(updates))
+	}
+	if args := updates[0].args; args[0] != int64(1) || args[2] != int64(12) || args[3] != int64(40) {
+		t.Errorf("root updated with count, change_seq, id = %v, %v, %v, want 1, 12, 40", args[0], args[2], args[3])
+	}
+	if lastSeq() != 12 {
+		t.Errorf("last seq = %d, want 12", lastSeq())
+	}
+
+	for userID := range conns {
+		var thread bool
+		for _, frame := range receivedEvents(t, pool, userID, conns[userID]) {
+			var ev struct {
+				Type string `json:"type"`
+				Data struct {
+					RootID     int64 `json:"root_id"`
+					ReplyCount int   `json:"reply_count"`
+					Seq        int64 `json:"seq"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(frame, &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Type == eventThreadUpdated {
+				thread = true
+				if ev.Data.RootID != 40 || ev.Data.ReplyCount != 1 || ev.Data.Seq != 12 {
+					t.Errorf("user %d got %s", userID, frame)
+				}
+			}
+		}
+		if !thread {
+			t.Errorf("user %d got no thread_updated frame", userID)
+		}
+	}
+}
+
+func TestHandleThreadHidesBlockedUsers(t *testing.T) {
+	svc, db := roomTest(t)
+	sent := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	roomMessage := func(id, senderID int64, threadRoot interface{}) []driver.Value {
+		return []driver.Value{id, senderID, nil, int64(50), id, nil, "hi", sent, nil, nil, threadRoot, threadRoot, int64(0), nil}
+	}
+	db.onQuery("WHERE thread_root = ? AND id > ?", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{roomMessage(41, 7, int64(40)), roomMessage(42, 8, int64(40))}
+	})
+	db.onQuery("FROM messages WHERE id = ?", func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{roomMessage(40, 8, nil)}
+	})
+	db.onQuery("FROM thread_participants", func([]driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(8)}, {int64(7)}}
+	})
+	db.onQuery("FROM users WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, id := range args {
+			rows = append(rows, []driver.Value{id, "", "User", "", "", "user", false, "everyone", "everyone"})
+		}
+		return rows
+	})
+
+	// User 9 blocked 7, so neither 7's reply nor 7 as a participant shows
+	for userID, want := range map[int]struct {
+		replies      []int
+		participants int
+	}{8: {[]int{41, 42}, 2}, 9: {[]int{42}, 1}} {
+		req := withClaims(t, httptest.NewRequest(http.MethodGet, "/threads/40", nil), userID, "s1")
+		req.SetPathValue("id", "40")
+		rec := httptest.NewRecorder()
+		HandleThread(rec, req, svc)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("user %d: status %d %s", userID, rec.Code, rec.Body)
+		}
+		var response threadResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		var replies []int
+		for _, reply := range response.Replies {
+			replies = append(replies, int(reply.ID))
+		}
+		if !slices.Equal(replies, want.replies) {
+			t.Errorf("user %d got replies %v, want %v", userID, replies, want.replies)
+		}
+		if len(response.Participants) != want.participants {
+			t.Errorf("user %d got participants %+v, want %d", userID, response.Participants, want.participants)
+		}
+	}
+}
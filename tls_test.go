@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for localhost with the given
+// common name and dates the files at modTime
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedName returns the common name of the certificate served right now
+func servedName(t *testing.T, cr *certReloader) string {
+	t.Helper()
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderPicksUpRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "first", start)
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cr); name != "first" {
+		t.Fatalf("serving %q, want first", name)
+	}
+
+	// Unchanged files are not loaded again
+	cr.check()
+	if name := servedName(t, cr); name != "first" {
+		t.Fatalf("serving %q, want first", name)
+	}
+
+	writeCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	cr.check()
+	if name := servedName(t, cr); name != "second" {
+		t.Fatalf("serving %q after a rotation, want second", name)
+	}
+
+	// A broken rotation keeps the previous certificate until it is fixed
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyFile, start.Add(2*time.Minute), start.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	cr.check()
+	if name := servedName(t, cr); name != "second" {
+		t.Fatalf("serving %q after a broken rotation, want second", name)
+	}
+	writeCert(t, certFile, keyFile, "third", start.Add(3*time.Minute))
+	cr.check()
+	if name := servedName(t, cr); name != "third" {
+		t.Fatalf("serving %q after the fix, want third", name)
+	}
+}
+
+func TestTLSServesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "localhost", time.Now())
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = newTLSConfig(cr)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	client := srv.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("served %s, want HTTP/2", resp.Proto)
+	}
+	if resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("negotiated TLS version %x", resp.TLS.Version)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, tt := range []struct {
+		httpsAddr, host, path, want string
+	}{
+		{":443", "chat.example.com", "/user?x=1", "https://chat.example.com/user?x=1"},
+		{":8443", "chat.example.com:8080", "/ws", "https://chat.example.com:8443/ws"},
+		{"0.0.0.0:443", "chat.example.com:80", "/", "https://chat.example.com/"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		httpsRedirectHandler(tt.httpsAddr).ServeHTTP(rec, req)
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tt.want {
+			t.Errorf("redirect of %s%s to %s: %d %s, want %s", tt.host, tt.path, tt.httpsAddr, rec.Code, rec.Header().Get("Location"), tt.want)
+		}
+	}
+}
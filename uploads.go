@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+	utils "github.com/gitnoober/chat-go/utils"
+)
+
+const (
+	// maxMessageAttachments is the number of files one message can carry
+	maxMessageAttachments = 10
+	// maxThumbnailSourcePixels keeps huge images from being decoded for a thumbnail
+	maxThumbnailSourcePixels = 25_000_000
+	maxFilenameLength        = 255
+	thumbnailVariant         = "thumbnail"
+	// unsentSweepBatch is the number of stale uploads deleted per transaction
+	unsentSweepBatch = 100
+)
+
+// newBlobStore creates the blob store selected by BLOB_STORE
+func newBlobStore(cfg *config.UploadConfig) (thirdparty.BlobStore, error) {
+	switch cfg.Store {
+	case "local":
+		return thirdparty.NewLocalBlobStore(cfg.LocalDir)
+	case "s3":
+		return thirdparty.NewS3BlobStore(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey)
+	default:
+		return nil, fmt.Errorf("unknown blob store: %q", cfg.Store)
+	}
+}
+
+// sweepUnsentUploads deletes uploads that were never sent within
+// UPLOAD_UNSENT_TTL, together with their blobs
+func sweepUnsentUploads(svc *service.Service, blobs thirdparty.BlobStore, cfg *config.UploadConfig) {
+	ticker := time.NewTicker(cfg.SweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := deleteUnsentUploads(svc, blobs, time.Now().Add(-cfg.UnsentTTL))
+		if err != nil {
+			log.Printf("Error deleting unsent uploads: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Deleted %d unsent uploads", n)
+		}
+	}
+}
+
+// deleteUnsentUploads deletes the unsent uploads created before a time in
+// batches and returns how many were deleted
+func deleteUnsentUploads(svc *service.Service, blobs thirdparty.BlobStore, before time.Time) (int, error) {
+	deleted := 0
+	for {
+		attachments, err := svc.DeleteUnsentAttachments(before, unsentSweepBatch)
+		if err != nil {
+			return deleted, err
+		}
+		deleteAttachmentBlobs(blobs, attachments)
+		deleted += len(attachments)
+		if len(attachments) < unsentSweepBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// urlSigner signs download URLs for one user with an expiry
+type urlSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+func newURLSigner(cfg *config.UploadConfig) (*urlSigner, error) {
+	key := []byte(cfg.SigningKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("error generating url signing key: %v", err)
+		}
+		log.Println("UPLOAD_SIGNING_KEY not set, download URLs will not survive a restart")
+	}
+	return &urlSigner{key: key, ttl: cfg.URLTTL}, nil
+}
+
+func (s *urlSigner) signature(id, variant string, userID int, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "%s|%s|%d|%d", id, variant, userID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns a signed download path for an attachment and when it expires
+func (s *urlSigner) URL(id, variant string, userID int) (string, time.Time) {
+	expires := time.Now().Add(s.ttl).Truncate(time.Second)
+	q := url.Values{}
+	if variant != "" {
+		q.Set("variant", variant)
+	}
+	q.Set("uid", strconv.Itoa(userID))
+	q.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", s.signature(id, variant, userID, expires.Unix()))
+	return "/files/" + url.PathEscape(id) + "?" + q.Encode(), expires
+}
+
+// Verify checks a signed download request and returns the user it was issued to
+func (s *urlSigner) Verify(id string, q url.Values) (userID int, variant string, ok bool) {
+	variant = q.Get("variant")
+	userID, err := strconv.Atoi(q.Get("uid"))
+	if err != nil {
+		return 0, "", false
+	}
+	expires, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, "", false
+	}
+	if !utils.ConstantTimeEqual(q.Get("sig"), s.signature(id, variant, userID, expires)) {
+		return 0, "", false
+	}
+	return userID, variant, true
+}
+
+// canAccessAttachment checks that a user may download an attachment: unsent
+// files only by their uploader, sent ones by the members of the conversation
+// as long as the message exists
+func canAccessAttachment(svc *service.Service, userID int, a *service.Attachment) error {
+	if a.MessageID == 0 {
+		if a.UploaderID != userID {
+			return service.ErrAttachmentNotFound
+		}
+		return nil
+	}
+	msg, err := participantMessage(svc, userID, a.MessageID)
+	if errors.Is(err, service.ErrMessageNotFound) || (err == nil && msg.DeletedAt != nil) {
+		return service.ErrAttachmentNotFound
+	}
+	return err
+}
+
+// sanitizeFilename keeps the base name of a client supplied filename without
+// control characters and at most maxFilenameLength characters long
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+	// The column counts characters, and cutting bytes could split one
+	if utf8.RuneCountInString(name) > maxFilenameLength {
+		name = string([]rune(name)[:maxFilenameLength])
+	}
+	return name
+}
+
+// makeThumbnail scales an image down to fit in size x size. PNG and GIF
+// thumbnails are encoded as PNG to keep transparency, others as JPEG.
+func makeThumbnail(data []byte, contentType string, size int) ([]byte, string, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding image: %v", err)
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/b.Dx())
+		} else {
+			w, h = max(1, w*size/b.Dy()), size
+		}
+	}
+
+	// Box filter: every thumbnail pixel averages the source pixels it covers
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+max((y+1)*b.Dy()/h, y*b.Dy()/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+max((x+1)*b.Dx()/w, x*b.Dx()/w+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, "", fmt.Errorf("error encoding thumbnail: %v", err)
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, "", fmt.Errorf("error encoding thumbnail: %v", err)
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// readUploadedFile reads the "file" part of a multipart upload, failing if it
+// is larger than maxSize
+func readUploadedFile(r *http.Request, maxSize int) (data []byte, filename string, tooLarge bool, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", false, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return nil, "", false, fmt.Errorf("file is required")
+			}
+			return nil, "", false, err
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(part, int64(maxSize)+1))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			return nil, "", errors.As(err, &maxErr), err
+		}
+		if len(data) > maxSize {
+			return nil, "", true, fmt.Errorf("file too large")
+		}
+		return data, part.FileName(), false, nil
+	}
+}
+
+// HandleUpload stores a file sent as the "file" field of a multipart form.
+// The content type is sniffed from the data, images get their dimensions
+// recorded and a thumbnail. The attachment can then be sent with a message.
+func HandleUpload(w http.ResponseWriter, r *http.Request, svc *service.Service, blobs thirdparty.BlobStore, cfg *config.UploadConfig) {
+	claims := claimsFromContext(r.Context())
+
+	// Leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxSize)+1<<20)
+	data, filename, tooLarge, err := readUploadedFile(r, cfg.MaxSize)
+	if tooLarge {
+		http.Error(w, fmt.Sprintf("File must be at most %d bytes", cfg.MaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "File is empty", http.StatusBadRequest)
+		return
+	}
+
+	// Never trust the declared type, only what the data looks like
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !slices.Contains(cfg.AllowedTypes, contentType) {
+		http.Error(w, "File type not allowed: "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id, err := newTokenID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attachment := &service.Attachment{
+		ID:          id,
+		UploaderID:  claims.UserID(),
+		Filename:    sanitizeFilename(filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		BlobKey:     "attachments/" + id,
+	}
+
+	var thumbnail []byte
+	var thumbnailType string
+	if strings.HasPrefix(contentType, "image/") {
+		if imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			attachment.Width, attachment.Height = imgCfg.Width, imgCfg.Height
+			if imgCfg.Width*imgCfg.Height <= maxThumbnailSourcePixels {
+				thumbnail, thumbnailType, err = makeThumbnail(data, contentType, cfg.ThumbnailSize)
+				if err != nil {
+					log.Printf("Error creating thumbnail for %s: %v", id, err)
+				}
+			}
+		}
+	}
+
+	ctx := r.Context()
+	if err := blobs.Put(ctx, attachment.BlobKey, bytes.NewReader(data), attachment.Size, contentType); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if thumbnail != nil {
+		key := attachment.BlobKey + "." + thumbnailVariant
+		if err := blobs.Put(ctx, key, bytes.NewReader(thumbnail), int64(len(thumbnail)), thumbnailType); err != nil {
+			log.Printf("Error storing thumbnail for %s: %v", id, err)
+		} else {
+			attachment.ThumbnailKey = key
+		}
+	}
+	if err := svc.CreateAttachment(attachment); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+type attachmentURLResponse struct {
+	*service.Attachment
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// HandleAttachment returns an attachment with signed, expiring download URLs
+// for the caller
+func HandleAttachment(w http.ResponseWriter, r *http.Request, svc *service.Service, signer *urlSigner) {
+	claims := claimsFromContext(r.Context())
+
+	attachment, err := svc.GetAttachment(r.PathValue("id"))
+	if err == nil {
+		err = canAccessAttachment(svc, claims.UserID(), attachment)
+	}
+	if errors.Is(err, service.ErrAttachmentNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := attachmentURLResponse{Attachment: attachment}
+	response.URL, response.ExpiresAt = signer.URL(attachment.ID, "", claims.UserID())
+	if attachment.HasThumbnail {
+		response.ThumbnailURL, _ = signer.URL(attachment.ID, thumbnailVariant, claims.UserID())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleFile serves a download through a signed URL. Access is checked again
+// so URLs stop working once the user loses access to the conversation.
+func HandleFile(w http.ResponseWriter, r *http.Request, svc *service.Service, blobs thirdparty.BlobStore, signer *urlSigner) {
+	id := r.PathValue("id")
+	userID, variant, ok := signer.Verify(id, r.URL.Query())
+	if !ok || (variant != "" && variant != thumbnailVariant) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	attachment, err := svc.GetAttachment(id)
+	if err == nil {
+		err = canAccessAttachment(svc, userID, attachment)
+	}
+	if errors.Is(err, service.ErrAttachmentNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	key, contentType := attachment.BlobKey, attachment.ContentType
+	if variant == thumbnailVariant {
+		if !attachment.HasThumbnail {
+			http.Error(w, "No thumbnail", http.StatusNotFound)
+			return
+		}
+		key = attachment.ThumbnailKey
+		contentType = "image/png"
+		if attachment.ContentType == "image/jpeg" {
+			contentType = "image/jpeg"
+		}
+	}
+
+	body, err := blobs.Get(r.Context(), key)
+	if errors.Is(err, thirdparty.ErrBlobNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	if variant == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Error serving file %s: %v", id, err)
+	}
+}
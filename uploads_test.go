@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	thirdparty "github.com/gitnoober/chat-go/third-party"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	long := strings.Repeat("é", maxFilenameLength+45)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"unicode", "résumé 😀.txt", "résumé 😀.txt"},
+		{"unix path", "/etc/passwd", "passwd"},
+		{"traversal", "../../secret.txt", "secret.txt"},
+		{"windows path", `C:\Users\me\photo.jpg`, "photo.jpg"},
+		{"trailing slash", "dir/", "dir"},
+		{"control characters", "a\x00b\r\nc\x7f.txt", "abc.txt"},
+		{"empty", "", "file"},
+		{"dot", ".", "file"},
+		{"root", "/", "file"},
+		{"only control characters", "\x01\x02", "file"},
+		{"long multibyte", long, strings.Repeat("é", maxFilenameLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	// A cut never splits a character, even a multibyte one at the boundary
+	mixed := strings.Repeat("a", maxFilenameLength-1) + "😀😀"
+	got := sanitizeFilename(mixed)
+	if !utf8.ValidString(got) || utf8.RuneCountInString(got) != maxFilenameLength || !strings.HasSuffix(got, "😀") {
+		t.Errorf("sanitizeFilename cut %q badly", got[len(got)-8:])
+	}
+}
+
+// testImage returns a w x h image whose left half is black and right half white
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x >= w/2 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	var jpegData, gifData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, testImage(300, 600), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifData, testImage(50, 20), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		wantType    string
+		wantW       int
+		wantH       int
+	}{
+		{"landscape png", encodePNG(t, testImage(800, 200)), "image/png", "image/png", 100, 25},
+		{"portrait jpeg", jpegData.Bytes(), "image/jpeg", "image/jpeg", 50, 100},
+		{"gif keeps transparency", gifData.Bytes(), "image/gif", "image/png", 50, 20},
+		{"small image is not upscaled", encodePNG(t, testImage(40, 30)), "image/png", "image/png", 40, 30},
+		{"thin image keeps a pixel", encodePNG(t, testImage(1000, 3)), "image/png", "image/png", 100, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thumb, contentType, err := makeThumbnail(tt.data, tt.contentType, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != tt.wantType {
+				t.Errorf("content type = %q, want %q", contentType, tt.wantType)
+			}
+			img, format, err := image.Decode(bytes.NewReader(thumb))
+			if err != nil {
+				t.Fatalf("thumbnail does not decode: %v", err)
+			}
+			if "image/"+format != tt.wantType {
+				t.Errorf("thumbnail encoded as %s, want %s", format, tt.wantType)
+			}
+			if b := img.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+
+	if _, _, err := makeThumbnail([]byte("not an image"), "image/png", 100); err == nil {
+		t.Error("makeThumbnail of invalid data succeeded")
+	}
+}
+
+func TestMakeThumbnailAveragesPixels(t *testing.T) {
+	// Black and white columns average to grey
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			if x%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	thumb, _, err := makeThumbnail(encodePNG(t, img), "image/png", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b, a := out.At(50, 50).RGBA()
+	if r>>8 != 127 || g>>8 != 127 || b>>8 != 127 || a>>8 != 255 {
+		t.Errorf("pixel = %d,%d,%d,%d, want opaque grey", r>>8, g>>8, b>>8, a>>8)
+	}
+}
+
+// signedQuery returns the query of a download URL issued by s
+func signedQuery(t *testing.T, s *urlSigner, id, variant string, userID int) url.Values {
+	t.Helper()
+	link, _ := s.URL(id, variant, userID)
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/files/"+id {
+		t.Fatalf("URL path = %q", u.Path)
+	}
+	return u.Query()
+}
+
+func TestURLSignerVerify(t *testing.T) {
+	signer := &urlSigner{key: []byte("test-signing-key"), ttl: time.Hour}
+
+	q := signedQuery(t, signer, "att1", thumbnailVariant, 42)
+	userID, variant, ok := signer.Verify("att1", q)
+	if !ok || userID != 42 || variant != thumbnailVariant {
+		t.Fatalf("Verify = %d, %q, %v, want 42, %q, true", userID, variant, ok, thumbnailVariant)
+	}
+	if userID, variant, ok := signer.Verify("att1", signedQuery(t, signer, "att1", "", 42)); !ok || userID != 42 || variant != "" {
+		t.Fatalf("Verify of original = %d, %q, %v", userID, variant, ok)
+	}
+
+	tampered := func(key, value string) url.Values {
+		c := url.Values{}
+		for k, v := range q {
+			c[k] = v
+		}
+		if value == "" {
+			c.Del(key)
+		} else {
+			c.Set(key, value)
+		}
+		return c
+	}
+	expired := &urlSigner{key: signer.key, ttl: -time.Minute}
+	tests := []struct {
+		name string
+		id   string
+		q    url.Values
+	}{
+		{"expired", "att1", signedQuery(t, expired, "att1", thumbnailVariant, 42)},
+		{"wrong uid", "att1", tampered("uid", "43")},
+		{"changed variant", "att1", tampered("variant", "original")},
+		{"removed variant", "att1", tampered("variant", "")},
+		{"extended expiry", "att1", tampered("exp", "99999999999")},
+		{"other attachment", "att2", q},
+		{"tampered signature", "att1", tampered("sig", strings.Repeat("A", 43))},
+		{"missing signature", "att1", tampered("sig", "")},
+		{"missing uid", "att1", tampered("uid", "")},
+		{"other key", "att1", signedQuery(t, &urlSigner{key: []byte("other-key"), ttl: time.Hour}, "att1", thumbnailVariant, 42)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if userID, _, ok := signer.Verify(tt.id, tt.q); ok {
+				t.Errorf("Verify succeeded for user %d", userID)
+			}
+		})
+	}
+}
+
+func TestDeleteUnsentUploads(t *testing.T) {
+	db := newFakeDB()
+	svc, _ := newTestService(t, db)
+	blobs, err := thirdparty.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	before := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// A full batch and then one more stale upload
+	stale := unsentSweepBatch + 1
+	for i := 0; i < stale; i++ {
+		if err := blobs.Put(ctx, fmt.Sprintf("blobs/%d", i), strings.NewReader("png"), 3, "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := 0
+	db.onQuery("message_id IS NULL AND created_at < ?", func(args []driver.Value) [][]driver.Value {
+		if args[0] != before || args[1] != int64(unsentSweepBatch) {
+			t.Errorf("listed unsent uploads with %v", args)
+		}
+		var rows [][]driver.Value
+		for ; next < stale && len(rows) < unsentSweepBatch; next++ {
+			id := fmt.Sprint(next)
+			rows = append(rows, []driver.Value{id, int64(7), nil, id + ".png", "image/png", int64(3), int64(0), int64(0), "blobs/" + id, "", before.Add(-time.Hour)})
+		}
+		return rows
+	})
+
+	n, err := deleteUnsentUploads(svc, blobs, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != stale {
+		t.Errorf("deleted %d uploads, want %d", n, stale)
+	}
+	if deletes := db.executed("DELETE FROM attachments WHERE id IN"); len(deletes) != 2 || len(deletes[0].args) != unsentSweepBatch || len(deletes[1].args) != 1 {
+		t.Errorf("deleted in %d batches, want 2", len(deletes))
+	}
+	for i := 0; i < stale; i++ {
+		rc, err := blobs.Get(ctx, fmt.Sprintf("blobs/%d", i))
+		if err == nil {
+			rc.Close()
+		}
+		if !errors.Is(err, thirdparty.ErrBlobNotFound) {
+			t.Fatalf("blob %d: Get error = %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B, cut to six digits
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateTOTPKnownAnswers(t *testing.T) {
+	for unix, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		step, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(unix, 0), 0)
+		if !ok || step != unix/totpPeriod {
+			t.Errorf("ValidateTOTP(%s at %d) = %d, %v, want step %d", code, unix, step, ok, unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	// 050471 is the code of step 37037037
+	code := "050471"
+	for _, tt := range []struct {
+		unix int64
+		skew int
+		want bool
+	}{
+		{1111111111, 0, true},
+		{1111111111 + totpPeriod, 0, false},
+		{1111111111 + totpPeriod, 1, true},
+		{1111111111 - totpPeriod, 1, true},
+		{1111111111 + 2*totpPeriod, 1, false},
+	} {
+		step, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(tt.unix, 0), tt.skew)
+		if ok != tt.want || (ok && step != 37037037) {
+			t.Errorf("ValidateTOTP at %d with skew %d = %d, %v, want %v", tt.unix, tt.skew, step, ok, tt.want)
+		}
+	}
+
+	// Malformed codes and secrets never match
+	at := time.Unix(1111111111, 0)
+	for _, tt := range []struct{ secret, code string }{
+		{rfc6238Secret, "50471"},
+		{rfc6238Secret, "0050471"},
+		{"not base32!", code},
+	} {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, at, 1); ok {
+			t.Errorf("ValidateTOTP(%q, %q) matched", tt.secret, tt.code)
+		}
+	}
+	// Secrets are accepted in lower case
+	if _, ok := ValidateTOTP(strings.ToLower(rfc6238Secret), code, at, 0); !ok {
+		t.Error("lower case secret rejected")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	u, err := url.Parse(TOTPProvisioningURI("chat-go", "ada@example.com", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/chat-go:ada@example.com" {
+		t.Errorf("uri = %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != rfc6238Secret || q.Get("issuer") != "chat-go" || q.Get("digits") != "6" || q.Get("period") != "30" || q.Get("algorithm") != "SHA1" {
+		t.Errorf("uri parameters = %v", q)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if !format.MatchString(c) || seen[c] {
+			t.Errorf("bad or repeated recovery code %q", c)
+		}
+		seen[c] = true
+	}
+	if len(codes) != 10 {
+		t.Errorf("%d codes, want 10", len(codes))
+	}
+}
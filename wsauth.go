@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gitnoober/chat-go/service"
+	utils "github.com/gitnoober/chat-go/utils"
+)
+
+const (
+	// wsSubprotocol is the subprotocol the server accepts. Clients authenticating
+	// through Sec-WebSocket-Protocol offer it next to "bearer.<access_token>".
+	wsSubprotocol       = "chat-go"
+	wsBearerProtoPrefix = "bearer."
+	wsTicketPrefix      = "ws:ticket:"
+)
+
+// wsTicket is what a connect ticket stands for
+type wsTicket struct {
+	UserID    int    `json:"user_id"`
+	SessionID string `json:"session_id"`
+	Role      string `json:"role"`
+}
+
+// wsProtocolToken reads an access token offered as a "bearer.<token>" subprotocol
+func wsProtocolToken(r *http.Request) string {
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, proto := range strings.Split(header, ",") {
+			proto = strings.TrimSpace(proto)
+			if strings.HasPrefix(proto, wsBearerProtoPrefix) {
+				return strings.TrimPrefix(proto, wsBearerProtoPrefix)
+			}
+		}
+	}
+	return ""
+}
+
+// authenticateWebSocket authenticates a websocket handshake with a single-use
+// connect ticket (?ticket=), a "bearer.<token>" subprotocol or an Authorization
+// header. Access tokens are never read from the URL so they do not end up in logs.
+// Revoked sessions and disabled users are refused like on every other route.
+func authenticateWebSocket(svc *service.Service) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var claims *Claims
+			var err error
+			if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+				claims, err = redeemWSTicket(svc, ticket)
+			} else if token := wsProtocolToken(r); token != "" {
+				claims, err = validateAccessToken(token)
+			} else {
+				claims, err = validateAccessToken(bearerToken(r))
+			}
+			if err != nil || claims == nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			active, err := sessionActive(svc, claims)
+			if err != nil {
+				log.Printf("Error checking session: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if !active {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+		})
+	}
+}
+
+// redeemWSTicket consumes a connect ticket, returning nil claims if it is
+// unknown, expired or already used
+func redeemWSTicket(svc *service.Service, ticket string) (*Claims, error) {
+	raw, err := svc.GetRedisDataAndDelete(wsTicketPrefix + utils.GenerateSHA256Hash(ticket))
+	if err != nil || raw == "" {
+		return nil, err
+	}
+	var t wsTicket
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return nil, err
+	}
+	return &Claims{
+		Type:        accessTokenType,
+		SessionID:   t.SessionID,
+		Role:        t.Role,
+		Permissions: permissionsFor(t.Role),
+		userID:      t.UserID,
+	}, nil
+}
+
+// HandleWSTicket issues a short-lived single-use ticket for opening /ws, so the
+// access token itself never has to travel in the websocket URL
+func HandleWSTicket(w http.ResponseWriter, r *http.Request, svc *service.Service, ttl time.Duration) {
+	claims := claimsFromContext(r.Context())
+
+	ticket, err := newTokenID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(wsTicket{UserID: claims.UserID(), SessionID: claims.SessionID, Role: claims.Role})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Only the hash is stored, a Redis dump does not leak usable tickets
+	if err := svc.SetRedisData(wsTicketPrefix+utils.GenerateSHA256Hash(ticket), string(data), ttl); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": int(ttl.Seconds()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
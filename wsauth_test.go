@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/gitnoober/chat-go/config"
+	"github.com/gitnoober/chat-go/service"
+)
+
+// wsAuthTest is user 7 with the live session s1
+func wsAuthTest(t *testing.T) (*service.Service, *fakeRedis) {
+	t.Helper()
+	db := newFakeDB()
+	svc, rdb := newTestService(t, db)
+	db.onQuery("FROM users WHERE id IN", func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{args[0], "ada@example.com", "Ada", "", "", "user", false, "everyone", "everyone"}}
+	})
+	if err := svc.CreateSession(service.Session{ID: "s1", UserID: 7}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return svc, rdb
+}
+
+func TestWSTicketSingleUse(t *testing.T) {
+	svc, rdb := wsAuthTest(t)
+	ttl := 30 * time.Second
+	issue := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		HandleWSTicket(rec, withClaims(t, httptest.NewRequest(http.MethodPost, "/ws-ticket", nil), 7, "s1"), svc, ttl)
+		var response struct {
+			Ticket    string `json:"ticket"`
+			ExpiresIn int    `json:"expires_in"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Ticket == "" || response.ExpiresIn != 30 {
+			t.Fatalf("ticket response = %+v", response)
+		}
+		// Only the hash of the ticket is stored
+		if _, ok := rdb.get(wsTicketPrefix + response.Ticket); ok {
+			t.Fatal("ticket stored in the clear")
+		}
+		return response.Ticket
+	}
+
+	handler := authenticateWebSocket(svc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(claimsFromContext(r.Context()).UserID())
+	}))
+	connect := func(query string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ws"+query, nil))
+		return rec.Code
+	}
+
+	ticket := issue()
+	if code := connect("?ticket=" + ticket); code != http.StatusOK {
+		t.Fatalf("first use of a ticket: status %d, want 200", code)
+	}
+	if code := connect("?ticket=" + ticket); code != http.StatusUnauthorized {
+		t.Errorf("second use of a ticket: status %d, want 401", code)
+	}
+	if code := connect("?ticket=unknown"); code != http.StatusUnauthorized {
+		t.Errorf("unknown ticket: status %d, want 401", code)
+	}
+
+	ticket = issue()
+	rdb.advance(ttl)
+	if code := connect("?ticket=" + ticket); code != http.StatusUnauthorized {
+		t.Errorf("expired ticket: status %d, want 401", code)
+	}
+
+	// A ticket of a revoked session is refused
+	ticket = issue()
+	if err := svc.DeleteSession(7, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if code := connect("?ticket=" + ticket); code != http.StatusUnauthorized {
+		t.Errorf("ticket of a revoked session: status %d, want 401", code)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	svc, _ := wsAuthTest(t)
+	cfg := config.LoadConfig()
+	cfg.HTTPConfig.WSOriginPatterns = []string{"chat.example.com"}
+	srv := httptest.NewServer(newRouter(cfg, svc, newPool(), nil, nil, nil, nil, nil))
+	t.Cleanup(srv.Close)
+	token, err := generateToken(7, "s1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(query, origin string, protocols ...string) (*websocket.Conn, int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws"+query, &websocket.DialOptions{
+			HTTPHeader:   http.Header{"Origin": {origin}},
+			Subprotocols: protocols,
+		})
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		return conn, status, err
+	}
+
+	conn, _, err := dial("", "https://chat.example.com", wsSubprotocol, wsBearerProtoPrefix+token)
+	if err != nil {
+		t.Fatalf("allowed origin with a bearer subprotocol: %v", err)
+	}
+	if conn.Subprotocol() != wsSubprotocol {
+		t.Errorf("negotiated subprotocol %q, want %q", conn.Subprotocol(), wsSubprotocol)
+	}
+	conn.CloseNow()
+
+	if _, status, err := dial("", "https://evil.example.com", wsSubprotocol, wsBearerProtoPrefix+token); err == nil || status != http.StatusForbidden {
+		t.Errorf("other origin: status %d, err %v, want 403", status, err)
+	}
+	// Access tokens are not read from the URL
+	if _, status, err := dial("?token="+token, "https://chat.example.com"); err == nil || status != http.StatusUnauthorized {
+		t.Errorf("token in the query: status %d, err %v, want 401", status, err)
+	}
+}